@@ -1,6 +1,10 @@
+.import "runtime.b"
+
 main:
-    byte 0                   // 0 terminate the string
-    const "Hello world!\n"
-    rload 1                  // load stack pointer
+    const message            // address of the 0-terminated string
     call fmt.Print
-    return
\ No newline at end of file
+    return
+
+.data
+message:
+    .asciz "Hello world!\n"
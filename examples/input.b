@@ -1,3 +1,5 @@
+.import "runtime.b"
+
 main:
     byte 0                   // 0 terminate the string
     const "Please input a string and it will be echoed to the console:\n"
@@ -1,3 +1,5 @@
+.import "runtime.b"
+
 main:    
     // loop 50M times (just under half a second on Apple M1)
     const 50000000
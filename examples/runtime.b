@@ -1,45 +1,82 @@
+// System calls provided by the runtime (visible to every file)
+.define SYS_READC 0xA0
+.define SYS_EXIT 0xA4
+.define SYS_WRITE 0xA8
+
+// Registers
+.equ SP 1
+.equ FP 2
+
+// Devices and their commands
+.equ TIMER_PORT 0
+.equ TIMER_START 2
+.equ POWER_PORT 1
+.equ POWER_OFF 3
+.equ MMU_PORT 2
+.equ MMU_SET_BOUNDS 2
+.equ CONSOLE_PORT 3
+.equ CONSOLE_WRITE 3
+.equ CONSOLE_READ_CHAR 4
+
+// Interrupt vector table entries for hardware devices
+.equ TIMER_HANDLER 0x00
+.equ CONSOLE_HANDLER 0x0C
+
+.equ TIMER_MICROSECONDS 50000
+
+// Functions that programs linked against a separately assembled runtime can call
+.global fmt.Readc fmt.Strlen fmt.Print runtime.Exit
+
+// Every program provides main
+.extern main
+
+// Starts a timer that interrupts the CPU after the given number of microseconds
+.macro startTimer microseconds
+    const microseconds
+    const 4             // num bytes of data (we only write 32-bit microsecond value)
+    const 123           // interaction ID
+    write TIMER_PORT TIMER_START
+    pop 4               // remove result of write from stack
+.endm
+
     // adds input reserved bytes and program size bytes
     addi
     rkstore 3          // store in register[2] (tells us the beginning of unused heap), keep value on stack
     srstore 33         // store beginning of unused heap in special reserved register 33
 
     // Set up memory bounds
-    rload 1            // load stack pointer (max heap address)
-    rload 3            // load end of program+reserved segment (min heap address)
+    rload SP           // load stack pointer (max heap address)
+    const reservedBytes // min address (the program's code and static data stay addressable)
     const 8            // 8 bytes of input to write
     const 0            // unused interaction id
-    write 2 2          // set min/max memory bounds when in non-privileged mode
+    write MMU_PORT MMU_SET_BOUNDS // set min/max memory bounds when in non-privileged mode
     pop 4              // remove result of write from stack (TODO: check status)
 
     // Set up interrupt handlers
     
     // uncomment to allow runtime to interrupt process
     //const runtime.__timerExpired
-    //const 0x00
+    //const TIMER_HANDLER
     //storep32
 
     const runtime.__handleCharInput
-    const 0x0C
+    const CONSOLE_HANDLER
     storep32
 
     const runtime.__requestCharInput
-    const 0xA0
+    const SYS_READC
     storep32
 
     const runtime.__requestExit
-    const 0xA4
+    const SYS_EXIT
     storep32
 
     const runtime.__writeBytes
-    const 0xA8
+    const SYS_WRITE
     storep32
 
     // Set up a 0.05 second timer
-    const 50000         // microseconds
-    const 4             // num bytes of data (we only write 32-bit microsecond value)
-    const 123           // interaction ID
-    write 0 2           // write <port> <command> - port 0 is the timer interrupt device
-    pop 4               // remove result of write from stack
+    startTimer TIMER_MICROSECONDS
 
     // Move into non-privileged mode
     const 1
@@ -56,10 +93,10 @@
 // read 1 character from stdin and store result on stack
 fmt.Readc:
     const 0             // zeroed 4 bytes for return value
-    sysint 0xA0         // make a system call to get the next character (result is stored in register[3])
+    sysint SYS_READC    // make a system call to get the next character (result is stored in register[3])
     return 4            // return top 4 bytes on stack
 
-// 0xA0
+// SYS_READC
 //
 // fp[0] -> old PC
 // fp[4] -> old SP
@@ -67,7 +104,7 @@ fmt.Readc:
 // fp[12] -> old mode
 // fp[16] -> beginning of 4 byte buffer to store result
 runtime.__requestCharInput:
-    rload 2             // load fp
+    rload FP            // load fp
     addi 16             // address of return buffer at offset 16 bytes
     srload 33           // load register[33] which contains beginning of unused heap
     storep32            // place return buffer address at beginning of unused heap
@@ -75,16 +112,16 @@ runtime.__requestCharInput:
     // set up a character input request from console IO device
     const 0             // no input data
     const 0             // unused interaction id
-    write 3 4           // port 3 = console IO device, command 4 = read 32-bit character
+    write CONSOLE_PORT CONSOLE_READ_CHAR
     
     // At some point while spinning we will be interrupted to run runtime.__handleCharInput
-__waitForChar:
-    rload 2
+.waitForChar:
+    rload FP
     loadp32 16          // perform *(fp+16)
-    jz __waitForChar    // busy wait loop - could be replaced with context switch to other task in future
+    jz .waitForChar    // busy wait loop - could be replaced with context switch to other task in future
     resume              // data buffer no longer 0 - resume caller
 
-// 0x0C
+// CONSOLE_HANDLER
 //
 // stack[0] -> interaction id (fp[-12])
 // stack[4] -> number of bytes of input character (4) (fp[-8])
@@ -115,15 +152,15 @@ fmt.Strlen:
     const 0
     rkstore 4            // set up accumulator in register[4], keep value on stack
 
-__strlenloop:
+.loop:
     rload 3           
     addi                 // add string address to current accumulator value
     loadp8
-    jz __strlendone      // if current byte is 0 we're done
+    jz .done      // if current byte is 0 we're done
     raddi 4 1            // increment register[4] by 1, store new value on stack
-    jmp __strlenloop
+    jmp .loop
 
-__strlendone:
+.done:
     rload 4              // load value of counter
 
     rload 2              // load frame pointer
@@ -143,10 +180,10 @@ fmt.Print:
     rload 2              // load frame pointer
     loadp32 8            // skip past value of ret addr and frame pointer to get string address
     call fmt.Strlen
-    sysint 0xA8          // system call to runtime.__requestExit
+    sysint SYS_WRITE     // system call to runtime.__writeBytes
     return
 
-// 0xA8
+// SYS_WRITE
 //
 // fp[0] -> old PC
 // fp[4] -> old SP
@@ -161,20 +198,20 @@ runtime.__writeBytes:
     loadp32 16           // get number of bytes to write
     const 8              // 8 bytes of input
     const 0              // unused interaction id
-    write 3 3            // port 3 = console IO device, command 3 = write N bytes from address
+    write CONSOLE_PORT CONSOLE_WRITE // write N bytes from address
     resume
 
 runtime.Exit:
-    sysint 0xA4
+    sysint SYS_EXIT
 
-// 0xA4
+// SYS_EXIT
 runtime.__requestExit:
     const 0             // unused data
     const 0             // unused interaction id
-    write 1 3           // port 1 = power controller, command 3 = perform poweroff
+    write POWER_PORT POWER_OFF
     halt                // stops CPU here in case power device takes a bit to shutdown
 
-// 0x00
+// TIMER_HANDLER
 runtime.__timerExpired:
     byte 0
     const "interrupted by runtime\n"
@@ -182,9 +219,6 @@ runtime.__timerExpired:
     call fmt.Print
 
     // Set up a new 0.05 second timer
-    const 50000         // microseconds
-    const 4             // num bytes of data (we only write 32-bit microsecond value)
-    const 123           // interaction ID
-    write 0 2           // write <port> <command> - port 0 is the timer interrupt device
+    startTimer TIMER_MICROSECONDS
 
     resume
\ No newline at end of file
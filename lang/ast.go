@@ -0,0 +1,239 @@
+package lang
+
+import "fmt"
+
+// Kinds of types in the language
+type typeKind int
+
+const (
+	typeVoid typeKind = iota
+	typeInt
+	typeChar
+	typeFloat
+	typePointer
+	typeArray
+)
+
+// A type in the language. Pointers and arrays have an element type, and arrays have a length.
+type langType struct {
+	kind   typeKind
+	elem   *langType
+	length int
+}
+
+var (
+	voidType  = &langType{kind: typeVoid}
+	intType   = &langType{kind: typeInt}
+	charType  = &langType{kind: typeChar}
+	floatType = &langType{kind: typeFloat}
+)
+
+func pointerTo(elem *langType) *langType {
+	return &langType{kind: typePointer, elem: elem}
+}
+
+func (t *langType) String() string {
+	switch t.kind {
+	case typeVoid:
+		return "void"
+	case typeInt:
+		return "int"
+	case typeChar:
+		return "char"
+	case typeFloat:
+		return "float"
+	case typePointer:
+		return t.elem.String() + "*"
+	default:
+		return fmt.Sprintf("%s[%d]", t.elem, t.length)
+	}
+}
+
+// Number of bytes a value of the type takes up in memory
+func (t *langType) size() int {
+	switch t.kind {
+	case typeVoid:
+		return 0
+	case typeChar:
+		return 1
+	case typeArray:
+		return t.elem.size() * t.length
+	default:
+		return 4
+	}
+}
+
+func (t *langType) equals(other *langType) bool {
+	if t.kind != other.kind {
+		return false
+	} else if t.kind == typePointer || t.kind == typeArray {
+		return t.length == other.length && t.elem.equals(other.elem)
+	}
+
+	return true
+}
+
+// Integers and characters can be used interchangeably in arithmetic
+func (t *langType) isInteger() bool {
+	return t.kind == typeInt || t.kind == typeChar
+}
+
+// Types that can be used as a condition or compared
+func (t *langType) isScalar() bool {
+	return t.isInteger() || t.kind == typeFloat || t.kind == typePointer
+}
+
+// Arrays are used as a pointer to their first element everywhere except when declaring them
+func (t *langType) decay() *langType {
+	if t.kind == typeArray {
+		return pointerTo(t.elem)
+	}
+
+	return t
+}
+
+// A parsed source file
+type file struct {
+	globals   []*varDecl
+	functions []*function
+}
+
+type function struct {
+	pos        position
+	name       string
+	returnType *langType
+	params     []*varDecl
+	body       *blockStmt
+}
+
+// A variable declaration (global, local or parameter)
+type varDecl struct {
+	pos      position
+	name     string
+	varType  *langType
+	initExpr expr
+}
+
+type stmt interface {
+	stmtPos() position
+}
+
+type blockStmt struct {
+	pos   position
+	stmts []stmt
+}
+
+type declStmt struct {
+	decl *varDecl
+}
+
+type exprStmt struct {
+	expr expr
+}
+
+// lhs = rhs
+type assignStmt struct {
+	pos      position
+	lhs, rhs expr
+}
+
+type ifStmt struct {
+	pos      position
+	cond     expr
+	then     stmt
+	elseStmt stmt
+}
+
+// while loops are for loops without an init or post statement
+type forStmt struct {
+	pos  position
+	init stmt
+	cond expr
+	post stmt
+	body stmt
+}
+
+type returnStmt struct {
+	pos   position
+	value expr
+}
+
+// break or continue
+type branchStmt struct {
+	pos     position
+	keyword string
+}
+
+func (s *blockStmt) stmtPos() position  { return s.pos }
+func (s *declStmt) stmtPos() position   { return s.decl.pos }
+func (s *exprStmt) stmtPos() position   { return s.expr.exprPos() }
+func (s *assignStmt) stmtPos() position { return s.pos }
+func (s *ifStmt) stmtPos() position     { return s.pos }
+func (s *forStmt) stmtPos() position    { return s.pos }
+func (s *returnStmt) stmtPos() position { return s.pos }
+func (s *branchStmt) stmtPos() position { return s.pos }
+
+type expr interface {
+	exprPos() position
+}
+
+type intLit struct {
+	pos   position
+	value uint32
+	// Character literals have the char type
+	isChar bool
+}
+
+type floatLit struct {
+	pos   position
+	value float32
+}
+
+type stringLit struct {
+	pos   position
+	value string
+}
+
+type identExpr struct {
+	pos  position
+	name string
+}
+
+type unaryExpr struct {
+	pos     position
+	op      string
+	operand expr
+}
+
+type binaryExpr struct {
+	pos      position
+	op       string
+	lhs, rhs expr
+}
+
+type indexExpr struct {
+	pos           position
+	target, index expr
+}
+
+type callExpr struct {
+	pos  position
+	name string
+	args []expr
+}
+
+type castExpr struct {
+	pos     position
+	to      *langType
+	operand expr
+}
+
+func (e *intLit) exprPos() position     { return e.pos }
+func (e *floatLit) exprPos() position   { return e.pos }
+func (e *stringLit) exprPos() position  { return e.pos }
+func (e *identExpr) exprPos() position  { return e.pos }
+func (e *unaryExpr) exprPos() position  { return e.pos }
+func (e *binaryExpr) exprPos() position { return e.pos }
+func (e *indexExpr) exprPos() position  { return e.pos }
+func (e *callExpr) exprPos() position   { return e.pos }
+func (e *castExpr) exprPos() position   { return e.pos }
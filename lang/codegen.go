@@ -0,0 +1,947 @@
+package lang
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	gvm "gvm/vm"
+)
+
+/*
+	Code generation
+
+	Every expression leaves its value (always 4 bytes) on the stack. Functions use the same convention
+	as the runtime: the caller pushes the arguments in order and uses call, which leaves
+
+		fp[0] -> return address
+		fp[4] -> caller's frame pointer
+		fp[8] -> last argument
+		fp[12] -> the argument before it, and so on
+
+	Locals are placed below the frame pointer (the first one is at fp-4) and space for them is reserved
+	with push when the function starts. Functions that return a value use return 4 to leave it on top of
+	the arguments, and the caller moves it down into the first argument's slot before popping the rest.
+
+	Runtime calls use the public interrupts set up by runtime.b:
+		readc()          -> sysint 0xA0 (returns the next character from the console)
+		exit()           -> sysint 0xA4 (powers off)
+		write(buf, len)  -> sysint 0xA8 (writes len bytes starting at buf to the console)
+*/
+
+const (
+	// Public interrupts provided by runtime.b
+	sysReadc = 0xA0
+	sysExit  = 0xA4
+	sysWrite = 0xA8
+
+	// Registers used by the calling convention
+	regSP = 1
+	regFP = 2
+
+	// Offset from fp of the last argument (return address and caller's frame pointer come first)
+	paramsOffset = 8
+)
+
+// Where a variable lives
+type storageKind int
+
+const (
+	storageLocal storageKind = iota
+	storageParam
+	storageGlobal
+)
+
+type variable struct {
+	name    string
+	varType *langType
+	storage storageKind
+	// Offset from fp for locals and params
+	offset int
+}
+
+// The signature of a function that can be called
+type signature struct {
+	name       string
+	returnType *langType
+	params     []*langType
+}
+
+// Builtin functions that turn into runtime calls
+var builtins = map[string]*signature{
+	"readc": {name: "readc", returnType: intType},
+	"exit":  {name: "exit", returnType: voidType},
+	"write": {name: "write", returnType: voidType, params: []*langType{pointerTo(charType), intType}},
+}
+
+// Labels for the jumps out of a loop
+type loopLabels struct {
+	breakLabel, continueLabel string
+}
+
+// Holds the state for compiling a single source file
+type compiler struct {
+	name        string
+	diagnostics gvm.Diagnostics
+
+	// Lines of generated assembly for the .text section, globals and string literals (which both go in
+	// the .data section)
+	text     []string
+	data     []string
+	literals []string
+
+	functions map[string]*signature
+	globals   map[string]*variable
+	// Maps from string literal -> label of its data
+	stringLabels map[string]string
+	// Functions that have been called (used to decide which prelude functions are needed)
+	called map[string]bool
+
+	// State for the function currently being compiled
+	fn        *function
+	scopes    []map[string]*variable
+	frameSize int
+	loops     []loopLabels
+	labels    int
+}
+
+// Records an error at a position in the source
+func (c *compiler) errorf(pos position, format string, args ...any) {
+	c.diagnostics = append(c.diagnostics, gvm.Diagnostic{
+		File:     c.name,
+		Line:     pos.line,
+		Column:   pos.col,
+		Severity: gvm.SeverityError,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// Adds an instruction to the function being compiled
+func (c *compiler) emit(format string, args ...any) {
+	c.text = append(c.text, "    "+fmt.Sprintf(format, args...))
+}
+
+func (c *compiler) emitLabel(label string) {
+	c.text = append(c.text, label+":")
+}
+
+// Returns a new label that's local to the function being compiled
+func (c *compiler) newLabel() string {
+	c.labels++
+	return fmt.Sprintf(".L%d", c.labels)
+}
+
+// Registers the signature of every function so that functions can be called before they're defined
+func (c *compiler) declareFunctions(functions []*function, isPrelude bool) {
+	for _, fn := range functions {
+		if isPrelude {
+			if _, ok := c.functions[fn.name]; ok {
+				// The program has its own version
+				continue
+			}
+		} else if err := c.checkName(fn.pos, fn.name); err {
+			continue
+		} else if _, ok := c.functions[fn.name]; ok {
+			c.errorf(fn.pos, "function %s redefined", fn.name)
+			continue
+		}
+
+		sig := &signature{name: fn.name, returnType: fn.returnType}
+		for _, param := range fn.params {
+			sig.params = append(sig.params, param.varType)
+		}
+		c.functions[fn.name] = sig
+	}
+}
+
+// Reports names that can't be used for functions and globals since they'd clash with the runtime or
+// the assembler. Returns true if the name is invalid.
+func (c *compiler) checkName(pos position, name string) bool {
+	if _, ok := builtins[name]; ok {
+		c.errorf(pos, "%s is a builtin function", name)
+		return true
+	} else if strings.HasPrefix(name, "__") || name == "reservedBytes" || name == "instructionBytes" {
+		c.errorf(pos, "the name %s is reserved", name)
+		return true
+	}
+
+	return false
+}
+
+// Adds a global variable to the .data section
+func (c *compiler) compileGlobal(decl *varDecl) {
+	if c.checkName(decl.pos, decl.name) {
+		return
+	} else if _, ok := c.globals[decl.name]; ok {
+		c.errorf(decl.pos, "global %s redefined", decl.name)
+		return
+	} else if _, ok := c.functions[decl.name]; ok {
+		c.errorf(decl.pos, "global %s has the same name as a function", decl.name)
+		return
+	} else if decl.varType.kind == typeVoid {
+		c.errorf(decl.pos, "variable %s can't be void", decl.name)
+		return
+	}
+
+	c.globals[decl.name] = &variable{name: decl.name, varType: decl.varType, storage: storageGlobal}
+	c.data = append(c.data, "    .align 4", decl.name+":")
+	if decl.varType.kind == typeArray {
+		if decl.initExpr != nil {
+			c.errorf(decl.pos, "arrays can't be initialized")
+		}
+		c.data = append(c.data, fmt.Sprintf("    .space %d", decl.varType.size()))
+		return
+	}
+
+	value := "0"
+	if decl.initExpr != nil {
+		var ok bool
+		if value, ok = c.constantValue(decl.initExpr, decl.varType); !ok {
+			return
+		}
+	}
+	c.data = append(c.data, "    .word "+value)
+}
+
+// Returns the assembly for the value of a global's initializer, which has to be a constant
+func (c *compiler) constantValue(e expr, want *langType) (string, bool) {
+	negate := false
+	if unary, ok := e.(*unaryExpr); ok && unary.op == "-" {
+		negate, e = true, unary.operand
+	}
+
+	var value string
+	var valueType *langType
+	switch lit := e.(type) {
+	case *intLit:
+		n := lit.value
+		if negate {
+			n = -n
+		}
+		value, valueType = fmt.Sprint(n), intType
+	case *floatLit:
+		f := lit.value
+		if negate {
+			f = -f
+		}
+		value, valueType = fmt.Sprint(math.Float32bits(f)), floatType
+	case *stringLit:
+		if !negate {
+			value, valueType = c.stringLabel(lit.value), pointerTo(charType)
+		}
+	}
+
+	if valueType == nil {
+		c.errorf(e.exprPos(), "global initializer must be a constant")
+		return "", false
+	} else if !assignable(want, valueType) {
+		c.errorf(e.exprPos(), "can't initialize %s with %s", want, valueType)
+		return "", false
+	}
+
+	return value, true
+}
+
+// Returns the label of a string literal's data, adding it to the .data section the first time it's used
+func (c *compiler) stringLabel(value string) string {
+	if label, ok := c.stringLabels[value]; ok {
+		return label
+	}
+
+	label := fmt.Sprintf("__string.%d", len(c.stringLabels))
+	c.stringLabels[value] = label
+	c.literals = append(c.literals, label+":")
+	c.literals = append(c.literals, stringData(value)...)
+	return label
+}
+
+// Turns a string into .ascii and .byte directives followed by a 0 byte. Quotes, backslashes and
+// control characters are written as numbers so that they don't need to be escaped.
+func stringData(value string) []string {
+	var lines []string
+	for len(value) > 0 {
+		n := 0
+		for n < len(value) && value[n] >= ' ' && value[n] <= '~' && value[n] != '"' && value[n] != '\\' {
+			n++
+		}
+
+		if n > 0 {
+			lines = append(lines, fmt.Sprintf("    .ascii \"%s\"", value[:n]))
+			value = value[n:]
+			continue
+		}
+
+		lines = append(lines, fmt.Sprintf("    .byte %d", value[0]))
+		value = value[1:]
+	}
+
+	return append(lines, "    .byte 0")
+}
+
+// Returns true if a value of type from can be stored in a variable of type to
+func assignable(to, from *langType) bool {
+	from = from.decay()
+	switch {
+	case to.isInteger() && from.isInteger():
+		return true
+	case to.kind == typePointer && from.kind == typePointer:
+		// void* converts to and from any other pointer
+		return to.elem.kind == typeVoid || from.elem.kind == typeVoid || to.equals(from)
+	default:
+		return to.kind != typeArray && to.equals(from)
+	}
+}
+
+func (c *compiler) compileFunction(fn *function) {
+	c.fn, c.frameSize, c.loops = fn, 0, nil
+	c.scopes = []map[string]*variable{make(map[string]*variable)}
+
+	for i, param := range fn.params {
+		if param.varType.kind == typeVoid {
+			c.errorf(param.pos, "parameter %s can't be void", param.name)
+		} else if _, ok := c.scopes[0][param.name]; ok {
+			c.errorf(param.pos, "parameter %s redefined", param.name)
+		}
+
+		// The last argument is pushed last, so it's closest to the frame pointer
+		offset := paramsOffset + 4*(len(fn.params)-1-i)
+		c.scopes[0][param.name] = &variable{name: param.name, varType: param.varType, storage: storageParam, offset: offset}
+	}
+
+	// The body is generated first so that the size of the frame is known
+	start := len(c.text)
+	c.compileBlock(fn.body)
+	body := append([]string{}, c.text[start:]...)
+	c.text = c.text[:start]
+
+	c.text = append(c.text, "", fn.name+":")
+	if c.frameSize > 0 {
+		c.emit("push %d", c.frameSize)
+	}
+	c.text = append(c.text, body...)
+
+	// Falling off the end of a function returns 0 if it's supposed to return something
+	if fn.returnType.kind == typeVoid {
+		c.emit("return")
+	} else {
+		c.emit("const 0")
+		c.emit("return 4")
+	}
+}
+
+func (c *compiler) lookup(name string) *variable {
+	for i := len(c.scopes) - 1; i >= 0; i-- {
+		if v, ok := c.scopes[i][name]; ok {
+			return v
+		}
+	}
+
+	return c.globals[name]
+}
+
+func (c *compiler) compileBlock(block *blockStmt) {
+	c.scopes = append(c.scopes, make(map[string]*variable))
+	for _, s := range block.stmts {
+		c.compileStmt(s)
+	}
+	c.scopes = c.scopes[:len(c.scopes)-1]
+}
+
+func (c *compiler) compileStmt(s stmt) {
+	switch s := s.(type) {
+	case *blockStmt:
+		c.compileBlock(s)
+	case *declStmt:
+		c.compileLocal(s.decl)
+	case *exprStmt:
+		if t := c.compileExpr(s.expr); t != nil && t.kind != typeVoid {
+			c.emit("pop 4")
+		}
+	case *assignStmt:
+		c.compileAssign(s)
+	case *ifStmt:
+		elseLabel, endLabel := c.newLabel(), c.newLabel()
+		c.compileCond(s.cond, elseLabel)
+		c.compileStmt(s.then)
+		if s.elseStmt != nil {
+			c.emit("jmp %s", endLabel)
+		}
+
+		c.emitLabel(elseLabel)
+		if s.elseStmt != nil {
+			c.compileStmt(s.elseStmt)
+			c.emitLabel(endLabel)
+		}
+	case *forStmt:
+		c.compileFor(s)
+	case *returnStmt:
+		c.compileReturn(s)
+	case *branchStmt:
+		if len(c.loops) == 0 {
+			c.errorf(s.pos, "%s outside of a loop", s.keyword)
+			return
+		}
+
+		loop := c.loops[len(c.loops)-1]
+		if s.keyword == "break" {
+			c.emit("jmp %s", loop.breakLabel)
+		} else {
+			c.emit("jmp %s", loop.continueLabel)
+		}
+	}
+}
+
+func (c *compiler) compileLocal(decl *varDecl) {
+	scope := c.scopes[len(c.scopes)-1]
+	if _, ok := scope[decl.name]; ok {
+		c.errorf(decl.pos, "variable %s redefined", decl.name)
+		return
+	} else if decl.varType.kind == typeVoid {
+		c.errorf(decl.pos, "variable %s can't be void", decl.name)
+		return
+	}
+
+	// Every variable gets at least 4 bytes so that the frame stays aligned
+	c.frameSize += (decl.varType.size() + 3) &^ 3
+	v := &variable{name: decl.name, varType: decl.varType, storage: storageLocal, offset: -c.frameSize}
+
+	if decl.varType.kind == typeArray {
+		if decl.initExpr != nil {
+			c.errorf(decl.pos, "arrays can't be initialized")
+		}
+		scope[decl.name] = v
+		return
+	}
+
+	// Locals always start with a value so that programs behave the same every time they run
+	if decl.initExpr != nil {
+		c.compileValue(decl.initExpr, decl.varType, "initialize")
+	} else {
+		c.emit("const 0")
+	}
+
+	scope[decl.name] = v
+	c.storeVariable(v)
+}
+
+// Compiles an expression whose value is being stored in something of the given type
+func (c *compiler) compileValue(e expr, to *langType, action string) {
+	t := c.compileExpr(e)
+	if t == nil {
+		return
+	} else if !assignable(to, t) {
+		c.errorf(e.exprPos(), "can't %s %s with %s", action, to, t)
+	} else if to.kind == typeChar && t.kind != typeChar {
+		// Keep char variables in the range of a char
+		c.emit("and 255")
+	}
+}
+
+func (c *compiler) compileAssign(s *assignStmt) {
+	if ident, ok := s.lhs.(*identExpr); ok {
+		v := c.lookup(ident.name)
+		if v == nil {
+			c.errorf(ident.pos, "undefined: %s", ident.name)
+			return
+		} else if v.varType.kind == typeArray {
+			c.errorf(ident.pos, "can't assign to array %s", ident.name)
+			return
+		}
+
+		c.compileValue(s.rhs, v.varType, "assign")
+		c.storeVariable(v)
+		return
+	}
+
+	// Anything else is stored through a pointer. The address is generated first to find out what type is
+	// being stored, but it has to end up on top of the value.
+	addrStart := len(c.text)
+	elem := c.compileAddr(s.lhs)
+	if elem == nil {
+		return
+	}
+	addr := append([]string{}, c.text[addrStart:]...)
+	c.text = c.text[:addrStart]
+
+	c.compileValue(s.rhs, elem, "assign")
+	c.text = append(c.text, addr...)
+	c.emitStore(elem)
+}
+
+// Stores the value on the stack in a variable (which can't be an array)
+func (c *compiler) storeVariable(v *variable) {
+	switch v.storage {
+	case storageGlobal:
+		c.emit("const %s", v.name)
+		c.emit("storep32")
+	default:
+		c.emit("rload %d", regFP)
+		c.emit("storep32 %d", v.offset)
+	}
+}
+
+// Stores the value under the address on the stack in memory of the given type
+func (c *compiler) emitStore(t *langType) {
+	if t.size() == 1 {
+		c.emit("storep8")
+	} else {
+		c.emit("storep32")
+	}
+}
+
+// Loads a value of the given type from the address on the stack
+func (c *compiler) emitLoad(t *langType) {
+	if t.size() == 1 {
+		c.emit("loadp8")
+	} else {
+		c.emit("loadp32")
+	}
+}
+
+// Compiles a condition and jumps to the label if it's false
+func (c *compiler) compileCond(cond expr, falseLabel string) {
+	if t := c.compileExpr(cond); t != nil && !t.decay().isScalar() {
+		c.errorf(cond.exprPos(), "can't use %s as a condition", t)
+	}
+	c.emit("jz %s", falseLabel)
+}
+
+func (c *compiler) compileFor(s *forStmt) {
+	c.scopes = append(c.scopes, make(map[string]*variable))
+	defer func() { c.scopes = c.scopes[:len(c.scopes)-1] }()
+
+	if s.init != nil {
+		c.compileStmt(s.init)
+	}
+
+	topLabel, continueLabel, endLabel := c.newLabel(), c.newLabel(), c.newLabel()
+	c.emitLabel(topLabel)
+	if s.cond != nil {
+		c.compileCond(s.cond, endLabel)
+	}
+
+	c.loops = append(c.loops, loopLabels{breakLabel: endLabel, continueLabel: continueLabel})
+	c.compileStmt(s.body)
+	c.loops = c.loops[:len(c.loops)-1]
+
+	c.emitLabel(continueLabel)
+	if s.post != nil {
+		c.compileStmt(s.post)
+	}
+	c.emit("jmp %s", topLabel)
+	c.emitLabel(endLabel)
+}
+
+func (c *compiler) compileReturn(s *returnStmt) {
+	returnType := c.fn.returnType
+	if s.value == nil {
+		if returnType.kind != typeVoid {
+			c.errorf(s.pos, "%s has to return a value", c.fn.name)
+		}
+		c.emit("return")
+		return
+	} else if returnType.kind == typeVoid {
+		c.errorf(s.pos, "%s doesn't return a value", c.fn.name)
+		return
+	}
+
+	c.compileValue(s.value, returnType, "return")
+	c.emit("return 4")
+}
+
+// Compiles an expression, leaving its value on the stack (unless it's void). Returns the type of the
+// expression, or nil if there was a problem with it.
+func (c *compiler) compileExpr(e expr) *langType {
+	switch e := e.(type) {
+	case *intLit:
+		c.emit("const %d", e.value)
+		if e.isChar {
+			return charType
+		}
+		return intType
+	case *floatLit:
+		c.emit("const %d // %v", math.Float32bits(e.value), e.value)
+		return floatType
+	case *stringLit:
+		c.emit("const %s", c.stringLabel(e.value))
+		return pointerTo(charType)
+	case *identExpr:
+		return c.compileIdent(e)
+	case *unaryExpr:
+		return c.compileUnary(e)
+	case *binaryExpr:
+		return c.compileBinary(e)
+	case *indexExpr:
+		elem := c.compileAddr(e)
+		if elem != nil {
+			c.emitLoad(elem)
+		}
+		return elem
+	case *callExpr:
+		return c.compileCall(e)
+	case *castExpr:
+		return c.compileCast(e)
+	}
+
+	return nil
+}
+
+func (c *compiler) compileIdent(e *identExpr) *langType {
+	v := c.lookup(e.name)
+	if v == nil {
+		if _, ok := c.functions[e.name]; ok {
+			c.errorf(e.pos, "function %s can only be called", e.name)
+		} else {
+			c.errorf(e.pos, "undefined: %s", e.name)
+		}
+		return nil
+	}
+
+	// Arrays are used as the address of their first element
+	if v.varType.kind == typeArray {
+		c.emitVariableAddr(v)
+		return v.varType.decay()
+	}
+
+	if v.storage == storageGlobal {
+		c.emit("const %s", v.name)
+		c.emit("loadp32")
+	} else {
+		c.emit("rload %d", regFP)
+		c.emit("loadp32 %d", v.offset)
+	}
+	return v.varType
+}
+
+func (c *compiler) emitVariableAddr(v *variable) {
+	if v.storage == storageGlobal {
+		c.emit("const %s", v.name)
+	} else {
+		c.emit("rload %d", regFP)
+		c.emit("addi %d", v.offset)
+	}
+}
+
+// Compiles the address of something that can be assigned to, returning the type of what's at the address
+func (c *compiler) compileAddr(e expr) *langType {
+	switch e := e.(type) {
+	case *identExpr:
+		v := c.lookup(e.name)
+		if v == nil {
+			c.errorf(e.pos, "undefined: %s", e.name)
+			return nil
+		}
+
+		c.emitVariableAddr(v)
+		if v.varType.kind == typeArray {
+			return v.varType.elem
+		}
+		return v.varType
+	case *unaryExpr:
+		if e.op == "*" {
+			t := c.compileExpr(e.operand)
+			if t == nil {
+				return nil
+			} else if t = t.decay(); t.kind != typePointer || t.elem.kind == typeVoid {
+				c.errorf(e.pos, "can't dereference %s", t)
+				return nil
+			}
+			return t.elem
+		}
+	case *indexExpr:
+		return c.compileIndexAddr(e)
+	}
+
+	c.errorf(e.exprPos(), "can't take the address of this expression")
+	return nil
+}
+
+// Compiles target + index * element size
+func (c *compiler) compileIndexAddr(e *indexExpr) *langType {
+	indexType := c.compileExpr(e.index)
+	if indexType != nil && !indexType.isInteger() {
+		c.errorf(e.index.exprPos(), "index must be an integer, not %s", indexType)
+	}
+
+	target := c.compileExpr(e.target)
+	if target == nil || indexType == nil {
+		return nil
+	} else if target = target.decay(); target.kind != typePointer || target.elem.kind == typeVoid {
+		c.errorf(e.pos, "can't index %s", target)
+		return nil
+	}
+
+	c.scaleAndAdd(target.elem, "addi")
+	return target.elem
+}
+
+// With an integer under a pointer on the stack, leaves pointer <op> integer * element size
+func (c *compiler) scaleAndAdd(elem *langType, op string) {
+	if size := elem.size(); size != 1 {
+		// Scale the integer under the pointer by moving the pointer out of the way with the stack pointer
+		c.emit("rload %d", regSP)
+		c.emit("loadp32 4")
+		c.emit("muli %d", size)
+		c.emit("rload %d", regSP)
+		c.emit("storep32 8")
+	}
+	c.emit(op)
+}
+
+func (c *compiler) compileUnary(e *unaryExpr) *langType {
+	switch e.op {
+	case "&":
+		elem := c.compileAddr(e.operand)
+		if elem == nil {
+			return nil
+		}
+		return pointerTo(elem)
+	case "*":
+		elem := c.compileAddr(e)
+		if elem == nil {
+			return nil
+		}
+		c.emitLoad(elem)
+		return elem
+	}
+
+	t := c.compileExpr(e.operand)
+	if t == nil {
+		return nil
+	}
+
+	switch {
+	case e.op == "-" && t.isInteger():
+		c.emit("neg")
+		return intType
+	case e.op == "-" && t.kind == typeFloat:
+		c.emit("negf")
+		return floatType
+	case e.op == "!" && t.decay().isScalar():
+		c.emitBool("jz")
+		return intType
+	}
+
+	c.errorf(e.pos, "operator %s can't be used on %s", e.op, t)
+	return nil
+}
+
+// Replaces the value on top of the stack with 1 if the jump is taken and 0 if it isn't
+func (c *compiler) emitBool(jump string) {
+	trueLabel, endLabel := c.newLabel(), c.newLabel()
+	c.emit("%s %s", jump, trueLabel)
+	c.emit("const 0")
+	c.emit("jmp %s", endLabel)
+	c.emitLabel(trueLabel)
+	c.emit("const 1")
+	c.emitLabel(endLabel)
+}
+
+var (
+	intOps   = map[string]string{"+": "addi", "-": "subi", "*": "muli", "/": "divs", "%": "rems", "&": "and", "|": "or", "^": "Xor", "<<": "shiftl", ">>": "sar"}
+	floatOps = map[string]string{"+": "addf", "-": "subf", "*": "mulf", "/": "divf", "%": "remf"}
+	// Maps from comparison -> jump that's taken when the comparison is true (after cmp*)
+	comparisonJumps = map[string]string{"==": "jz", "!=": "jnz", "<": "jl", "<=": "jle", ">": "jg", ">=": "jge"}
+)
+
+func (c *compiler) compileBinary(e *binaryExpr) *langType {
+	if e.op == "&&" || e.op == "||" {
+		return c.compileLogical(e)
+	}
+
+	// The right hand side is pushed first so that the left hand side ends up on top, which is the order
+	// the stack instructions expect (subi computes stack[0] - stack[1])
+	rhs := c.compileExpr(e.rhs)
+	lhs := c.compileExpr(e.lhs)
+	if lhs == nil || rhs == nil {
+		return nil
+	}
+	lhs, rhs = c.promoteToFloat(lhs.decay(), rhs.decay())
+
+	if jump, ok := comparisonJumps[e.op]; ok {
+		switch {
+		case lhs.isInteger() && rhs.isInteger():
+			c.emit("cmps")
+		case lhs.kind == typeFloat && rhs.kind == typeFloat:
+			c.emit("cmpf")
+		case lhs.kind == typePointer && (rhs.kind == typePointer || rhs.isInteger()),
+			rhs.kind == typePointer && lhs.isInteger():
+			c.emit("cmpu")
+		default:
+			c.errorf(e.pos, "can't compare %s and %s", lhs, rhs)
+			return nil
+		}
+
+		c.emitBool(jump)
+		return intType
+	}
+
+	switch {
+	case lhs.isInteger() && rhs.isInteger():
+		c.emit(intOps[e.op])
+		return intType
+	case lhs.kind == typeFloat && rhs.kind == typeFloat && floatOps[e.op] != "":
+		c.emit(floatOps[e.op])
+		return floatType
+	case lhs.kind == typePointer && rhs.isInteger() && (e.op == "+" || e.op == "-") && lhs.elem.kind != typeVoid:
+		c.scaleAndAdd(lhs.elem, intOps[e.op])
+		return lhs
+	case lhs.isInteger() && rhs.kind == typePointer && e.op == "+" && rhs.elem.kind != typeVoid:
+		// The integer is on top so it can be scaled in place
+		if size := rhs.elem.size(); size != 1 {
+			c.emit("muli %d", size)
+		}
+		c.emit("addi")
+		return rhs
+	case lhs.kind == typePointer && rhs.kind == typePointer && e.op == "-" && lhs.equals(rhs) && lhs.elem.kind != typeVoid:
+		c.emit("subi")
+		if size := lhs.elem.size(); size != 1 {
+			c.emit("divs %d", size)
+		}
+		return intType
+	}
+
+	c.errorf(e.pos, "operator %s can't be used on %s and %s", e.op, lhs, rhs)
+	return nil
+}
+
+// Converts an integer operand to a float when the other operand is a float, like C does. The left hand
+// side is on top of the stack and the right hand side is below it.
+func (c *compiler) promoteToFloat(lhs, rhs *langType) (*langType, *langType) {
+	switch {
+	case lhs.isInteger() && rhs.kind == typeFloat:
+		c.emit("itof")
+		return floatType, rhs
+	case lhs.kind == typeFloat && rhs.isInteger():
+		c.emit("swap")
+		c.emit("itof")
+		c.emit("swap")
+		return lhs, floatType
+	}
+	return lhs, rhs
+}
+
+// && and || only evaluate the right hand side when they need to
+func (c *compiler) compileLogical(e *binaryExpr) *langType {
+	shortLabel, endLabel := c.newLabel(), c.newLabel()
+	jump := "jz"
+	if e.op == "||" {
+		jump = "jnz"
+	}
+
+	valid := true
+	for _, operand := range []expr{e.lhs, e.rhs} {
+		t := c.compileExpr(operand)
+		if t == nil {
+			valid = false
+		} else if !t.decay().isScalar() {
+			c.errorf(operand.exprPos(), "operator %s can't be used on %s", e.op, t)
+			valid = false
+		}
+		c.emit("%s %s", jump, shortLabel)
+	}
+
+	// Neither operand decided the result
+	if e.op == "&&" {
+		c.emit("const 1")
+	} else {
+		c.emit("const 0")
+	}
+	c.emit("jmp %s", endLabel)
+
+	c.emitLabel(shortLabel)
+	if e.op == "&&" {
+		c.emit("const 0")
+	} else {
+		c.emit("const 1")
+	}
+	c.emitLabel(endLabel)
+
+	if !valid {
+		return nil
+	}
+	return intType
+}
+
+func (c *compiler) compileCall(e *callExpr) *langType {
+	sig, isBuiltin := builtins[e.name]
+	if !isBuiltin {
+		var ok bool
+		if sig, ok = c.functions[e.name]; !ok {
+			c.errorf(e.pos, "undefined function: %s", e.name)
+			return nil
+		}
+		c.called[e.name] = true
+	}
+
+	if len(e.args) != len(sig.params) {
+		c.errorf(e.pos, "%s wanted %d arguments but got %d", e.name, len(sig.params), len(e.args))
+		return nil
+	}
+
+	for i, arg := range e.args {
+		param := sig.params[i]
+		// Any pointer can be written to the console
+		if e.name == "write" && i == 0 {
+			param = pointerTo(voidType)
+		}
+		c.compileValue(arg, param, "pass")
+	}
+
+	n := len(e.args)
+	switch {
+	case e.name == "readc":
+		// The runtime stores the character in the 4 bytes on top of the stack
+		c.emit("const 0")
+		c.emit("sysint %d", sysReadc)
+	case e.name == "exit":
+		c.emit("sysint %d", sysExit)
+	case e.name == "write":
+		c.emit("sysint %d", sysWrite)
+		c.emit("pop 8")
+	case sig.returnType.kind == typeVoid:
+		c.emit("call %s", e.name)
+		if n > 0 {
+			c.emit("pop %d", 4*n)
+		}
+	default:
+		c.emit("call %s", e.name)
+		if n > 0 {
+			// Move the return value into the first argument's slot and pop the rest
+			c.emit("rload %d", regSP)
+			c.emit("storep32 %d", 4*n)
+			if n > 1 {
+				c.emit("pop %d", 4*(n-1))
+			}
+		}
+	}
+
+	return sig.returnType
+}
+
+func (c *compiler) compileCast(e *castExpr) *langType {
+	t := c.compileExpr(e.operand)
+	if t == nil {
+		return nil
+	}
+
+	from, to := t.decay(), e.to
+	switch {
+	case to.kind == typeChar && from.kind != typeChar && (from.isInteger() || from.kind == typePointer):
+		c.emit("and 255")
+	case (to.isInteger() || to.kind == typePointer) && (from.isInteger() || from.kind == typePointer):
+	case to.kind == typeFloat && from.kind == typeFloat:
+	case to.kind == typeFloat && from.isInteger():
+		c.emit("itof")
+	case to.isInteger() && from.kind == typeFloat:
+		c.emit("ftoi")
+		if to.kind == typeChar {
+			c.emit("and 255")
+		}
+	default:
+		c.errorf(e.pos, "can't convert %s to %s", from, to)
+		return nil
+	}
+
+	return to
+}
@@ -0,0 +1,133 @@
+// Package lang compiles a small C-like language to GVM assembly.
+//
+// Programs are made of global variables and functions. The types are int, char, float, void (only as a
+// return type or as void*), pointers and fixed size arrays. Statements are blocks, declarations,
+// assignments, if/else, while, for, break, continue and return. Expressions support C's arithmetic,
+// bitwise, comparison and logical operators along with indexing, &, * and casts.
+//
+// The compiled code is linked with runtime.b, which calls main. The builtins readc(), write(buf, len) and
+// exit() use the runtime's public interrupts, and strlen, print, printc and printi are available unless
+// the program defines its own.
+package lang
+
+import (
+	"errors"
+	"strings"
+
+	gvm "gvm/vm"
+)
+
+// Compiles source to GVM assembly. The name is used for diagnostics.
+//
+// If compiling fails the returned error is of type gvm.Diagnostics.
+func Compile(name, source string) (string, error) {
+	f, err := parseSource(name, source)
+	if err != nil {
+		return "", err
+	}
+
+	preludeFile, err := parseSource("<prelude>", prelude)
+	if err != nil {
+		// The prelude is part of the compiler, so this is a bug
+		panic(err)
+	}
+
+	c := &compiler{
+		name:         name,
+		functions:    make(map[string]*signature),
+		globals:      make(map[string]*variable),
+		stringLabels: make(map[string]string),
+		called:       make(map[string]bool),
+	}
+
+	c.declareFunctions(f.functions, false)
+	c.declareFunctions(preludeFile.functions, true)
+	for _, global := range f.globals {
+		c.compileGlobal(global)
+	}
+
+	defined := make(map[string]bool)
+	for _, fn := range f.functions {
+		if !defined[fn.name] {
+			defined[fn.name] = true
+			c.compileFunction(fn)
+		}
+	}
+
+	if !defined["main"] {
+		c.errorf(position{line: 1}, "program has no main function")
+	}
+
+	// Prelude functions can call each other, so keep going until nothing new is called
+	for compiled := true; compiled; {
+		compiled = false
+		for _, fn := range preludeFile.functions {
+			if c.called[fn.name] && !defined[fn.name] {
+				defined[fn.name], compiled = true, true
+				c.compileFunction(fn)
+			}
+		}
+	}
+
+	if len(c.diagnostics) > 0 {
+		return "", c.diagnostics
+	}
+
+	lines := []string{"// Generated from " + name, ".global main", ".text"}
+	lines = append(lines, c.text...)
+	if len(c.data) > 0 || len(c.literals) > 0 {
+		lines = append(lines, "", ".data")
+		lines = append(lines, c.data...)
+		lines = append(lines, c.literals...)
+	}
+
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+// Compiles source into a relocatable object using the assembler's options. The object has to be linked
+// with runtime.b to run.
+func CompileObject(as *gvm.Assembler, name, source string) (*gvm.Object, error) {
+	asm, err := Compile(name, source)
+	if err != nil {
+		return nil, err
+	}
+
+	return as.AssembleSource(name, strings.Split(asm, "\n"))
+}
+
+// Compiles source and links it after the runtime object into a program that's ready to run
+func CompileProgram(as *gvm.Assembler, runtime *gvm.Object, name, source string) (gvm.Program, error) {
+	if runtime == nil {
+		return gvm.Program{}, errors.New("no runtime object given")
+	}
+
+	obj, err := CompileObject(as, name, source)
+	if err != nil {
+		return gvm.Program{}, err
+	}
+
+	return gvm.Link([]*gvm.Object{runtime, obj}, gvm.LinkOptions{})
+}
+
+// Lexes and parses source, turning any error into diagnostics
+func parseSource(name, source string) (*file, error) {
+	tokens, err := lex(source)
+	if err == nil {
+		var f *file
+		if f, err = parse(tokens); err == nil {
+			return f, nil
+		}
+	}
+
+	var srcErr *sourceError
+	if errors.As(err, &srcErr) {
+		return nil, gvm.Diagnostics{{
+			File:     name,
+			Line:     srcErr.pos.line,
+			Column:   srcErr.pos.col,
+			Severity: gvm.SeverityError,
+			Message:  srcErr.message,
+		}}
+	}
+	return nil, err
+}
@@ -0,0 +1,235 @@
+package lang
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	gvm "gvm/vm"
+)
+
+func assert(t *testing.T, cond bool, format string, args ...any) {
+	if !cond {
+		t.Fatalf(fmt.Sprintf("%v %s", cond, format), args...)
+	}
+}
+
+var (
+	featuresTest = `
+int counter = 3;
+float scale = 1.5;
+char* greeting = "globals\n";
+int squares[5];
+
+int fib(int n) {
+    if (n < 2) {
+        return n;
+    }
+    return fib(n - 1) + fib(n - 2);
+}
+
+void fill(int* values, int n) {
+    for (int i = 0; i < n; i = i + 1) {
+        values[i] = i * i;
+    }
+}
+
+int sum(int* values, int n) {
+    int total = 0;
+    int* end = values + n;
+    while (values < end) {
+        total = total + *values;
+        values = values + 1;
+    }
+    return total;
+}
+
+void upper(char* s) {
+    for (; *s != 0; s = s + 1) {
+        if (*s >= 'a' && *s <= 'z') {
+            *s = *s - 32;
+        }
+    }
+}
+
+int main() {
+    print(greeting);
+
+    printi(fib(15));
+    printc('\n');
+
+    fill(squares, 5);
+    printi(sum(squares, 5));
+    printc(' ');
+    printi(sum(&squares[2], 3));
+    printc('\n');
+
+    char buf[6];
+    buf[0] = 'h';
+    buf[1] = 'e';
+    buf[2] = 'l';
+    buf[3] = 'l';
+    buf[4] = 'o';
+    buf[5] = 0;
+    upper(buf);
+    print(buf);
+    printc('\n');
+
+    int i = 0;
+    while (1) {
+        i = i + 1;
+        if (i % 2 == 0) {
+            continue;
+        }
+        if (i > 7) {
+            break;
+        }
+        printi(i);
+    }
+    printc('\n');
+
+    printi(-17 / 1 + 0);
+    printc(' ');
+    printi(-2147483648);
+    printc(' ');
+    printi(7 % -3);
+    printc(' ');
+    printi(1 << 4 | 3 ^ 1);
+    printc(' ');
+    printi(!0 + !5);
+    printc('\n');
+
+    float x = 2.0 * scale;
+    if (x > 2.5 && x < 3.5 || counter == 0) {
+        print("float ok\n");
+    }
+
+    int* p = &counter;
+    *p = *p + 1;
+    printi(counter);
+    printc('\n');
+
+    char c = 300;
+    printi(c);
+    printc('\n');
+    return 0;
+}
+`
+	featuresOutput = "globals\n610\n30 29\nHELLO\n1357\n-17 -2147483648 1 18 1\nfloat ok\n4\n44\n"
+
+	numericTest = `
+int main() {
+    float f = (float)7 / 2.0;
+    printi((int)f);
+    printc(' ');
+    printi((int)-2.75);
+    printc(' ');
+    printi(-7 >> 1);
+    printc(' ');
+    printi(-7 / 2);
+    printc(' ');
+    float g = -f;
+    printi((int)(g * 10.0));
+    printc(' ');
+    printi((char)300.5);
+    printc('\n');
+
+    // Int operands are converted to float when mixed with a float
+    printi((int)(f * 2.0 + 1));
+    printc(' ');
+    printi((int)((float)7 / 2 * 4));
+    printc(' ');
+    printi((int)(10 - f));
+    printc(' ');
+    printi(3 < f);
+    printc('\n');
+    return 0;
+}
+`
+
+	echoTest = `
+// Echoes input back until a newline
+int main() {
+    int count = 0;
+    for (int c = readc(); c != '\n'; c = readc()) {
+        printc((char)c);
+        count = count + 1;
+    }
+    print(" (");
+    printi(count);
+    print(")\n");
+    exit();
+    print("not reached\n");
+}
+`
+)
+
+func compileAndRun(t *testing.T, source, stdin string) string {
+	runtime, err := (&gvm.Assembler{}).AssembleFiles("../examples/runtime.b")
+	assert(t, err == nil, "Failed to assemble runtime: %s", err)
+
+	program, err := CompileProgram(&gvm.Assembler{}, runtime, "test.gvc", source)
+	assert(t, err == nil, "Failed to compile: %s", err)
+
+	stdout := &strings.Builder{}
+	vm, err := gvm.NewVirtualMachine(program, gvm.WithStdout(stdout), gvm.WithStdin(strings.NewReader(stdin)))
+	assert(t, err == nil, "Failed to create new VM: %s", err)
+	err = vm.RunProgram()
+	assert(t, err == nil, "Program failed: %s", err)
+	return stdout.String()
+}
+
+func TestCompile(t *testing.T) {
+	output := compileAndRun(t, featuresTest, "")
+	assert(t, output == featuresOutput, "Unexpected program output: %q", output)
+
+	output = compileAndRun(t, numericTest, "")
+	assert(t, output == "3 -2 -4 -3 -35 44\n8 14 6 1\n", "Unexpected program output: %q", output)
+
+	output = compileAndRun(t, echoTest, "hey\n")
+	assert(t, output == "hey (3)\n", "Unexpected program output: %q", output)
+
+	// Only the prelude functions that are used are compiled, and programs can replace them
+	asm, err := Compile("test.gvc", "void print(char* s) {} int main() { print(\"x\"); return 0; }")
+	assert(t, err == nil, "Failed to compile: %s", err)
+	assert(t, !strings.Contains(asm, "strlen:"), "Unused prelude function was compiled:\n%s", asm)
+	assert(t, strings.Count(asm, "print:") == 1, "Prelude function was not replaced:\n%s", asm)
+
+	// The optimizer understands the generated code
+	runtime, err := (&gvm.Assembler{}).AssembleFiles("../examples/runtime.b")
+	assert(t, err == nil, "Failed to assemble runtime: %s", err)
+	program, err := CompileProgram(&gvm.Assembler{Optimize: true}, runtime, "test.gvc", featuresTest)
+	assert(t, err == nil, "Failed to compile: %s", err)
+	stdout := &strings.Builder{}
+	vm, err := gvm.NewVirtualMachine(program, gvm.WithStdout(stdout))
+	assert(t, err == nil, "Failed to create new VM: %s", err)
+	err = vm.RunProgram()
+	assert(t, err == nil, "Program failed: %s", err)
+	assert(t, stdout.String() == featuresOutput, "Unexpected optimized program output: %q", stdout.String())
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, tc := range []struct {
+		source string
+		err    string
+	}{
+		{"int main() { return 0 }", "test.gvc:1:23: error: expected ; but found }"},
+		{"int main() { int x = \"a; }", "test.gvc:1:22: error: unterminated string literal"},
+		{"int x;", "test.gvc:1: error: program has no main function"},
+		{"int main() { return y; }", "test.gvc:1:21: error: undefined: y"},
+		{"int main() { float f = 1; return 0; }", "test.gvc:1:24: error: can't initialize float with int"},
+		{"int main() { char* p = \"a\"; p = p * 2; return 0; }", "test.gvc:1:35: error: operator * can't be used on char* and int"},
+		{"void f(int a) {} int main() { f(); return 0; }", "test.gvc:1:31: error: f wanted 1 arguments but got 0"},
+		{"int main() { break; }", "test.gvc:1:14: error: break outside of a loop"},
+		{"void main() { return 1; }", "test.gvc:1:15: error: main doesn't return a value"},
+		{"int main() { int a[2]; a = 0; return 0; }", "test.gvc:1:24: error: can't assign to array a"},
+		{"int __x; int main() { return 0; }", "test.gvc:1:1: error: the name __x is reserved"},
+		{"int main() { char* p = \"a\"; float f = (float)p; return 0; }", "test.gvc:1:39: error: can't convert char* to float"},
+	} {
+		_, err := Compile("test.gvc", tc.source)
+		var diagnostics gvm.Diagnostics
+		assert(t, errors.As(err, &diagnostics), "Expected diagnostics for %q, got %v", tc.source, err)
+		assert(t, err.Error() == tc.err, "Unexpected error for %q:\n%s", tc.source, err)
+	}
+}
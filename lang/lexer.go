@@ -0,0 +1,275 @@
+package lang
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Kinds of tokens produced by the lexer
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenKeyword
+	tokenInt
+	tokenFloat
+	tokenChar
+	tokenString
+	tokenPunct
+)
+
+func (k tokenKind) String() string {
+	switch k {
+	case tokenEOF:
+		return "end of file"
+	case tokenIdent:
+		return "identifier"
+	case tokenKeyword:
+		return "keyword"
+	case tokenInt:
+		return "integer"
+	case tokenFloat:
+		return "float"
+	case tokenChar:
+		return "character"
+	case tokenString:
+		return "string"
+	default:
+		return "punctuation"
+	}
+}
+
+var keywords = map[string]bool{
+	"int": true, "float": true, "char": true, "void": true,
+	"if": true, "else": true, "while": true, "for": true,
+	"return": true, "break": true, "continue": true,
+}
+
+// Punctuation, longest first so that <= is matched before <
+var punctuation = []string{
+	"<<", ">>", "<=", ">=", "==", "!=", "&&", "||",
+	"+", "-", "*", "/", "%", "&", "|", "^", "!", "<", ">", "=",
+	"(", ")", "{", "}", "[", "]", ",", ";",
+}
+
+// A position in the source (both 1-based)
+type position struct {
+	line, col int
+}
+
+type token struct {
+	kind tokenKind
+	// Source text of the token (the decoded value for strings and characters)
+	text string
+	// Value of integer, float and character tokens
+	intValue   uint32
+	floatValue float32
+	pos        position
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokenEOF:
+		return t.kind.String()
+	case tokenString:
+		return strconv.Quote(t.text)
+	default:
+		return t.text
+	}
+}
+
+// An error at a position in the source
+type sourceError struct {
+	pos     position
+	message string
+}
+
+func (e *sourceError) Error() string {
+	return fmt.Sprintf("%d:%d: %s", e.pos.line, e.pos.col, e.message)
+}
+
+func errorAt(pos position, format string, args ...any) *sourceError {
+	return &sourceError{pos: pos, message: fmt.Sprintf(format, args...)}
+}
+
+// Splits source into tokens. Comments (// and /* */) are skipped.
+func lex(source string) ([]token, error) {
+	var tokens []token
+	line, lineStart := 1, 0
+	for i := 0; i < len(source); {
+		c := source[i]
+		pos := position{line: line, col: i - lineStart + 1}
+
+		switch {
+		case c == '\n':
+			line, lineStart = line+1, i+1
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case strings.HasPrefix(source[i:], "//"):
+			for i < len(source) && source[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(source[i:], "/*"):
+			end := strings.Index(source[i+2:], "*/")
+			if end < 0 {
+				return nil, errorAt(pos, "unterminated comment")
+			}
+
+			comment := source[i : i+2+end+2]
+			if n := strings.Count(comment, "\n"); n > 0 {
+				line, lineStart = line+n, i+strings.LastIndex(comment, "\n")+1
+			}
+			i += len(comment)
+		case isIdentStart(c):
+			start := i
+			for i < len(source) && isIdentChar(source[i]) {
+				i++
+			}
+
+			kind := tokenIdent
+			if keywords[source[start:i]] {
+				kind = tokenKeyword
+			}
+			tokens = append(tokens, token{kind: kind, text: source[start:i], pos: pos})
+		case isDigit(c) || c == '.' && i+1 < len(source) && isDigit(source[i+1]):
+			tok, n, err := lexNumber(source[i:], pos)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, tok)
+			i += n
+		case c == '"' || c == '\'':
+			tok, n, err := lexQuoted(source[i:], pos)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, tok)
+			i += n
+		default:
+			punct := ""
+			for _, p := range punctuation {
+				if strings.HasPrefix(source[i:], p) {
+					punct = p
+					break
+				}
+			}
+
+			if punct == "" {
+				return nil, errorAt(pos, "unexpected character %q", c)
+			}
+			tokens = append(tokens, token{kind: tokenPunct, text: punct, pos: pos})
+			i += len(punct)
+		}
+	}
+
+	return append(tokens, token{kind: tokenEOF, pos: position{line: line, col: len(source) - lineStart + 1}}), nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || isDigit(c)
+}
+
+// Lexes an integer (decimal or 0x hex) or float literal at the start of text, returning the token and
+// its length
+func lexNumber(text string, pos position) (token, int, error) {
+	n, isFloat := 0, false
+	if strings.HasPrefix(text, "0x") || strings.HasPrefix(text, "0X") {
+		n = 2
+	} else {
+		for n < len(text) && isDigit(text[n]) {
+			n++
+		}
+
+		if n < len(text) && text[n] == '.' {
+			isFloat = true
+			n++
+			for n < len(text) && isDigit(text[n]) {
+				n++
+			}
+		}
+
+		if n < len(text) && (text[n] == 'e' || text[n] == 'E') {
+			isFloat = true
+			n++
+			if n < len(text) && (text[n] == '+' || text[n] == '-') {
+				n++
+			}
+		}
+	}
+
+	// Anything else attached to the literal (like a suffix) makes it invalid
+	for n < len(text) && isIdentChar(text[n]) {
+		n++
+	}
+
+	literal := text[:n]
+	if isFloat {
+		f, err := strconv.ParseFloat(literal, 32)
+		if err != nil {
+			return token{}, 0, errorAt(pos, "invalid float literal %s", literal)
+		}
+		return token{kind: tokenFloat, text: literal, floatValue: float32(f), pos: pos}, n, nil
+	}
+
+	v, err := strconv.ParseUint(literal, 0, 32)
+	if err != nil {
+		return token{}, 0, errorAt(pos, "invalid integer literal %s (must fit in 32 bits)", literal)
+	}
+	return token{kind: tokenInt, text: literal, intValue: uint32(v), pos: pos}, n, nil
+}
+
+// Lexes a string or character literal at the start of text, returning the token and its length
+func lexQuoted(text string, pos position) (token, int, error) {
+	quote := text[0]
+	var value strings.Builder
+	i := 1
+	for ; i < len(text) && text[i] != quote; i++ {
+		c := text[i]
+		if c == '\n' {
+			break
+		} else if c != '\\' {
+			value.WriteByte(c)
+			continue
+		}
+
+		i++
+		if i >= len(text) {
+			break
+		}
+
+		escaped, ok := escapes[text[i]]
+		if !ok {
+			return token{}, 0, errorAt(position{pos.line, pos.col + i - 1}, "unknown escape sequence \\%c", text[i])
+		}
+		value.WriteByte(escaped)
+	}
+
+	if i >= len(text) || text[i] != quote {
+		return token{}, 0, errorAt(pos, "unterminated %s literal", map[byte]string{'"': "string", '\'': "character"}[quote])
+	}
+
+	if quote == '"' {
+		return token{kind: tokenString, text: value.String(), pos: pos}, i + 1, nil
+	}
+
+	if value.Len() != 1 {
+		return token{}, 0, errorAt(pos, "character literal must be a single character")
+	}
+	return token{kind: tokenChar, text: text[:i+1], intValue: uint32(value.String()[0]), pos: pos}, i + 1, nil
+}
+
+var escapes = map[byte]byte{
+	'n': '\n', 't': '\t', 'r': '\r', '0': 0, 'a': '\a', 'b': '\b', 'f': '\f', 'v': '\v',
+	'\\': '\\', '\'': '\'', '"': '"',
+}
@@ -0,0 +1,498 @@
+package lang
+
+// Recursive descent parser. Binary operators are parsed by precedence climbing with the same
+// precedence as C.
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// Binary operators from lowest to highest precedence
+var binaryPrecedence = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"|":  3,
+	"^":  4,
+	"&":  5,
+	"==": 6, "!=": 6,
+	"<": 7, "<=": 7, ">": 7, ">=": 7,
+	"<<": 8, ">>": 8,
+	"+": 9, "-": 9,
+	"*": 10, "/": 10, "%": 10,
+}
+
+func parse(tokens []token) (*file, error) {
+	p := &parser{tokens: tokens}
+	f := &file{}
+	for p.peek().kind != tokenEOF {
+		pos := p.peek().pos
+		declType, err := p.parseType()
+		if err != nil {
+			return nil, err
+		}
+
+		name, err := p.expectIdent()
+		if err != nil {
+			return nil, err
+		}
+
+		if p.accept("(") {
+			fn, err := p.parseFunction(pos, declType, name)
+			if err != nil {
+				return nil, err
+			}
+			f.functions = append(f.functions, fn)
+			continue
+		}
+
+		decl, err := p.parseVarDeclRest(pos, declType, name)
+		if err != nil {
+			return nil, err
+		}
+		f.globals = append(f.globals, decl)
+	}
+
+	return f, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// Returns true (and consumes the token) if the next token is the given punctuation or keyword
+func (p *parser) accept(text string) bool {
+	if tok := p.peek(); (tok.kind == tokenPunct || tok.kind == tokenKeyword) && tok.text == text {
+		p.pos++
+		return true
+	}
+
+	return false
+}
+
+func (p *parser) expect(text string) error {
+	if !p.accept(text) {
+		return errorAt(p.peek().pos, "expected %s but found %s", text, p.peek())
+	}
+
+	return nil
+}
+
+func (p *parser) expectIdent() (string, error) {
+	tok := p.peek()
+	if tok.kind != tokenIdent {
+		return "", errorAt(tok.pos, "expected a name but found %s", tok)
+	}
+
+	p.pos++
+	return tok.text, nil
+}
+
+// Returns true if the next token starts a type
+func (p *parser) atType() bool {
+	tok := p.peek()
+	return tok.kind == tokenKeyword && (tok.text == "int" || tok.text == "float" || tok.text == "char" || tok.text == "void")
+}
+
+// type := ('int' | 'float' | 'char' | 'void') '*'*
+func (p *parser) parseType() (*langType, error) {
+	if !p.atType() {
+		return nil, errorAt(p.peek().pos, "expected a type but found %s", p.peek())
+	}
+
+	var t *langType
+	switch p.next().text {
+	case "int":
+		t = intType
+	case "float":
+		t = floatType
+	case "char":
+		t = charType
+	default:
+		t = voidType
+	}
+
+	for p.accept("*") {
+		t = pointerTo(t)
+	}
+
+	return t, nil
+}
+
+// Parses everything after the name of a variable: an optional array length, an optional initial
+// value and the closing ;
+func (p *parser) parseVarDeclRest(pos position, declType *langType, name string) (*varDecl, error) {
+	decl := &varDecl{pos: pos, name: name, varType: declType}
+	if p.accept("[") {
+		tok := p.next()
+		if tok.kind != tokenInt || tok.intValue == 0 {
+			return nil, errorAt(tok.pos, "array length must be a positive integer")
+		}
+
+		decl.varType = &langType{kind: typeArray, elem: declType, length: int(tok.intValue)}
+		if err := p.expect("]"); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.accept("=") {
+		init, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		decl.initExpr = init
+	}
+
+	return decl, p.expect(";")
+}
+
+// function := type name '(' (type name (',' type name)*)? ')' block
+func (p *parser) parseFunction(pos position, returnType *langType, name string) (*function, error) {
+	fn := &function{pos: pos, name: name, returnType: returnType}
+	for !p.accept(")") {
+		if len(fn.params) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+
+		paramPos := p.peek().pos
+		paramType, err := p.parseType()
+		if err != nil {
+			return nil, err
+		}
+
+		paramName, err := p.expectIdent()
+		if err != nil {
+			return nil, err
+		}
+		fn.params = append(fn.params, &varDecl{pos: paramPos, name: paramName, varType: paramType})
+	}
+
+	body, err := p.parseBlock()
+	if err != nil {
+		return nil, err
+	}
+	fn.body = body
+	return fn, nil
+}
+
+func (p *parser) parseBlock() (*blockStmt, error) {
+	block := &blockStmt{pos: p.peek().pos}
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+
+	for !p.accept("}") {
+		if p.peek().kind == tokenEOF {
+			return nil, errorAt(p.peek().pos, "expected } but found %s", p.peek())
+		}
+
+		s, err := p.parseStmt()
+		if err != nil {
+			return nil, err
+		}
+		block.stmts = append(block.stmts, s)
+	}
+
+	return block, nil
+}
+
+func (p *parser) parseStmt() (stmt, error) {
+	tok := p.peek()
+	switch {
+	case tok.kind == tokenPunct && tok.text == "{":
+		return p.parseBlock()
+	case p.atType():
+		declType, err := p.parseType()
+		if err != nil {
+			return nil, err
+		}
+
+		name, err := p.expectIdent()
+		if err != nil {
+			return nil, err
+		}
+
+		decl, err := p.parseVarDeclRest(tok.pos, declType, name)
+		if err != nil {
+			return nil, err
+		}
+		return &declStmt{decl: decl}, nil
+	case p.accept("if"):
+		return p.parseIf(tok.pos)
+	case p.accept("while"):
+		return p.parseWhile(tok.pos)
+	case p.accept("for"):
+		return p.parseFor(tok.pos)
+	case p.accept("return"):
+		s := &returnStmt{pos: tok.pos}
+		if !p.accept(";") {
+			value, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			s.value = value
+			return s, p.expect(";")
+		}
+		return s, nil
+	case p.accept("break"), p.accept("continue"):
+		return &branchStmt{pos: tok.pos, keyword: tok.text}, p.expect(";")
+	}
+
+	s, err := p.parseSimpleStmt()
+	if err != nil {
+		return nil, err
+	}
+	return s, p.expect(";")
+}
+
+// An expression or an assignment (used on its own and in for loops)
+func (p *parser) parseSimpleStmt() (stmt, error) {
+	pos := p.peek().pos
+	lhs, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+
+	if !p.accept("=") {
+		return &exprStmt{expr: lhs}, nil
+	}
+
+	rhs, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	return &assignStmt{pos: pos, lhs: lhs, rhs: rhs}, nil
+}
+
+// Parses a parenthesized condition
+func (p *parser) parseCond() (expr, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+
+	cond, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	return cond, p.expect(")")
+}
+
+func (p *parser) parseIf(pos position) (stmt, error) {
+	cond, err := p.parseCond()
+	if err != nil {
+		return nil, err
+	}
+
+	then, err := p.parseStmt()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &ifStmt{pos: pos, cond: cond, then: then}
+	if p.accept("else") {
+		if s.elseStmt, err = p.parseStmt(); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+func (p *parser) parseWhile(pos position) (stmt, error) {
+	cond, err := p.parseCond()
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := p.parseStmt()
+	if err != nil {
+		return nil, err
+	}
+
+	return &forStmt{pos: pos, cond: cond, body: body}, nil
+}
+
+// for '(' simple? ';' expr? ';' simple? ')' stmt
+func (p *parser) parseFor(pos position) (stmt, error) {
+	s := &forStmt{pos: pos}
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if !p.accept(";") {
+		if p.atType() {
+			// Declarations include their own ;
+			if s.init, err = p.parseStmt(); err != nil {
+				return nil, err
+			}
+		} else if s.init, err = p.parseSimpleStmt(); err != nil {
+			return nil, err
+		} else if err := p.expect(";"); err != nil {
+			return nil, err
+		}
+	}
+
+	if !p.accept(";") {
+		if s.cond, err = p.parseExpr(); err != nil {
+			return nil, err
+		} else if err := p.expect(";"); err != nil {
+			return nil, err
+		}
+	}
+
+	if !p.accept(")") {
+		if s.post, err = p.parseSimpleStmt(); err != nil {
+			return nil, err
+		} else if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.body, err = p.parseStmt(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (p *parser) parseExpr() (expr, error) {
+	return p.parseBinary(1)
+}
+
+// Parses binary operators with at least the given precedence
+func (p *parser) parseBinary(minPrecedence int) (expr, error) {
+	lhs, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		tok := p.peek()
+		precedence, ok := binaryPrecedence[tok.text]
+		if tok.kind != tokenPunct || !ok || precedence < minPrecedence {
+			return lhs, nil
+		}
+
+		p.next()
+		rhs, err := p.parseBinary(precedence + 1)
+		if err != nil {
+			return nil, err
+		}
+		lhs = &binaryExpr{pos: tok.pos, op: tok.text, lhs: lhs, rhs: rhs}
+	}
+}
+
+// unary := ('-' | '!' | '*' | '&') unary | '(' type ')' unary | postfix
+func (p *parser) parseUnary() (expr, error) {
+	tok := p.peek()
+	if tok.kind == tokenPunct && (tok.text == "-" || tok.text == "!" || tok.text == "*" || tok.text == "&") {
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryExpr{pos: tok.pos, op: tok.text, operand: operand}, nil
+	}
+
+	// A type in parentheses is a cast
+	if tok.kind == tokenPunct && tok.text == "(" {
+		p.next()
+		if !p.atType() {
+			p.pos--
+			return p.parsePostfix()
+		}
+
+		to, err := p.parseType()
+		if err != nil {
+			return nil, err
+		} else if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &castExpr{pos: tok.pos, to: to, operand: operand}, nil
+	}
+
+	return p.parsePostfix()
+}
+
+// postfix := primary ('[' expr ']')*
+func (p *parser) parsePostfix() (expr, error) {
+	e, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		tok := p.peek()
+		if !p.accept("[") {
+			return e, nil
+		}
+
+		index, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		} else if err := p.expect("]"); err != nil {
+			return nil, err
+		}
+		e = &indexExpr{pos: tok.pos, target: e, index: index}
+	}
+}
+
+// primary := int | float | char | string | name | name '(' args ')' | '(' expr ')'
+func (p *parser) parsePrimary() (expr, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokenInt:
+		return &intLit{pos: tok.pos, value: tok.intValue}, nil
+	case tokenChar:
+		return &intLit{pos: tok.pos, value: tok.intValue, isChar: true}, nil
+	case tokenFloat:
+		return &floatLit{pos: tok.pos, value: tok.floatValue}, nil
+	case tokenString:
+		return &stringLit{pos: tok.pos, value: tok.text}, nil
+	case tokenIdent:
+		if !p.accept("(") {
+			return &identExpr{pos: tok.pos, name: tok.text}, nil
+		}
+
+		call := &callExpr{pos: tok.pos, name: tok.text}
+		for !p.accept(")") {
+			if len(call.args) > 0 {
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+			}
+
+			arg, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			call.args = append(call.args, arg)
+		}
+		return call, nil
+	case tokenPunct:
+		if tok.text == "(" {
+			e, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			return e, p.expect(")")
+		}
+	}
+
+	return nil, errorAt(tok.pos, "expected an expression but found %s", tok)
+}
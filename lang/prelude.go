@@ -0,0 +1,48 @@
+package lang
+
+// Functions every program can call without defining them. They're written in the language itself and
+// only compiled into programs that use them. A program can replace any of them by defining a function
+// with the same name.
+const prelude = `
+int strlen(char* s) {
+    int n = 0;
+    while (s[n] != 0) {
+        n = n + 1;
+    }
+    return n;
+}
+
+void print(char* s) {
+    write(s, strlen(s));
+}
+
+void printc(char c) {
+    write(&c, 1);
+}
+
+void printi(int n) {
+    // -2147483648 can't be negated
+    if (n == -2147483648) {
+        print("-2147483648");
+        return;
+    }
+
+    if (n < 0) {
+        printc('-');
+        n = -n;
+    }
+
+    // Digits are filled in from the end
+    char digits[10];
+    int i = 10;
+    while (1) {
+        i = i - 1;
+        digits[i] = '0' + n % 10;
+        n = n / 10;
+        if (n == 0) {
+            break;
+        }
+    }
+    write(&digits[i], 10 - i);
+}
+`
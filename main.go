@@ -1,15 +1,71 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"gvm/lang"
 	gvm "gvm/vm"
+	"math"
 	"os"
+	"slices"
+	"strings"
+	"time"
 )
 
 // Allows us to go into debug mode when needed
 var debugVM = flag.Bool("debug", false, "Enter into debug mode")
 
+// Allows untrusted programs to be stopped if they run for too long
+var maxInstructions = flag.Uint64("limit", 0, "Stop the program after this many instructions (0 means no limit)")
+var timeout = flag.Duration("timeout", 0, "Stop the program after it has run for this long (0 means no limit)")
+
+// Allows the physical memory size to be chosen at startup
+var memorySize = flag.Uint64("memory", 0, "Physical memory size in bytes, up to 4294967296 (0 uses the default of 65536)")
+
+// Allows assembled programs to be saved as a binary image instead of being run
+var outputImage = flag.String("o", "", "Write the assembled program to a binary image file instead of running it")
+
+// Allows source files to be assembled into relocatable objects that are linked later
+var assembleOnly = flag.Bool("c", false, "Assemble the source files into a relocatable object (written to -o) instead of linking them")
+var loadAddress = flag.Uint("load", 0, "Address to load the program at when linking (0 loads it directly after the interrupt vector table)")
+var linkMap = flag.String("map", "", "Write a map of where each section and symbol was placed to this file when linking")
+
+// Allows the peephole optimizer to be run over assembled source files
+var optimize = flag.Bool("O", false, "Optimize the assembled instructions")
+var optimizationReport = flag.Bool("optreport", false, "With -O, print what the optimizer changed")
+
+// Allows the assembly generated for .gvc source files to be inspected
+var printAssembly = flag.Bool("S", false, "Print the assembly generated for .gvc files instead of running them")
+
+// Allows programs and memory dumps to be turned back into assembly source
+var disassemble = flag.Bool("disasm", false, "Print assembly source for the program instead of running it")
+var rawMemory = flag.Bool("memdump", false, "With -disasm, treat the input file as a raw memory dump")
+var dumpMemory = flag.String("dump", "", "Write a raw memory dump to this file after the program stops running")
+
+// Allows a program that was stopped by -limit or -timeout to be saved and resumed later
+var saveSnapshot = flag.String("snapshot", "", "Write a snapshot of the VM to this file if the program stops before powering off")
+
+// Allows .include and .import to find files outside of the including file's directory
+var includePaths includePathList
+
+func init() {
+	flag.Var(&includePaths, "I", "Add a directory to search for included files (can be repeated)")
+}
+
+// Collects every -I flag in the order given
+type includePathList []string
+
+func (l *includePathList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *includePathList) Set(path string) error {
+	*l = append(*l, path)
+	return nil
+}
+
 func main() {
 	// Uncomment for CPU profiling (also shows you what was inlined vs not inlined)
 	// f, err := os.Create("pprof.cpu")
@@ -29,19 +85,269 @@ func main() {
 	// First argument is the path to the program
 	if len(args) == 0 {
 		fmt.Println("Usage: <file 1> [file 2] [file 3] ... [file N]")
+		fmt.Println("       <image file>")
+		fmt.Println("       <snapshot file>")
+		fmt.Println("       -c -o <object file> <file 1> [file 2] ... [file N]")
+		fmt.Println("       -S <file 1>.gvc [file 2].gvc ... [file N].gvc")
+		return
+	}
+
+	if *disassemble && *rawMemory {
+		memory, err := os.ReadFile(args[0])
+		if err == nil {
+			err = gvm.DisassembleMemory(memory, os.Stdout)
+		}
+
+		if err != nil {
+			fmt.Println(err)
+		}
+		return
+	}
+
+	if *printAssembly {
+		for _, file := range args {
+			asm, err := compileLangFile(file)
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+			fmt.Print(asm)
+		}
+		return
+	}
+
+	if *assembleOnly {
+		if *outputImage == "" {
+			fmt.Println("-c needs an object file to write to (use -o)")
+			return
+		}
+
+		obj, err := assembleObject(args)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+
+		printAssemblerOutput(obj)
+
+		if err := obj.WriteObjectFile(*outputImage); err != nil {
+			fmt.Println(err)
+		}
+		return
+	}
+
+	if len(args) == 1 && gvm.IsSnapshotFile(args[0]) {
+		// Resume a VM that was saved with -snapshot
+		vm, err := gvm.ReadSnapshotFile(args[0])
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+
+		runVM(vm)
+		return
+	}
+
+	var program gvm.Program
+	var err error
+	if len(args) == 1 && gvm.IsImageFile(args[0]) {
+		// Prebuilt image - no need to assemble anything
+		program, err = gvm.ReadImageFile(args[0])
+	} else {
+		program, err = linkFiles(args)
+	}
+
+	if err != nil {
+		fmt.Println(err)
 		return
 	}
 
-	program, err := gvm.CompileSource(*debugVM, args...)
+	if *outputImage != "" {
+		if err := program.WriteImageFile(*outputImage); err != nil {
+			fmt.Println(err)
+		}
+		return
+	}
+
+	if *disassemble {
+		if err := program.Disassemble(os.Stdout); err != nil {
+			fmt.Println(err)
+		}
+		return
+	}
+
+	options := []gvm.VMOption{}
+	if *memorySize != 0 {
+		options = append(options, gvm.WithMemorySize(*memorySize))
+	}
+
+	vm, err := gvm.NewVirtualMachine(program, options...)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
 
-	vm := gvm.NewVirtualMachine(program)
+	runVM(vm)
+}
+
+// Runs the VM according to the flags, then writes the memory dump and snapshot if they were requested
+func runVM(vm *gvm.VM) {
+	var err error
+	stopped := false
 	if *debugVM {
-		vm.RunProgramDebugMode()
+		err = vm.RunProgramDebugMode()
+	} else if *maxInstructions != 0 || *timeout != 0 {
+		limits := gvm.RunLimits{MaxInstructions: *maxInstructions}
+		if *timeout != 0 {
+			limits.Deadline = time.Now().Add(*timeout)
+		}
+
+		if result := vm.Run(context.Background(), limits); result.Reason != gvm.StopShutdown {
+			fmt.Println(result)
+			stopped = result.Reason != gvm.StopFault
+		}
 	} else {
-		vm.RunProgram()
+		err = vm.RunProgram()
 	}
+
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	if *dumpMemory != "" {
+		if err := writeMemoryDump(vm, *dumpMemory); err != nil {
+			fmt.Println(err)
+		}
+	}
+
+	if *saveSnapshot != "" && stopped {
+		if err := vm.WriteSnapshotFile(*saveSnapshot); err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+// Assembles the source files and links them with any object files. All of the assembly source files are
+// assembled together into one object, which is placed where the first assembly source file appears in the
+// list. Each .gvc file is compiled into its own object.
+func linkFiles(files []string) (gvm.Program, error) {
+	var objects []*gvm.Object
+	var sources []string
+	sourceIndex := -1
+	for _, file := range files {
+		if isLangFile(file) {
+			obj, err := compileLangObject(file)
+			if err != nil {
+				return gvm.Program{}, err
+			}
+			objects = append(objects, obj)
+			continue
+		}
+
+		if gvm.IsObjectFile(file) {
+			obj, err := gvm.ReadObjectFile(file)
+			if err != nil {
+				return gvm.Program{}, fmt.Errorf("%s: %w", file, err)
+			}
+			objects = append(objects, obj)
+			continue
+		}
+
+		if sourceIndex < 0 {
+			sourceIndex = len(objects)
+		}
+		sources = append(sources, file)
+	}
+
+	if len(sources) > 0 {
+		obj, err := newAssembler().AssembleFiles(sources...)
+		if err != nil {
+			return gvm.Program{}, err
+		}
+		objects = slices.Insert(objects, sourceIndex, obj)
+	}
+
+	for _, obj := range objects {
+		printAssemblerOutput(obj)
+	}
+
+	if *loadAddress > math.MaxUint32 {
+		return gvm.Program{}, fmt.Errorf("load address 0x%X does not fit into 32 bits", *loadAddress)
+	}
+
+	options := gvm.LinkOptions{LoadAddress: uint32(*loadAddress)}
+	if *linkMap != "" {
+		file, err := os.Create(*linkMap)
+		if err != nil {
+			return gvm.Program{}, err
+		}
+		defer file.Close()
+		options.Map = file
+	}
+
+	return gvm.Link(objects, options)
+}
+
+func newAssembler() *gvm.Assembler {
+	return &gvm.Assembler{Debug: *debugVM, IncludePaths: includePaths, Optimize: *optimize}
+}
+
+// Assembles the files given to -c, which are either assembly source files or a single .gvc file
+func assembleObject(files []string) (*gvm.Object, error) {
+	if slices.ContainsFunc(files, isLangFile) {
+		if len(files) > 1 {
+			return nil, errors.New("-c takes either assembly source files or a single .gvc file")
+		}
+		return compileLangObject(files[0])
+	}
+
+	return newAssembler().AssembleFiles(files...)
+}
+
+// Source files ending in .gvc are written in the high level language (see package lang)
+func isLangFile(file string) bool {
+	return strings.HasSuffix(file, ".gvc")
+}
+
+func compileLangFile(file string) (string, error) {
+	source, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+
+	return lang.Compile(file, string(source))
+}
+
+func compileLangObject(file string) (*gvm.Object, error) {
+	source, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return lang.CompileObject(newAssembler(), file, string(source))
+}
+
+// Prints the warnings for an object along with what the optimizer changed (if requested)
+func printAssemblerOutput(obj *gvm.Object) {
+	for _, warning := range obj.Warnings() {
+		fmt.Println(warning)
+	}
+
+	if *optimize && *optimizationReport && len(obj.OptimizationReport().Optimizations) > 0 {
+		fmt.Println(obj.OptimizationReport())
+	}
+}
+
+func writeMemoryDump(vm *gvm.VM, filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+
+	if err := vm.WriteMemoryDump(file); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
 }
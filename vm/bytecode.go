@@ -11,11 +11,12 @@ package gvm
 			- registers indexed 3 through 31 are general purpose, 32-bit
 			- 8 specialized registers (sr/srs)
 			- sr 0 is the CPU "mode" - 0 means unprivileged, 1 means privileged
-			- srs 1-7 can be used for anything
+			- sr 1 can be used for anything
+			- srs 2-7 (registers 34-39) are the interrupt controller (see interrupts.go)
 			- supports single stepping through instructions
 			- supports setting program breakpoints
 
-	The memory segment is 64kb in size minimum
+	The memory segment is 64kb in size by default (configurable from 4kb up to the full 4gb 32-bit address space)
 		- bytes 0-255 are reserved for the interrupt vector table (IVT)
 		- startup program starts at byte 256
 		- by default, entire memory segment is read/write at startup
@@ -53,7 +54,7 @@ package gvm
 			-> command 4 is "read 32-bit character"
 				-> expects no input
 				-> when data comes in, it is forwarded to handler address 0x0C
-		- ports 4-15 are currently unused
+		- ports 4-15 are currently unused (custom devices can be attached with VM.AttachDevice)
 
 	Exceptions
 		- There are 5 exceptions that can be caught and handled by the code
@@ -107,12 +108,39 @@ package gvm
 				storepX are essentially *stack[0] = stack[1]
 			-> each of the storep functions accept an optional address byte offset (becomes *(stack[0]+offset) = stack[1])
 
+		The block memory instructions work on a range of bytes at once. They pop all of their inputs, and the optional argument
+		is the number of bytes (otherwise it's taken from the stack after the addresses). Addresses are checked the same way as
+		loadpX/storepX, and the whole range has to be valid or nothing is written.
+
+			memcpy  [bytes] (copies bytes from address stack[1] to address stack[0], one byte at a time from the start, so a
+							 destination that overlaps the end of the source repeats the start of the source)
+			memmove [bytes] (copies bytes from address stack[1] to address stack[0] as if through a temporary buffer)
+			memset  [bytes] (fills bytes starting at address stack[0] with the low byte of stack[1])
+			memcmp  [bytes] (compares bytes at address stack[0] to bytes at address stack[1] and pushes -1, 0 or 1 the same way as cmpu)
+
+		The atomic instructions read and write a 32-bit value in a single instruction, so an interrupt can't run in between.
+		They pop all of their inputs and push the value that was in memory before. The optional argument is an address byte
+		offset, the same as for loadp32/storep32.
+
+			cas32      [offsetbytes] (if the value at address stack[0] equals stack[1], replaces it with stack[2])
+			xchg32     [offsetbytes] (replaces the value at address stack[0] with stack[1])
+			fetchadd32 [offsetbytes] (adds stack[1] to the value at address stack[0])
+
 		The push/pop instructions accept an optional argument. This argument is the number of bytes to push to or pop from the stack.
 		If no argument is specified, stack[0] should hold the bytes argument.
 
 			push [constant] (reserve bytes on the stack, advances stack pointer)
 			pop  [constant] (free bytes back to the stack, retracts stack pointer)
 
+		The stack manipulation instructions copy or reorder 32-bit values on the stack without going through a register.
+
+			dup  (pushes a copy of stack[0])
+			swap (exchanges stack[0] and stack[1])
+			over (pushes a copy of stack[1])
+			rot  (moves stack[2] to the top, so stack[0], stack[1] become stack[1], stack[2])
+			pick [constant] (pushes a copy of stack[constant], or of stack[N] after popping N if no argument is given)
+				-> pick 0 is the same as dup and pick 1 is the same as over
+
 		All arithmetic instructions accept an optional argument. This is a fast path that will perform stack[0] <op> arg and overwrite
 		the current stack value with the result.
 
@@ -120,6 +148,21 @@ package gvm
 			subi, subf [constant] (int and float sub)
 			muli, mulf [constant] (int and float mul)
 			divi, divf [constant] (int and float div)
+			divu, divs [constant] (unsigned and signed int div, divu is the same as divi)
+
+		The unary arithmetic and conversion instructions replace stack[0] with the result. Their optional argument is a fast path
+		that pushes the result for the argument instead, so neg 5 is the same as const 5; neg.
+
+			neg   [constant] (int negation)
+			negf  [constant] (float negation)
+			absf  [constant] (float absolute value)
+			sqrtf [constant] (float square root)
+			floor [constant] (rounds a float down to a whole number, result is still a float)
+			ceil  [constant] (rounds a float up to a whole number, result is still a float)
+
+			itof, utof [constant] (converts a signed or unsigned int to float)
+			ftoi, ftou [constant] (converts a float to a signed or unsigned int, truncating towards 0 - values out of range
+								   saturate to the closest int and NaN becomes 0)
 
 		The remainder functions work the same as % in languages such as C. It returns the remainder after dividing stack[0] and stack[1].
 		There is a fast path for these as well that performs remainder stack[0] arg.
@@ -135,8 +178,9 @@ package gvm
 			or  [constant] (logical OR between stack[0] and stack[1])
 			xor [constant] (logical XOR between stack[0] and stack[1])
 
-			shiftl (shift stack[0] left by stack[1])
-			shiftr (shift stack[0] right by stack[1])
+			shiftl [constant] (shift stack[0] left by stack[1])
+			shiftr [constant] (shift stack[0] right by stack[1], filling with zeros)
+			sar    [constant] (shift stack[0] right by stack[1], filling with copies of the sign bit)
 
 		Each of the jump instructions accept an optional argument. If no argument is specified, stack[0] is where
 		they check for their jump address. Otherwise the argument is treated as the jump address.
@@ -158,7 +202,8 @@ package gvm
 			return [bytes] (clear current stack frame and return to caller - if bytes is supplied, current top stack bytes are preserved for caller return values)
 			-> note that call and return go together - a return without a call will break the program
 
-			resume		   (similar to return, but for resuming from inside an interrupt handler)
+			resume		   (similar to return, but for resuming from inside an interrupt handler - also ends the interrupt
+			                the handler was for unless the interrupt controller is set to only end them through sr 36)
 
 			sysint <address> (invokes a privileged interrupt handler at <address>)
 				-> note that address range [0xA0, 0x100) is marked as "public" so non-privileged code can use them to
@@ -173,6 +218,7 @@ package gvm
 			rsubi, rsubf <register> [constant]
 			rmuli, rmulf <register> [constant]
 			rdivi, rdivf <register> [constant]
+			rdivs        <register> [constant] (signed int div)
 
 			rshiftl <register> [constant] (shift register left)
 			rshiftr <register> [constant] (shift register right)
@@ -209,6 +255,9 @@ package gvm
 
 			halt (puts CPU into "waiting for next instruction" state, which is interruptible)
 
+			cli (privileged, disables device interrupts - responses wait until they're enabled again, but exceptions are still raised)
+			sti (privileged, enables device interrupts)
+
 	Examples:
 			const 3 // stack: [3]
 			const 5 // stack: [5, 3]
@@ -245,6 +294,11 @@ const (
 	Storep32 Bytecode = 0x15
 	Push     Bytecode = 0x16
 	Pop      Bytecode = 0x17
+	Dup      Bytecode = 0x18
+	Swap     Bytecode = 0x19
+	Over     Bytecode = 0x1A
+	Rot      Bytecode = 0x1B
+	Pick     Bytecode = 0x1C
 
 	Addi Bytecode = 0x20
 	Addf Bytecode = 0x21
@@ -257,6 +311,8 @@ const (
 	Remu Bytecode = 0x28
 	Rems Bytecode = 0x29
 	Remf Bytecode = 0x2A
+	Divu Bytecode = 0x2B
+	Divs Bytecode = 0x2C
 
 	Not    Bytecode = 0x30
 	And    Bytecode = 0x31
@@ -264,6 +320,7 @@ const (
 	Xor    Bytecode = 0x33
 	Shiftl Bytecode = 0x35
 	Shiftr Bytecode = 0x34
+	Sar    Bytecode = 0x36
 
 	Jmp    Bytecode = 0x40
 	Jz     Bytecode = 0x41
@@ -278,6 +335,17 @@ const (
 	Call   Bytecode = 0x4A
 	Return Bytecode = 0x4B
 
+	Itof  Bytecode = 0x50
+	Utof  Bytecode = 0x51
+	Ftoi  Bytecode = 0x52
+	Ftou  Bytecode = 0x53
+	Floor Bytecode = 0x54
+	Ceil  Bytecode = 0x55
+	Neg   Bytecode = 0x56
+	Negf  Bytecode = 0x57
+	Absf  Bytecode = 0x58
+	Sqrtf Bytecode = 0x59
+
 	Raddi   Bytecode = 0x60
 	Raddf   Bytecode = 0x61
 	Rsubi   Bytecode = 0x62
@@ -288,6 +356,16 @@ const (
 	Rdivf   Bytecode = 0x67
 	Rshiftr Bytecode = 0x68
 	Rshiftl Bytecode = 0x69
+	Rdivs   Bytecode = 0x6A
+
+	Memcpy  Bytecode = 0x80
+	Memmove Bytecode = 0x81
+	Memset  Bytecode = 0x82
+	Memcmp  Bytecode = 0x83
+
+	Cas32      Bytecode = 0x84
+	Xchg32     Bytecode = 0x85
+	Fetchadd32 Bytecode = 0x86
 
 	Sysint Bytecode = 0x70
 	Resume Bytecode = 0x71
@@ -295,6 +373,8 @@ const (
 	Write   Bytecode = 0xF1
 	Srload  Bytecode = 0xF2
 	Srstore Bytecode = 0xF3
+	Cli     Bytecode = 0xF4
+	Sti     Bytecode = 0xF5
 
 	Halt Bytecode = 0xFF
 )
@@ -302,65 +382,93 @@ const (
 var (
 	// Maps from string -> instruction
 	strToInstrMap = map[string]Bytecode{
-		"nop":      Nop,
-		"byte":     Byte,
-		"const":    Const,
-		"rload":    Rload,
-		"rstore":   Rstore,
-		"rkstore":  Rkstore,
-		"loadp8":   Loadp8,
-		"loadp16":  Loadp16,
-		"loadp32":  Loadp32,
-		"storep8":  Storep8,
-		"storep16": Storep16,
-		"storep32": Storep32,
-		"push":     Push,
-		"pop":      Pop,
-		"addi":     Addi,
-		"addf":     Addf,
-		"subi":     Subi,
-		"subf":     Subf,
-		"muli":     Muli,
-		"mulf":     Mulf,
-		"divi":     Divi,
-		"divf":     Divf,
-		"remu":     Remu,
-		"rems":     Rems,
-		"remf":     Remf,
-		"not":      Not,
-		"and":      And,
-		"or":       Or,
-		"Xor":      Xor,
-		"shiftl":   Shiftl,
-		"shiftr":   Shiftr,
-		"jmp":      Jmp,
-		"jz":       Jz,
-		"jnz":      Jnz,
-		"jle":      Jle,
-		"jl":       Jl,
-		"jge":      Jge,
-		"jg":       Jg,
-		"cmpu":     Cmpu,
-		"cmps":     Cmps,
-		"cmpf":     Cmpf,
-		"call":     Call,
-		"return":   Return,
-		"raddi":    Raddi,
-		"raddf":    Raddf,
-		"rsubi":    Rsubi,
-		"rsubf":    Rsubf,
-		"rmuli":    Rmuli,
-		"rmulf":    Rmulf,
-		"rdivi":    Rdivi,
-		"rdivf":    Rdivf,
-		"rshiftl":  Rshiftl,
-		"rshiftr":  Rshiftr,
-		"sysint":   Sysint,
-		"resume":   Resume,
-		"write":    Write,
-		"srload":   Srload,
-		"srstore":  Srstore,
-		"halt":     Halt,
+		"nop":        Nop,
+		"byte":       Byte,
+		"const":      Const,
+		"rload":      Rload,
+		"rstore":     Rstore,
+		"rkstore":    Rkstore,
+		"loadp8":     Loadp8,
+		"loadp16":    Loadp16,
+		"loadp32":    Loadp32,
+		"storep8":    Storep8,
+		"storep16":   Storep16,
+		"storep32":   Storep32,
+		"push":       Push,
+		"pop":        Pop,
+		"dup":        Dup,
+		"swap":       Swap,
+		"over":       Over,
+		"rot":        Rot,
+		"pick":       Pick,
+		"addi":       Addi,
+		"addf":       Addf,
+		"subi":       Subi,
+		"subf":       Subf,
+		"muli":       Muli,
+		"mulf":       Mulf,
+		"divi":       Divi,
+		"divf":       Divf,
+		"remu":       Remu,
+		"rems":       Rems,
+		"remf":       Remf,
+		"divu":       Divu,
+		"divs":       Divs,
+		"neg":        Neg,
+		"negf":       Negf,
+		"absf":       Absf,
+		"sqrtf":      Sqrtf,
+		"not":        Not,
+		"and":        And,
+		"or":         Or,
+		"Xor":        Xor,
+		"shiftl":     Shiftl,
+		"shiftr":     Shiftr,
+		"sar":        Sar,
+		"itof":       Itof,
+		"utof":       Utof,
+		"ftoi":       Ftoi,
+		"ftou":       Ftou,
+		"floor":      Floor,
+		"ceil":       Ceil,
+		"jmp":        Jmp,
+		"jz":         Jz,
+		"jnz":        Jnz,
+		"jle":        Jle,
+		"jl":         Jl,
+		"jge":        Jge,
+		"jg":         Jg,
+		"cmpu":       Cmpu,
+		"cmps":       Cmps,
+		"cmpf":       Cmpf,
+		"call":       Call,
+		"return":     Return,
+		"raddi":      Raddi,
+		"raddf":      Raddf,
+		"rsubi":      Rsubi,
+		"rsubf":      Rsubf,
+		"rmuli":      Rmuli,
+		"rmulf":      Rmulf,
+		"rdivi":      Rdivi,
+		"rdivf":      Rdivf,
+		"rdivs":      Rdivs,
+		"rshiftl":    Rshiftl,
+		"rshiftr":    Rshiftr,
+		"memcpy":     Memcpy,
+		"memmove":    Memmove,
+		"memset":     Memset,
+		"memcmp":     Memcmp,
+		"cas32":      Cas32,
+		"xchg32":     Xchg32,
+		"fetchadd32": Fetchadd32,
+		"sysint":     Sysint,
+		"resume":     Resume,
+		"write":      Write,
+		"srload":     Srload,
+		"srstore":    Srstore,
+		"cli":        Cli,
+		"sti":        Sti,
+		"halt":       Halt,
 	}
 
 	// Maps from instruction -> string (built from strToInstrMap)
@@ -393,7 +501,7 @@ func (b Bytecode) IsRegisterWriteOp() bool {
 // Returns true for all instructions that both read and write to a register
 func (b Bytecode) IsRegisterReadWriteOp() bool {
 	return b == Raddi || b == Raddf || b == Rsubi || b == Rsubf || b == Rmuli || b == Rmulf || b == Rdivi || b == Rdivf ||
-		b == Rshiftl || b == Rshiftr
+		b == Rdivs || b == Rshiftl || b == Rshiftr
 }
 
 // Returns true if the instruction deals with hardware device interfacing
@@ -412,17 +520,36 @@ func (b Bytecode) NumRequiredOpArgs() int {
 	}
 }
 
+// Returns true for the instructions that work on a range of memory at once
+func (b Bytecode) IsBlockMemoryOp() bool {
+	return b == Memcpy || b == Memmove || b == Memset || b == Memcmp
+}
+
+// Returns true for the instructions that read and write a 32-bit value in one step
+func (b Bytecode) IsAtomicOp() bool {
+	return b == Cas32 || b == Xchg32 || b == Fetchadd32
+}
+
+// Returns true for the instructions that replace stack[0] with a function of it, or push the function of
+// their argument when they have one
+func (b Bytecode) IsUnaryArithmeticOp() bool {
+	return b == Neg || b == Negf || b == Absf || b == Sqrtf ||
+		b == Itof || b == Utof || b == Ftoi || b == Ftou || b == Floor || b == Ceil
+}
+
 // True if the bytecode can optionally accept an argument instead of always inspecting the stack
 func (b Bytecode) NumOptionalOpArgs() int {
-	if b == Addi || b == Addf || b == Subi || b == Subf || b == Muli || b == Mulf || b == Divi || b == Divf ||
+	if b == Addi || b == Addf || b == Subi || b == Subf || b == Muli || b == Mulf || b == Divi || b == Divf || b == Divu || b == Divs ||
 		b == Remu || b == Rems || b == Remf ||
+		b.IsUnaryArithmeticOp() ||
 		b == And || b == Or || b == Xor ||
-		b == Shiftl || b == Shiftr ||
-		b == Push || b == Pop ||
+		b == Shiftl || b == Shiftr || b == Sar ||
+		b == Push || b == Pop || b == Pick ||
 		b == Jmp || b == Jz || b == Jnz || b == Jle || b == Jl || b == Jge || b == Jg ||
 		b == Call || b == Return ||
 		b == Loadp8 || b == Loadp16 || b == Loadp32 ||
 		b == Storep8 || b == Storep16 || b == Storep32 ||
+		b.IsBlockMemoryOp() || b.IsAtomicOp() ||
 		b.IsRegisterReadWriteOp() {
 		return 1
 	} else {
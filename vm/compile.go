@@ -1,15 +1,13 @@
 package gvm
 
 import (
-	"bufio"
+	"cmp"
 	"errors"
 	"fmt"
 	"math"
-	"os"
-	"regexp"
+	"slices"
 	"strconv"
 	"strings"
-	"unicode"
 	"unsafe"
 )
 
@@ -29,7 +27,18 @@ const (
 
 type Program struct {
 	instructions []Instruction
-	debugSymMap  map[int]string
+	// Static data placed in memory directly after the instructions
+	data        []byte
+	debugSymMap map[int]string
+	// Address of the first instruction to execute (0 means the first instruction in the program)
+	entryPoint uint32
+	// Address the instructions are loaded at, with the static data directly after them (0 means
+	// directly after the interrupt vector table)
+	loadAddr uint32
+	// Non-fatal problems found while assembling
+	warnings Diagnostics
+	// What the optimizer changed (empty unless the program was optimized)
+	optimizations OptimizationReport
 }
 
 const (
@@ -62,6 +71,13 @@ const (
 	popNoArgs  uint16 = uint16(Pop)
 	popOneArg  uint16 = 0x0100 | uint16(Pop)
 
+	dupNoArgs  uint16 = uint16(Dup)
+	swapNoArgs uint16 = uint16(Swap)
+	overNoArgs uint16 = uint16(Over)
+	rotNoArgs  uint16 = uint16(Rot)
+	pickNoArgs uint16 = uint16(Pick)
+	pickOneArg uint16 = 0x0100 | uint16(Pick)
+
 	addiNoArgs uint16 = uint16(Addi)
 	addiOneArg uint16 = 0x0100 | uint16(Addi)
 	addfNoArgs uint16 = uint16(Addf)
@@ -81,6 +97,19 @@ const (
 	diviOneArg uint16 = 0x0100 | uint16(Divi)
 	divfNoArgs uint16 = uint16(Divf)
 	divfOneArg uint16 = 0x0100 | uint16(Divf)
+	divuNoArgs uint16 = uint16(Divu)
+	divuOneArg uint16 = 0x0100 | uint16(Divu)
+	divsNoArgs uint16 = uint16(Divs)
+	divsOneArg uint16 = 0x0100 | uint16(Divs)
+
+	negNoArgs   uint16 = uint16(Neg)
+	negOneArg   uint16 = 0x0100 | uint16(Neg)
+	negfNoArgs  uint16 = uint16(Negf)
+	negfOneArg  uint16 = 0x0100 | uint16(Negf)
+	absfNoArgs  uint16 = uint16(Absf)
+	absfOneArg  uint16 = 0x0100 | uint16(Absf)
+	sqrtfNoArgs uint16 = uint16(Sqrtf)
+	sqrtfOneArg uint16 = 0x0100 | uint16(Sqrtf)
 
 	remuNoArgs uint16 = uint16(Remu)
 	remuOneArg uint16 = 0x0100 | uint16(Remu)
@@ -101,6 +130,21 @@ const (
 	shiftLOneArg uint16 = 0x0100 | uint16(Shiftl)
 	shiftRNoArgs uint16 = uint16(Shiftr)
 	shiftROneArg uint16 = 0x0100 | uint16(Shiftr)
+	sarNoArgs    uint16 = uint16(Sar)
+	sarOneArg    uint16 = 0x0100 | uint16(Sar)
+
+	itofNoArgs  uint16 = uint16(Itof)
+	itofOneArg  uint16 = 0x0100 | uint16(Itof)
+	utofNoArgs  uint16 = uint16(Utof)
+	utofOneArg  uint16 = 0x0100 | uint16(Utof)
+	ftoiNoArgs  uint16 = uint16(Ftoi)
+	ftoiOneArg  uint16 = 0x0100 | uint16(Ftoi)
+	ftouNoArgs  uint16 = uint16(Ftou)
+	ftouOneArg  uint16 = 0x0100 | uint16(Ftou)
+	floorNoArgs uint16 = uint16(Floor)
+	floorOneArg uint16 = 0x0100 | uint16(Floor)
+	ceilNoArgs  uint16 = uint16(Ceil)
+	ceilOneArg  uint16 = 0x0100 | uint16(Ceil)
 
 	jmpNoArgs uint16 = uint16(Jmp)
 	jmpOneArg uint16 = 0x0100 | uint16(Jmp)
@@ -131,6 +175,22 @@ const (
 	// flushNoArgs  uint16 = uint16(Flush)
 	// readcNoArgs  uint16 = uint16(Readc)
 
+	memcpyNoArgs  uint16 = uint16(Memcpy)
+	memcpyOneArg  uint16 = 0x0100 | uint16(Memcpy)
+	memmoveNoArgs uint16 = uint16(Memmove)
+	memmoveOneArg uint16 = 0x0100 | uint16(Memmove)
+	memsetNoArgs  uint16 = uint16(Memset)
+	memsetOneArg  uint16 = 0x0100 | uint16(Memset)
+	memcmpNoArgs  uint16 = uint16(Memcmp)
+	memcmpOneArg  uint16 = 0x0100 | uint16(Memcmp)
+
+	cas32NoArgs      uint16 = uint16(Cas32)
+	cas32OneArg      uint16 = 0x0100 | uint16(Cas32)
+	xchg32NoArgs     uint16 = uint16(Xchg32)
+	xchg32OneArg     uint16 = 0x0100 | uint16(Xchg32)
+	fetchadd32NoArgs uint16 = uint16(Fetchadd32)
+	fetchadd32OneArg uint16 = 0x0100 | uint16(Fetchadd32)
+
 	sysintOneArg uint16 = 0x0100 | uint16(Sysint)
 	resumeNoArgs uint16 = uint16(Resume)
 
@@ -156,6 +216,8 @@ const (
 	rdiviTwoArgs uint16 = 0x0200 | uint16(Rdivi)
 	rdivfOneArg  uint16 = 0x0100 | uint16(Rdivf)
 	rdivfTwoArgs uint16 = 0x0200 | uint16(Rdivf)
+	rdivsOneArg  uint16 = 0x0100 | uint16(Rdivs)
+	rdivsTwoArgs uint16 = 0x0200 | uint16(Rdivs)
 
 	rshiftLOneArg  uint16 = 0x0100 | uint16(Rshiftl)
 	rshiftLTwoArgs uint16 = 0x0200 | uint16(Rshiftl)
@@ -165,14 +227,13 @@ const (
 	srLoadOneArg  uint16 = 0x0100 | uint16(Srload)
 	srStoreOneArg uint16 = 0x0100 | uint16(Srstore)
 
+	cliNoArgs uint16 = uint16(Cli)
+	stiNoArgs uint16 = uint16(Sti)
+
 	haltNoArgs uint16 = uint16(Halt)
 )
 
-// Allows us to easily find and replace commands from start to end of line
 var (
-	// TODO: Fix // inside of a string
-	comments = regexp.MustCompile(`//.*`)
-
 	// Allows us to replace \\* escape sequence with \*, such as \\n -> \n
 	// (happens when reading from console or file)
 	escapeSeqReplacements = map[string]string{
@@ -240,6 +301,16 @@ func (instr Instruction) String() string {
 	}
 }
 
+// Lower 8 bits of the code are the bytecode
+func (instr Instruction) bytecode() Bytecode {
+	return Bytecode(instr.code & 0xff)
+}
+
+// Upper 8 bits of the code are the number of op args
+func (instr Instruction) numArgs() int {
+	return int(instr.code >> 8)
+}
+
 // Checks for things like \\n and replaces it with \n
 func insertEscapeSeqReplacements(line string) string {
 	for orig, replace := range escapeSeqReplacements {
@@ -256,307 +327,629 @@ func revertEscapeSeqReplacements(line string) string {
 	return line
 }
 
+// A single line of assembly source along with where it came from
+type sourceLine struct {
+	file string
+	// 1-based line number within the file
+	line int
+	text string
+	// Set when the line came from expanding a macro (outermost expansion first)
+	expansions []MacroExpansion
+}
+
+// Returns the file whose constants are visible to the line. Lines from a macro see the constants
+// of the file where the macro was used.
+func (s sourceLine) scope() string {
+	if len(s.expansions) > 0 {
+		return s.expansions[0].File
+	}
+
+	return s.file
+}
+
+// Where a symbol is used from, which decides which constants and local and numeric labels a name
+// refers to
+type symbolScope struct {
+	// File whose .equ constants are visible
+	file string
+	// Global label that local labels belong to
+	label string
+	// Position of the line in the order lines were preprocessed
+	pos int
+}
+
+// A source line that has been split into an instruction and its (up to 2) arguments
+type preprocessedLine struct {
+	source sourceLine
+	scope  symbolScope
+	code   string
+	args   [2]string
+	// 1-based columns of the code and each argument (used for diagnostics)
+	codeCol int
+	argCols [2]int
+}
+
+// Holds the state for a single run of the assembler
+type assembler struct {
+	debugSymMap map[int]string
+
+	// Maps from label -> location and where it was defined so that redefinitions can be detected
+	labels    map[string]labelLocation
+	labelDefs map[string]sourceLine
+	// The global label that local labels are currently scoped to, and the positions of every definition
+	// of each numeric label (in order)
+	labelScope    string
+	numericLabels map[string][]int
+	// Number of lines preprocessed so far
+	linePos int
+
+	// Constants from .define (global) and .equ (maps from file -> constants)
+	globalConstants map[string]*constant
+	fileConstants   map[string]map[string]*constant
+	// All constants in the order they were defined
+	constants []*constant
+
+	// Macros that have been defined, the macro currently being defined (if any) and the number
+	// of expansions so far (used to give labels inside of macros unique names)
+	macros          map[string]*macro
+	macro           *macro
+	macroExpansions int
+
+	// Section that lines are currently being added to
+	section section
+
+	// Directories to search for included files, the files currently being included (to detect cycles)
+	// and every file that has been assembled so far (maps from absolute path -> true)
+	includePaths []string
+	includeStack []string
+	included     map[string]bool
+	// Order that files were first preprocessed in (diagnostics are sorted by it)
+	fileOrder map[string]int
+
+	// Static data from the .data section, the values that still need to be filled in once all
+	// labels are known and the largest alignment used by .align
+	data      []byte
+	dataItems []dataItem
+	dataAlign int
+
+	// Labels made visible to other objects with .global and symbols expected to come from other
+	// objects (declared with .extern)
+	globals []symbolDecl
+	externs map[string]bool
+	// Places where an address needs to be filled in by the linker
+	relocations []relocation
+
+	// Run the peephole optimizer over the instructions once they're assembled
+	optimize bool
+
+	lines       []preprocessedLine
+	diagnostics Diagnostics
+}
+
+// Where a label points to. Offsets are relative to the start of the label's section.
+type labelLocation struct {
+	section section
+	offset  int
+}
+
+func newAssembler(debug bool) *assembler {
+	a := &assembler{
+		labels:    make(map[string]labelLocation),
+		labelDefs: make(map[string]sourceLine),
+
+		numericLabels: make(map[string][]int),
+
+		globalConstants: make(map[string]*constant),
+		fileConstants:   make(map[string]map[string]*constant),
+
+		macros: make(map[string]*macro),
+
+		included:  make(map[string]bool),
+		fileOrder: make(map[string]int),
+
+		dataAlign: 1,
+		externs:   make(map[string]bool),
+	}
+
+	// If requested, set up the VM in debug mode
+	if debug {
+		a.debugSymMap = make(map[int]string)
+	}
+
+	return a
+}
+
+// Records an error at the given source line and column
+func (a *assembler) errorf(source sourceLine, col int, format string, args ...any) {
+	a.diagnostics = append(a.diagnostics, newDiagnostic(source, col, SeverityError, fmt.Sprintf(format, args...)))
+}
+
+// Records a warning at the given source line and column
+func (a *assembler) warnf(source sourceLine, col int, format string, args ...any) {
+	a.diagnostics = append(a.diagnostics, newDiagnostic(source, col, SeverityWarning, fmt.Sprintf(format, args...)))
+}
+
+// Puts the diagnostics in source order (by file, line and then column) instead of the order the
+// assembler's passes found them in
+func (a *assembler) sortDiagnostics() {
+	fileOrder := func(file string) int {
+		if order, ok := a.fileOrder[file]; ok {
+			return order
+		}
+		return len(a.fileOrder)
+	}
+
+	slices.SortStableFunc(a.diagnostics, func(x, y Diagnostic) int {
+		return cmp.Or(cmp.Compare(fileOrder(x.File), fileOrder(y.File)), cmp.Compare(x.Line, y.Line), cmp.Compare(x.Column, y.Column))
+	})
+}
+
+// Returns the scope that symbols used on the current line are looked up in
+func (a *assembler) currentScope(source sourceLine) symbolScope {
+	return symbolScope{file: source.scope(), label: a.labelScope, pos: a.linePos}
+}
+
+// Offset from the start of the .text section that the next preprocessed line will be placed at
+func (a *assembler) nextOffset() int {
+	return len(a.lines) * int(instructionBytes)
+}
+
 // Responsible for removing comments and whitespace and splitting an instruction into (instruction, argument0, argument1) triples
-func preprocessLine(line string, labels map[*regexp.Regexp]string, lines [][3]string, debugSym map[int]string) ([][3]string, error) {
-	line = comments.ReplaceAllString(line, "")
-	line = strings.TrimSpace(line)
+func (a *assembler) preprocessLine(source sourceLine) {
+	a.linePos++
+	lexed := lexLine(source.text)
+	line, col, fields := lexed.text, lexed.col, lexed.fields
+
+	// Lines inside of a macro definition are saved for when the macro is used
+	if a.macro != nil {
+		a.recordMacroLine(source, line, col)
+		return
+	}
 
 	// Check if the line was pure whitespace
 	if line == "" {
-		return lines, nil
+		return
+	} else if lexed.unterminated > 0 {
+		a.errorf(source, lexed.unterminated, "unterminated string: %s", line)
+		return
 		// Check if the line is a label
 	} else if strings.HasSuffix(line, ":") {
+		// Make sure the label doesn't contain any inner whitespace
+		if len(fields) > 1 {
+			a.errorf(source, col, "invalid label (inner whitespace not allowed): %s", line)
+			return
+		}
+
 		// Get rid of the : in the label
-		label := strings.ReplaceAll(line, ":", "")
+		written := strings.TrimSuffix(line, ":")
+		label, ok := a.labelName(source, written, col)
+		if !ok {
+			return
+		}
 
-		// Make sure the label doesn't contain any inner whitespace
-		if strings.ContainsFunc(label, unicode.IsSpace) {
-			return nil, fmt.Errorf("invalid label (inner whitespace not allowed): %s", line)
+		if prev, defined := a.labelDefs[label]; defined {
+			a.errorf(source, col, "label %s redefined (previous definition at %s:%d)", written, displayFileName(prev.file), prev.line)
+			return
 		}
 
-		// Compile into a regex pattern that only matches on label<word boundary> where label is at the beginning
-		// of the argument (so label inside of a string or quotes will be ignored)
-		r, err := regexp.Compile(fmt.Sprintf(`^%s\b`, label))
-		if err != nil {
-			return nil, fmt.Errorf("invalid label: %s", line)
+		a.labelDefs[label] = source
+		if a.section == sectionData {
+			a.labels[label] = labelLocation{section: sectionData, offset: len(a.data)}
+			return
 		}
+		a.labels[label] = labelLocation{section: sectionText, offset: a.nextOffset()}
 
-		labels[r] = fmt.Sprintf("%d", len(lines)*int(instructionBytes)+int(reservedBytes))
-		if debugSym != nil {
-			debugSym[len(lines)*int(instructionBytes)+int(reservedBytes)] = label
+		if a.debugSymMap != nil {
+			a.debugSymMap[a.nextOffset()] = label
 			// For debug symbols we add a nop so that we can preserve this line in the code
-			return append(lines, [3]string{"nop", "", ""}), nil
-		} else {
-			return lines, nil
-		}
-	} else {
-		split := strings.Split(line, " ")
-		code := split[0]
-		resultArgs := [2]string{}
-		if len(split) > 1 {
-			// Rejoin rest of split array into 1 string
-			args := strings.Join(split[1:], " ")
-
-			// If it starts with a double or single quote, insert escape sequence replacements
-			if strings.HasPrefix(args, "'") || strings.HasPrefix(args, "\"") {
-				guardC := args[0]
-				last := strings.LastIndex(args, string(guardC))
-
-				// Make sure the double or single quote also includes a terminating quote
-				if last <= 0 {
-					return nil, fmt.Errorf("unterminated character or string: %s", line)
-				}
-
-				// Insert escape sequence replacements for the characters in between the quotes
-				// re-add the quotes after (that's what guardC holds)
-				args = fmt.Sprintf("%c%s%c", guardC, insertEscapeSeqReplacements(args[1:last]), guardC)
-
-				// Recompute the last index since escape sequence replacements may have changed the string length
-				last = strings.LastIndex(args, string(guardC))
-
-				// last+1 so that the end single/double quote can be included
-				resultArgs[0] = args[:last+1]
-				resultArgs[1] = strings.TrimSpace(args[last+1:])
-			} else {
-				// Since we know the first arg wasn't quoted, remaining inputs should be numbers or labels
-				// which fit perfectly into 1 or 2 arguments
-				if len(split[1:]) > 2 {
-					return nil, fmt.Errorf("too many or invalid type of arguments to instruction: %s", line)
-				}
-
-				for i := 0; i < len(split[1:]); i++ {
-					resultArgs[i] = strings.TrimSpace(split[1:][i])
-				}
-			}
+			a.lines = append(a.lines, preprocessedLine{source: source, scope: a.currentScope(source), code: Nop.String(), codeCol: col})
 		}
+		return
+	} else if isDirective(line) {
+		a.preprocessDirective(source, line, fields)
+		return
+	} else if m, ok := a.macros[fields[0].text]; ok {
+		a.expandMacro(m, source, line, fields)
+		return
+	} else if a.section != sectionText {
+		a.errorf(source, col, "instructions are only allowed in the .text section: %s", line)
+		return
+	}
 
-		// If the instruction is `const arg` and the argument is a string,
-		// expand the instruction to be a series of `byte arg` instructions
-		//
-		// We need to do the expansion in the preprocess stage or the labels
-		// will end up pointing to the wrong instructions
-		if code == Const.String() && strings.HasPrefix(resultArgs[0], "\"") && strings.HasSuffix(resultArgs[0], "\"") {
-			bytes := []byte(resultArgs[0])
-			// Slice bytes to get rid of start and end quotes
-			bytes = bytes[1 : len(bytes)-1]
-
-			// Append instructions in reverse order so that the top value on the
-			// stack corresponds to the start of the string
-			for i := len(bytes) - 1; i >= 0; i-- {
-				if debugSym != nil {
-					// Since it's a debug symbol, add back the escaped characters
-					debugSym[len(lines)*int(instructionBytes)+int(reservedBytes)] = revertEscapeSeqReplacements(fmt.Sprintf("%s '%c'", Byte.String(), bytes[i]))
-				}
-
-				lines = append(lines, [3]string{Byte.String(), fmt.Sprintf("%d", bytes[i]), resultArgs[1]})
-			}
-		} else {
-			if debugSym != nil {
-				debugSym[len(lines)*int(instructionBytes)+int(reservedBytes)] = line
-			}
+	result := preprocessedLine{source: source, scope: a.currentScope(source), code: fields[0].text, codeCol: col}
+	args := fields[1:]
+	if len(args) > 2 {
+		a.errorf(source, args[2].col, "too many or invalid type of arguments to instruction: %s", line)
+		return
+	}
 
-			// Forward result args unchanged
-			lines = append(lines, [3]string{code, resultArgs[0], resultArgs[1]})
+	for i, arg := range args {
+		// If it's a string, insert escape sequence replacements for the characters in between the quotes
+		// (characters are handled when the argument is evaluated)
+		if strings.HasPrefix(arg.text, "\"") && strings.HasSuffix(arg.text, "\"") {
+			arg.text = fmt.Sprintf("\"%s\"", insertEscapeSeqReplacements(arg.text[1:len(arg.text)-1]))
 		}
 
-		return lines, nil
+		result.args[i], result.argCols[i] = arg.text, arg.col
 	}
-}
 
-// Converts 1 piece of input into a uint32. In the case of floats, it will be the unsigned bit representation.
-//
-// This function should be called only after all labels have been removed from the source arguments.
-func inputArgToUint32(strArg string) (uint32, error) {
-	if strArg == "" {
-		return math.MaxUint32, errors.New("invalid")
-	}
-
-	// Character - replace with number
-	if strings.HasPrefix(strArg, "'") {
-		runes := []rune(strArg)
-		// first rune should be quote, then number, then end quote (len == 3)
-		if len(runes) != 3 {
-			return math.MaxUint32, errors.New("character is too large to fit into 32 bits")
-		}
+	// If the instruction is `const arg` and the argument is a string,
+	// expand the instruction to be a series of `byte arg` instructions
+	//
+	// We need to do the expansion in the preprocess stage or the labels
+	// will end up pointing to the wrong instructions
+	if result.code == Const.String() && strings.HasPrefix(result.args[0], "\"") && strings.HasSuffix(result.args[0], "\"") {
+		bytes := []byte(result.args[0])
+		// Slice bytes to get rid of start and end quotes
+		bytes = bytes[1 : len(bytes)-1]
+
+		// Append instructions in reverse order so that the top value on the
+		// stack corresponds to the start of the string
+		for i := len(bytes) - 1; i >= 0; i-- {
+			if a.debugSymMap != nil {
+				// Since it's a debug symbol, add back the escaped characters
+				a.debugSymMap[a.nextOffset()] = revertEscapeSeqReplacements(fmt.Sprintf("%s '%c'", Byte.String(), bytes[i]))
+			}
 
-		return uint32(runes[1]), nil
+			byteLine := result
+			byteLine.code = Byte.String()
+			byteLine.args[0] = fmt.Sprintf("%d", bytes[i])
+			a.lines = append(a.lines, byteLine)
+		}
 	} else {
-		// Likely a regular number or float
-		if strings.Contains(strArg, ".") {
-			arg, err := strconv.ParseFloat(strArg, 32)
-			if err != nil {
-				return math.MaxUint32, err
-			}
+		if a.debugSymMap != nil {
+			a.debugSymMap[a.nextOffset()] = debugSource(source, line)
+		}
 
-			return math.Float32bits(float32(arg)), nil
-		} else {
-			base := 10
-			// Check for hex values
-			if strings.HasPrefix(strArg, "0x") {
-				base = 16
-				// Remove 0x from input
-				strArg = strings.Replace(strArg, "0x", "", 1)
-			}
+		// Forward result args unchanged
+		a.lines = append(a.lines, result)
+	}
+}
 
-			var arg uint32
-			var err error
-			if strings.HasPrefix(strArg, "-") {
-				r, e := strconv.ParseInt(strArg, base, 32)
-				arg = uint32(r)
-				err = e
-			} else {
-				r, e := strconv.ParseUint(strArg, base, 32)
-				arg = uint32(r)
-				err = e
-			}
+// Returns the source for a line in the debug symbol map. Lines that came from a macro also show
+// where the macro was used.
+func debugSource(source sourceLine, line string) string {
+	if len(source.expansions) == 0 {
+		return line
+	}
 
-			if err != nil {
-				return math.MaxUint32, err
-			}
+	expansion := source.expansions[len(source.expansions)-1]
+	return fmt.Sprintf("%s // %s (%s:%d)", line, expansion.Macro, displayFileName(expansion.File), expansion.Line)
+}
 
-			return arg, nil
-		}
+// Converts 1 argument into a value. In the case of floats, it will be the unsigned bit representation.
+// Any problems are recorded as diagnostics.
+func (a *assembler) argValue(line preprocessedLine, i int) (exprValue, bool) {
+	arg, col := line.args[i], line.argCols[i]
+
+	// A single float literal or float constant is converted to its bit representation
+	if isFloatLiteral(arg) {
+		f, _ := strconv.ParseFloat(arg, 32)
+		return exprValue{n: int64(math.Float32bits(float32(f)))}, true
+	} else if c, ok := a.lookupConstant(line.scope.file, arg); ok && a.evalConstant(c) && c.isFloat {
+		return c.result, true
 	}
+
+	v, err := evalExpr32(arg, a.symbolLookup(line.scope))
+	if err != nil {
+		a.exprErrorf(line.source, col, err)
+		return exprValue{}, false
+	}
+
+	return v, true
 }
 
-// Converts an input line from list of strings to a VM instruction
+// Converts a preprocessed line to a VM instruction, recording any problems as diagnostics. Arguments
+// that are addresses get a relocation so the linker can fill them in. index is where the instruction
+// goes in the .text section. Returns false if the line could not be converted.
 //
-// This function should be called only after all labels have been removed from the source arguments
-func parseInputLine(line [3]string) (Instruction, error) {
-	code, ok := strToInstrMap[line[0]]
+// This function should be called only after all labels have been found
+func (a *assembler) parseInputLine(line preprocessedLine, index int) (Instruction, bool) {
+	code, ok := strToInstrMap[line.code]
 	if !ok {
-		return Instruction{}, fmt.Errorf("unknown bytecode: %s", line[0])
+		a.errorf(line.source, line.codeCol, "unknown bytecode: %s", line.code)
+		return Instruction{}, false
 	}
 
 	// Run through each argument and try to convert them to uint32
-	args := [2]uint32{}
+	args := [2]exprValue{}
 	numArgs := 0
-	for i, arg := range line[1:] {
+	valid := true
+	for i, arg := range line.args {
 		if arg != "" {
 			numArgs++
-			n, err := inputArgToUint32(arg)
-			if err != nil {
-				return Instruction{}, err
+			v, ok := a.argValue(line, i)
+			if !ok {
+				valid = false
+				continue
 			}
 
-			args[i] = n
+			args[i] = v
 		}
 	}
 
 	// Make sure the number of arguments we received makes sense for this instruction
 	if maxArgs := code.NumRequiredOpArgs() + code.NumOptionalOpArgs(); numArgs < code.NumRequiredOpArgs() {
-		return Instruction{}, fmt.Errorf("%s wanted %d args but only got %d", code, code.NumRequiredOpArgs(), numArgs)
+		a.errorf(line.source, line.codeCol, "%s wanted %d args but only got %d", code, code.NumRequiredOpArgs(), numArgs)
+		return Instruction{}, false
 	} else if numArgs > maxArgs {
-		return Instruction{}, fmt.Errorf("%s can only support a max of %d args but got %d", code, maxArgs, numArgs)
+		a.errorf(line.source, line.codeCol, "%s can only support a max of %d args but got %d", code, maxArgs, numArgs)
+		return Instruction{}, false
 	}
 
-	if code.IsRegisterOp() || code.IsPrivilegedRegisterOp() {
-		// Register instructions accept a minimum of 1 16-bit argument, but some also have an optional
-		// 2nd 32-bit argument
-		return NewInstruction(byte(numArgs), code, uint16(args[0]), args[1]), nil
+	if !valid {
+		return Instruction{}, false
+	}
+
+	// Register instructions accept a minimum of 1 16-bit argument, but some also have an optional
+	// 2nd 32-bit argument. Other instructions with 2 arguments also put the first one in the register
+	// field.
+	usesRegister := code.IsRegisterOp() || code.IsPrivilegedRegisterOp() || numArgs > 1
+	argIndex := 0
+	if usesRegister {
+		argIndex = 1
+		if args[0].base != "" {
+			a.errorf(line.source, line.argCols[0], "%s can't take an address as its first argument", code)
+			return Instruction{}, false
+		}
+	}
+
+	var instr Instruction
+	if usesRegister {
+		instr = NewInstruction(byte(numArgs), code, uint16(args[0].n), uint32(args[1].n))
 	} else {
-		if numArgs > 1 {
-			return NewInstruction(byte(numArgs), code, uint16(args[0]), args[1]), nil
-		} else {
-			return NewInstruction(byte(numArgs), code, 0, args[0]), nil
+		instr = NewInstruction(byte(numArgs), code, 0, uint32(args[0].n))
+	}
+
+	if args[argIndex].base != "" {
+		a.relocations = append(a.relocations, relocation{
+			kind:   relocInstructionArg,
+			offset: index,
+			base:   args[argIndex].base,
+			addend: args[argIndex].n,
+		})
+	}
+
+	// Check for invalid register stores (need to keep program counter and stack pointer
+	// from being written over by the input code)
+	if code.IsRegisterOp() {
+		// Make sure the register read/write is within bounds
+		if instr.register >= uint16(numRegisters) {
+			a.errorf(line.source, line.argCols[0], "out of bounds register write: %s", instr)
+			return Instruction{}, false
+		}
+	}
+
+	if code.IsRegisterWriteOp() {
+		if instr.register < 3 {
+			a.errorf(line.source, line.argCols[0], "illegal register write (reg < 3): %s", instr)
+			return Instruction{}, false
 		}
 	}
+
+	return instr, true
 }
 
-// Takes a buffer of lines and assembles them into a program represented by a list of instructions
-// and a debug symbol map (if debug requested).
-func CompileSourceFromBuffer(debug bool, lines []string) (Program, error) {
-	if len(lines) == 0 {
-		return Program{}, errors.New("no source lines given")
+// Preprocesses the lines of a single file (or buffer). Every file starts out in the .text section, and
+// macro definitions can't span files.
+func (a *assembler) preprocessFile(lines []sourceLine) {
+	if len(lines) > 0 {
+		if _, ok := a.fileOrder[lines[0].file]; !ok {
+			a.fileOrder[lines[0].file] = len(a.fileOrder)
+		}
 	}
 
-	// If requested, set up the VM in debug mode
-	var debugSymMap map[int]string
-	if debug {
-		debugSymMap = make(map[int]string)
+	prevSection, prevScope := a.section, a.labelScope
+	a.section, a.labelScope = sectionText, ""
+	for _, line := range lines {
+		a.preprocessLine(line)
 	}
 
-	// Maps from regex(label) -> address string
-	labels := make(map[*regexp.Regexp]string)
-	preprocessedLines := make([][3]string, 0)
+	a.checkUnterminatedMacro()
+	a.section, a.labelScope = prevSection, prevScope
+}
 
-	// First preprocess line to remove whitespace lines and convert labels
-	// into line numbers
-	for _, line := range lines {
-		var err error
-		preprocessedLines, err = preprocessLine(string(line), labels, preprocessedLines, debugSymMap)
-		if err != nil {
-			return Program{}, err
+// Finishes assembling the preprocessed lines into a relocatable object. All problems are collected and
+// returned together as Diagnostics.
+func (a *assembler) assemble(name string) (*Object, error) {
+	// Now that all labels are known, constants can be evaluated. This is done in the order they
+	// were defined so that any problems with them are reported in a consistent order.
+	for _, c := range a.constants {
+		if global, ok := a.globalConstants[c.name]; ok && global != c {
+			a.warnf(c.source, c.nameCol, "constant %s shadows the global constant defined at %s:%d", c.name, displayFileName(global.source.file), global.source.line)
 		}
+
+		a.evalConstant(c)
+	}
+
+	// Fill in static data values
+	for _, item := range a.dataItems {
+		a.evalDataItem(item)
 	}
 
-	instructions := make([]Instruction, 0, len(preprocessedLines))
+	instructions := make([]Instruction, 0, len(a.lines))
 
 	// Parse each input line to generate a list of instructions
-	for _, line := range preprocessedLines {
-		// Replace all labels with their instruction address
-		for label, lineNum := range labels {
-			for i := range line[1:] {
-				// i+1 since line[1:] reduces the length by 1, but the main array
-				// is unchanged in size so we're off by 1
-				line[i+1] = label.ReplaceAllString(line[i+1], lineNum)
-			}
+	for i, line := range a.lines {
+		instr, ok := a.parseInputLine(line, i)
+		if ok {
+			instructions = append(instructions, instr)
 		}
+	}
 
-		instr, err := parseInputLine(line)
-		if err != nil {
-			return Program{}, err
+	obj := &Object{
+		name:         name,
+		instructions: instructions,
+		data:         a.data,
+		dataAlign:    a.dataAlign,
+		symbols:      make(map[string]objectSymbol, len(a.labels)),
+		relocations:  a.relocations,
+		debugSymMap:  a.debugSymMap,
+	}
+
+	for label, l := range a.labels {
+		obj.symbols[label] = objectSymbol{labelLocation: l}
+	}
+
+	for _, global := range a.globals {
+		sym, ok := obj.symbols[global.name]
+		if !ok {
+			a.errorf(global.source, global.col, "exported symbol %s is not defined", global.name)
+			continue
 		}
 
-		instructions = append(instructions, instr)
+		sym.exported = true
+		obj.symbols[global.name] = sym
 	}
 
-	// Check for invalid register stores (need to keep program counter and stack pointer
-	// from being written over by the input code)
-	for i, instr := range instructions {
-		code := Bytecode(instr.code & 0xff)
-		if code.IsRegisterOp() {
-			// Make sure the register read/write is within bounds
-			if instr.register >= uint16(numRegisters) {
-				return Program{}, fmt.Errorf("out of bounds register write at %d: %s", i, instr)
-			}
+	for name := range a.externs {
+		if _, ok := a.labels[name]; !ok {
+			obj.imports = append(obj.imports, name)
 		}
+	}
+	slices.Sort(obj.imports)
 
-		if code.IsRegisterWriteOp() {
-			if instr.register < 3 {
-				return Program{}, fmt.Errorf("illegal register write (reg < 3) at %d: %s", i, instr)
-			}
+	a.sortDiagnostics()
+	if a.diagnostics.hasErrors() {
+		return nil, a.diagnostics
+	}
+
+	if a.optimize {
+		sources := make([]sourceLine, len(a.lines))
+		for i, line := range a.lines {
+			sources[i] = line.source
 		}
+
+		// nops are kept in debug mode so that they can still have breakpoints set on them
+		obj.optimizations = optimizeObject(obj, sources, a.debugSymMap != nil)
 	}
 
-	return Program{instructions: instructions, debugSymMap: debugSymMap}, nil
+	obj.warnings = a.diagnostics
+	return obj, nil
 }
 
-// Takes a series of files and assembles them into a program represented by a list of instructions
-// and a debug symbol map (if debug requested). The files are read sequentially so the first instruction
-// in the first file is what starts executing first.
-func CompileSource(debug bool, files ...string) (Program, error) {
-	// Read each file
-	lines := make([]string, 0)
+// Assembles source files into programs
+type Assembler struct {
+	// Include debug symbols in the program
+	Debug bool
+	// Directories searched by .include and .import (after the directory of the file doing the including)
+	IncludePaths []string
+	// Run the peephole optimizer over the assembled instructions (see optimize.go)
+	Optimize bool
+}
+
+// Takes a series of files and assembles them into a relocatable object. The files are assembled together,
+// so they can use each other's labels and constants, and the first instruction in the first file comes
+// first in the object. Files that were already pulled in by .include or .import are skipped.
+//
+// If assembling fails the returned error is of type Diagnostics.
+func (as *Assembler) AssembleFiles(files ...string) (*Object, error) {
+	if len(files) == 0 {
+		return nil, errors.New("no source lines given")
+	}
+
+	a := newAssembler(as.Debug)
+	a.includePaths, a.optimize = as.IncludePaths, as.Optimize
 	for _, filename := range files {
-		file, err := os.Open(filename)
+		lines, err := readSourceFile(filename)
 		if err != nil {
 			fmt.Println("Could not read", filename)
-			return Program{}, err
+			return nil, err
 		}
 
-		reader := bufio.NewReader(file)
-		for {
-			line, _, err := reader.ReadLine()
-			if err != nil {
-				break
-			}
+		a.preprocessIncludedFile(filename, lines, true)
+	}
 
-			lines = append(lines, string(line))
-		}
+	return a.assemble(files[0])
+}
+
+// Takes a buffer of lines and assembles them into a relocatable object. Files included from the buffer
+// are searched for in the current directory and then the include paths.
+//
+// If assembling fails the returned error is of type Diagnostics.
+func (as *Assembler) AssembleBuffer(lines []string) (*Object, error) {
+	if len(lines) == 0 {
+		return nil, errors.New("no source lines given")
+	}
+
+	source := make([]sourceLine, 0, len(lines))
+	for i, line := range lines {
+		source = append(source, sourceLine{line: i + 1, text: line})
+	}
+
+	a := newAssembler(as.Debug)
+	a.includePaths, a.optimize = as.IncludePaths, as.Optimize
+	a.preprocessFile(source)
+	return a.assemble("")
+}
+
+// Takes lines of source that were generated from the named file (such as by a compiler) and assembles
+// them into a relocatable object. Diagnostics use the name along with the line number within lines, and
+// files included from the source are searched for in the named file's directory and then the include paths.
+//
+// If assembling fails the returned error is of type Diagnostics.
+func (as *Assembler) AssembleSource(name string, lines []string) (*Object, error) {
+	if len(lines) == 0 {
+		return nil, errors.New("no source lines given")
+	}
+
+	source := make([]sourceLine, 0, len(lines))
+	for i, line := range lines {
+		source = append(source, sourceLine{file: name, line: i + 1, text: line})
+	}
+
+	a := newAssembler(as.Debug)
+	a.includePaths, a.optimize = as.IncludePaths, as.Optimize
+	a.preprocessFile(source)
+	return a.assemble(name)
+}
+
+// Takes a series of files and assembles them into a program represented by a list of instructions
+// and a debug symbol map (if debug requested). The files are read sequentially so the first instruction
+// in the first file is what starts executing first. Files that were already pulled in by .include or
+// .import are skipped.
+//
+// The program is linked on its own at the default load address. If assembling fails the returned error
+// is of type Diagnostics.
+func (as *Assembler) CompileFiles(files ...string) (Program, error) {
+	obj, err := as.AssembleFiles(files...)
+	if err != nil {
+		return Program{}, err
 	}
 
-	return CompileSourceFromBuffer(debug, lines)
+	return Link([]*Object{obj}, LinkOptions{})
+}
+
+// Takes a buffer of lines and assembles them into a program represented by a list of instructions
+// and a debug symbol map (if debug requested). Files included from the buffer are searched for in the
+// current directory and then the include paths.
+//
+// The program is linked on its own at the default load address. If assembling fails the returned error
+// is of type Diagnostics.
+func (as *Assembler) CompileBuffer(lines []string) (Program, error) {
+	obj, err := as.AssembleBuffer(lines)
+	if err != nil {
+		return Program{}, err
+	}
+
+	return Link([]*Object{obj}, LinkOptions{})
+}
+
+// Takes a buffer of lines and assembles them into a program represented by a list of instructions
+// and a debug symbol map (if debug requested).
+//
+// If assembling fails the returned error is of type Diagnostics.
+func CompileSourceFromBuffer(debug bool, lines []string) (Program, error) {
+	return (&Assembler{Debug: debug}).CompileBuffer(lines)
+}
+
+// Takes a series of files and assembles them into a program represented by a list of instructions
+// and a debug symbol map (if debug requested). The files are read sequentially so the first instruction
+// in the first file is what starts executing first.
+//
+// If assembling fails the returned error is of type Diagnostics.
+func CompileSource(debug bool, files ...string) (Program, error) {
+	return (&Assembler{Debug: debug}).CompileFiles(files...)
 }
 
 // This is called when package is first loaded (before main)
@@ -2,8 +2,12 @@ package gvm
 
 import (
 	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"math"
-	"os"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -61,11 +65,28 @@ type HardwareDevice interface {
 	Close()
 }
 
+// Devices that have internal state which should survive a snapshot (see VM.WriteSnapshot) implement this
+// as well as HardwareDevice. Devices that don't implement it are recreated from scratch when a snapshot
+// is read.
+type StatefulDevice interface {
+	HardwareDevice
+
+	// Returns the device's state in whatever format RestoreState understands. This shouldn't send
+	// responses since it's called while the response bus is being saved.
+	SaveState() ([]byte, error)
+
+	// Called on a freshly created device with the state saved by SaveState
+	RestoreState([]byte) error
+}
+
+// Creates a hardware device for the port described by the given base info
+type DeviceConstructor func(DeviceBaseInfo) HardwareDevice
+
 // Data that all hardware devices will need
 type DeviceBaseInfo struct {
 	// Specifies the entry into the interrupt table to match up with
 	InterruptAddr uint32
-	ResponseBus   *deviceResponseBus
+	ResponseBus   *DeviceResponseBus
 }
 
 // Safe to be used by multiple threads
@@ -128,6 +149,14 @@ func (q *syncStack[T]) popAll() []T {
 	return data
 }
 
+// Returns a copy of the data without removing it
+func (q *syncStack[T]) items() []T {
+	q.Lock()
+	defer q.Unlock()
+
+	return slices.Clone(q.queue[:q.count])
+}
+
 // Waits for data to be available if it isn't already
 func (q *syncStack[T]) wait() {
 	q.Lock()
@@ -175,8 +204,12 @@ func (*nodevice) Reset() {}
 func (*nodevice) Close() {}
 
 // ------- Begin system timer
+
+// How long an expired timer waits before trying again when the response bus is full
+const systemTimerRetryDelay = time.Millisecond
+
 type systemTimerData struct {
-	duration time.Duration
+	deadline time.Time
 	iid      InteractionID
 }
 
@@ -185,6 +218,13 @@ type systemTimer struct {
 
 	timerChan  chan systemTimerData
 	closedChan chan struct{}
+
+	// Copy of the pending timer (if any) so that it can be saved in a snapshot. armed is cleared
+	// once the timer's response has been sent.
+	lock     sync.Mutex
+	armed    bool
+	deadline time.Time
+	iid      InteractionID
 }
 
 func newSystemTimer(base DeviceBaseInfo) HardwareDevice {
@@ -197,17 +237,18 @@ func newSystemTimer(base DeviceBaseInfo) HardwareDevice {
 	// Start the timer goroutine
 	go func() {
 		t := time.NewTimer(time.Duration(math.MaxInt64))
-		var iid InteractionID
+		var current systemTimerData
 		for {
 			select {
 			case <-t.C:
-				// Use nil data in response since calling code will interpret our response
-				// to mean the timer expired
-				st.ResponseBus.Send(NewResponse(st.InterruptAddr, iid, nil, nil))
+				// If the bus is full the timer stays armed and tries again shortly
+				if !st.fire(current) {
+					t = time.NewTimer(systemTimerRetryDelay)
+				}
 			case newTimer := <-st.timerChan:
 				// New timer received - overwrite existing
-				t = time.NewTimer(newTimer.duration)
-				iid = newTimer.iid
+				t = time.NewTimer(time.Until(newTimer.deadline))
+				current = newTimer
 			case <-st.closedChan:
 				// Timer system shut down
 				return
@@ -229,22 +270,79 @@ func (t *systemTimer) TrySend(id InteractionID, command uint32, data []byte) Sta
 		return StatusDeviceReady
 	}
 
-	t.timerChan <- systemTimerData{
-		duration: time.Duration(uint32FromBytes(data)) * time.Microsecond,
-		iid:      id,
+	t.arm(id, time.Duration(uint32FromBytes(data))*time.Microsecond)
+	return StatusDeviceReady
+}
+
+// Starts a timer that responds with the given id after the duration, replacing any existing timer
+func (t *systemTimer) arm(id InteractionID, duration time.Duration) {
+	t.lock.Lock()
+	t.armed, t.deadline, t.iid = true, time.Now().Add(duration), id
+	data := systemTimerData{deadline: t.deadline, iid: id}
+	t.lock.Unlock()
+
+	t.timerChan <- data
+}
+
+// Sends the response for the given timer and marks it as finished unless it has since been replaced.
+// Both happen under the bus's snapshot lock so that a snapshot has either the pending timer or its
+// response, never both. Returns false if the response bus was full.
+func (t *systemTimer) fire(timer systemTimerData) bool {
+	t.ResponseBus.snapshotLock.Lock()
+	defer t.ResponseBus.snapshotLock.Unlock()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	// Use nil data in response since calling code will interpret our response
+	// to mean the timer expired
+	if !t.ResponseBus.trySend(NewResponse(t.InterruptAddr, timer.iid, nil, nil)) {
+		return false
 	}
 
-	return StatusDeviceReady
+	if t.deadline.Equal(timer.deadline) {
+		t.armed = false
+	}
+	return true
 }
 
 func (t *systemTimer) Reset() {
+	t.lock.Lock()
+	t.armed, t.deadline, t.iid = false, time.Time{}, 0
+	t.lock.Unlock()
+
 	// Send a new max timer to override the existing one
 	t.timerChan <- systemTimerData{
-		duration: time.Duration(math.MaxInt64),
+		deadline: time.Now().Add(time.Duration(math.MaxInt64)),
 		iid:      0,
 	}
 }
 
+// State is 1 if a timer is pending (0 otherwise), its interaction ID and the microseconds it had left
+func (t *systemTimer) SaveState() ([]byte, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if !t.armed {
+		return make([]byte, varchBytesx3), nil
+	}
+
+	remaining := max(time.Until(t.deadline), 0) / time.Microsecond
+	state := binary.LittleEndian.AppendUint32(nil, 1)
+	state = binary.LittleEndian.AppendUint32(state, t.iid)
+	return binary.LittleEndian.AppendUint32(state, uint32(min(remaining, math.MaxUint32))), nil
+}
+
+func (t *systemTimer) RestoreState(state []byte) error {
+	if len(state) != int(varchBytesx3) {
+		return fmt.Errorf("system timer state should be %d bytes but is %d", varchBytesx3, len(state))
+	}
+
+	if uint32FromBytes(state) != 0 {
+		t.arm(uint32FromBytes(state[4:]), time.Duration(uint32FromBytes(state[8:]))*time.Microsecond)
+	}
+	return nil
+}
+
 func (t *systemTimer) Close() {
 	t.closedChan <- struct{}{}
 }
@@ -280,7 +378,7 @@ func (p *powerController) TrySend(_ InteractionID, command uint32, _ []byte) Sta
 			device.Close()
 		}
 
-		p.vm.errcode = errSystemShutdown
+		p.vm.errcode = ErrSystemShutdown
 	}
 
 	return StatusDeviceReady
@@ -296,8 +394,10 @@ type memoryManagement struct {
 	vm *VM
 	// These specify the min/max addresses for the heap when in
 	// a privilege mode other than 0 (highest)
+	//
+	// maxHeapAddr is 64 bits so that it can point 1 past the end of a full 32-bit address space
 	minHeapAddr uint32
-	maxHeapAddr uint32
+	maxHeapAddr uint64
 }
 
 func newMemoryManagement(base DeviceBaseInfo, vm *VM) HardwareDevice {
@@ -305,7 +405,7 @@ func newMemoryManagement(base DeviceBaseInfo, vm *VM) HardwareDevice {
 		DeviceBaseInfo: base,
 		vm:             vm,
 		minHeapAddr:    0,
-		maxHeapAddr:    uint32(len(vm.memory)),
+		maxHeapAddr:    uint64(len(vm.memory)),
 	}
 }
 
@@ -332,7 +432,12 @@ func (m *memoryManagement) TrySend(id InteractionID, command uint32, data []byte
 	if command == 1 {
 		return StatusDeviceReady
 	} else if command == 2 {
-		m.minHeapAddr, m.maxHeapAddr = uint32FromBytes(data), uint32FromBytes(data[varchBytes:])
+		m.minHeapAddr, m.maxHeapAddr = uint32FromBytes(data), uint64(uint32FromBytes(data[varchBytes:]))
+		// A max address of 0 is what the top of the stack wraps around to when memory spans
+		// the full 32-bit address space, so treat it as 1 past the last valid address
+		if m.maxHeapAddr == 0 {
+			m.maxHeapAddr = maxHeapSizeBytes
+		}
 	}
 
 	m.updateBounds()
@@ -340,12 +445,33 @@ func (m *memoryManagement) TrySend(id InteractionID, command uint32, data []byte
 }
 
 func (m *memoryManagement) Reset() {
-	m.minHeapAddr, m.maxHeapAddr = 0, uint32(len(m.vm.memory))
+	m.minHeapAddr, m.maxHeapAddr = 0, uint64(len(m.vm.memory))
 	m.updateBounds()
 }
 
 func (m *memoryManagement) Close() {}
 
+// State is the min (4 bytes) and max (8 bytes) heap addresses. The VM's bounds are restored along with
+// the rest of the VM, so they're not updated here.
+func (m *memoryManagement) SaveState() ([]byte, error) {
+	state := binary.LittleEndian.AppendUint32(nil, m.minHeapAddr)
+	return binary.LittleEndian.AppendUint64(state, m.maxHeapAddr), nil
+}
+
+func (m *memoryManagement) RestoreState(state []byte) error {
+	if len(state) != int(varchBytesx3) {
+		return fmt.Errorf("memory management state should be %d bytes but is %d", varchBytesx3, len(state))
+	}
+
+	minHeapAddr, maxHeapAddr := uint32FromBytes(state), binary.LittleEndian.Uint64(state[4:])
+	if uint64(minHeapAddr) > maxHeapAddr || maxHeapAddr > uint64(len(m.vm.memory)) {
+		return fmt.Errorf("heap bounds [%d, %d) are outside of memory", minHeapAddr, maxHeapAddr)
+	}
+
+	m.minHeapAddr, m.maxHeapAddr = minHeapAddr, maxHeapAddr
+	return nil
+}
+
 // ------- Begin console IO manager
 type consoleIO struct {
 	DeviceBaseInfo
@@ -357,11 +483,11 @@ type consoleIO struct {
 	closed atomic.Bool
 }
 
-func newConsoleIO(base DeviceBaseInfo, vm *VM) HardwareDevice {
+func newConsoleIO(base DeviceBaseInfo, vm *VM, stdin io.Reader) HardwareDevice {
 	io := &consoleIO{
 		DeviceBaseInfo: base,
 		vm:             vm,
-		stdin:          bufio.NewReader(os.Stdin),
+		stdin:          bufio.NewReader(stdin),
 		charRequests:   newSyncStack[InteractionID](32),
 	}
 
@@ -424,14 +550,12 @@ func (c *consoleIO) TrySend(id InteractionID, command uint32, data []byte) Statu
 	} else if command == 3 {
 		numBytes := uint32FromBytes(data)
 		addr := uint32FromBytes(data[varchBytes:])
-		for i := uint32(0); i < numBytes; i++ {
-			b := c.vm.memory[addr+i]
-			c.vm.stdout.WriteByte(b)
-		}
+		// Computed in 64 bits so that reads past the end of memory can't wrap around
+		c.vm.stdout.Write(c.vm.memory[addr : uint64(addr)+uint64(numBytes)])
 		c.vm.stdout.Flush()
 	} else if command == 4 {
 		if ok := c.charRequests.push(id); !ok {
-			c.ResponseBus.Send(NewResponse(c.InterruptAddr, id, nil, errIO))
+			c.ResponseBus.Send(NewResponse(c.InterruptAddr, id, nil, ErrIO))
 			return StatusDeviceBusy
 		}
 	}
@@ -444,6 +568,30 @@ func (c *consoleIO) Reset() {
 	c.charRequests.popAll()
 }
 
+// State is the interaction ID of each pending character read. Input that was buffered from stdin
+// but not handed to the program yet isn't saved.
+func (c *consoleIO) SaveState() ([]byte, error) {
+	var state []byte
+	for _, iid := range c.charRequests.items() {
+		state = binary.LittleEndian.AppendUint32(state, iid)
+	}
+
+	return state, nil
+}
+
+func (c *consoleIO) RestoreState(state []byte) error {
+	if len(state)%int(varchBytes) != 0 {
+		return errors.New("console IO state is not a list of interaction IDs")
+	}
+
+	for i := 0; i < len(state); i += int(varchBytes) {
+		if ok := c.charRequests.push(uint32FromBytes(state[i:])); !ok {
+			return errors.New("console IO state has too many pending reads")
+		}
+	}
+	return nil
+}
+
 func (c *consoleIO) Close() {
 	// Mark closed and reset internal state
 	c.closed.Store(true)
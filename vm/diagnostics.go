@@ -0,0 +1,102 @@
+package gvm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// How serious a diagnostic is - errors stop a program from being assembled, warnings don't
+type Severity int
+
+const (
+	SeverityError Severity = iota
+	SeverityWarning
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityError:
+		return "error"
+	case SeverityWarning:
+		return "warning"
+	default:
+		return fmt.Sprintf("Severity(%d)", int(s))
+	}
+}
+
+// A single problem found in the source code while assembling
+type Diagnostic struct {
+	// Empty when the source came from a buffer instead of a file
+	File string
+	// 1-based line and column (column is 0 when it isn't known)
+	Line     int
+	Column   int
+	Severity Severity
+	Message  string
+	// When the problem is inside of a macro, where the macro was used (outermost expansion first)
+	Expansions []MacroExpansion
+}
+
+func newDiagnostic(source sourceLine, col int, severity Severity, message string) Diagnostic {
+	return Diagnostic{File: source.file, Line: source.line, Column: col, Severity: severity, Message: message, Expansions: source.expansions}
+}
+
+// Formats the diagnostic as file:line:col: severity: message, followed by one line per macro expansion
+// (innermost first)
+func (d Diagnostic) String() string {
+	var str string
+	if d.Column > 0 {
+		str = fmt.Sprintf("%s:%d:%d: %s: %s", displayFileName(d.File), d.Line, d.Column, d.Severity, d.Message)
+	} else {
+		str = fmt.Sprintf("%s:%d: %s: %s", displayFileName(d.File), d.Line, d.Severity, d.Message)
+	}
+
+	for i := len(d.Expansions) - 1; i >= 0; i-- {
+		str += "\n    " + d.Expansions[i].String()
+	}
+
+	return str
+}
+
+func (d Diagnostic) Error() string {
+	return d.String()
+}
+
+// All of the problems found while assembling, in source order. When assembling fails
+// the returned error is of this type so that every problem can be reported at once.
+type Diagnostics []Diagnostic
+
+// One diagnostic per line
+func (ds Diagnostics) Error() string {
+	lines := make([]string, 0, len(ds))
+	for _, d := range ds {
+		lines = append(lines, d.String())
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// Returns true if any of the diagnostics are errors
+func (ds Diagnostics) hasErrors() bool {
+	for _, d := range ds {
+		if d.Severity == SeverityError {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Source read from a buffer has no file name
+func displayFileName(file string) string {
+	if file == "" {
+		return "<buffer>"
+	}
+
+	return file
+}
+
+// Returns the warnings produced while assembling the program
+func (p Program) Warnings() Diagnostics {
+	return p.warnings
+}
@@ -0,0 +1,437 @@
+package gvm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Assembler directives start with a . and are handled before instructions are parsed
+const (
+	// .equ NAME value - constant visible only in the file it's defined in
+	directiveEqu = ".equ"
+	// .define NAME value - constant visible in every file
+	directiveDefine = ".define"
+
+	// .text and .data switch which section the following lines are added to
+	directiveText = ".text"
+	directiveData = ".data"
+
+	// Static data directives (only allowed in the .data section)
+	//
+	//	.byte value...   - 8-bit values
+	//	.word value...   - 32-bit values
+	//	.float value...  - 32-bit floating point values
+	//	.ascii "string"  - string bytes
+	//	.asciz "string"  - string bytes followed by a 0 byte
+	//	.space size [fill] - size bytes set to fill (or 0)
+	//	.align alignment - pads with 0s until the data is aligned (alignment must be a power of 2)
+	directiveByte  = ".byte"
+	directiveWord  = ".word"
+	directiveFloat = ".float"
+	directiveASCII = ".ascii"
+	directiveASCIZ = ".asciz"
+	directiveSpace = ".space"
+	directiveAlign = ".align"
+
+	// .global name... - makes labels visible to other objects when linking
+	directiveGlobal = ".global"
+	// .extern name... - declares symbols that come from another object when linking
+	directiveExtern = ".extern"
+)
+
+// Sections that the assembler can place lines in. Instructions go in .text and static data goes in .data,
+// which is laid out in memory directly after the instructions.
+type section int
+
+const (
+	sectionText section = iota
+	sectionData
+)
+
+// A symbol named by .global or .extern along with where it was named
+type symbolDecl struct {
+	name   string
+	source sourceLine
+	col    int
+}
+
+// A value in the .data section that is filled in once all labels are known
+type dataItem struct {
+	source sourceLine
+	scope  symbolScope
+	col    int
+	value  string
+	// Where the value goes in the .data section and how many bytes it takes up (1 or 4)
+	offset int
+	size   int
+	// Float values are stored using their bit representation
+	isFloat bool
+}
+
+// Symbols that are always defined
+var builtinSymbols = map[string]int64{
+	"reservedBytes":    int64(reservedBytes),
+	"instructionBytes": int64(instructionBytes),
+}
+
+type constantState int
+
+const (
+	constantUnresolved constantState = iota
+	constantResolving
+	constantResolved
+	constantFailed
+)
+
+// A named constant created with .equ or .define. The value is kept as source text and only
+// evaluated once all constants and labels are known, so constants can refer to things defined later.
+type constant struct {
+	name   string
+	value  string
+	source sourceLine
+	scope  symbolScope
+	// Columns of the name and value (used for diagnostics)
+	nameCol  int
+	valueCol int
+
+	state  constantState
+	result exprValue
+	// True if the value is a float literal, in which case result holds its bit representation
+	isFloat bool
+}
+
+// Returns true if the line is an assembler directive rather than an instruction or label
+func isDirective(line string) bool {
+	return strings.HasPrefix(line, ".") && !strings.HasSuffix(line, ":")
+}
+
+// Returns true if name can be used as a constant name (letter or _ followed by letters, digits, _ or .)
+func isIdentifier(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	for i, r := range name {
+		if !isIdentifierRune(r, i > 0) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Handles a single directive line (comments and surrounding whitespace already removed)
+func (a *assembler) preprocessDirective(source sourceLine, line string, fields []sourceField) {
+	col := fields[0].col
+	switch directive := fields[0].text; directive {
+	case directiveEqu, directiveDefine:
+		if len(fields) < 3 {
+			a.errorf(source, col, "%s wanted a name and a value: %s", directive, line)
+			return
+		}
+
+		name := fields[1]
+		if !isIdentifier(name.text) {
+			a.errorf(source, name.col, "invalid constant name: %s", name.text)
+			return
+		}
+
+		// Everything after the name is the value
+		value := strings.TrimSpace(line[fields[2].col-col:])
+
+		scope := a.globalConstants
+		if directive == directiveEqu {
+			scope = a.fileConstants[source.scope()]
+			if scope == nil {
+				scope = make(map[string]*constant)
+				a.fileConstants[source.scope()] = scope
+			}
+		}
+
+		if prev, ok := scope[name.text]; ok {
+			a.errorf(source, name.col, "constant %s redefined (previous definition at %s:%d)", name.text, displayFileName(prev.source.file), prev.source.line)
+			return
+		}
+
+		c := &constant{name: name.text, value: value, source: source, scope: a.currentScope(source), nameCol: name.col, valueCol: fields[2].col}
+		scope[name.text] = c
+		a.constants = append(a.constants, c)
+	case directiveText, directiveData:
+		if len(fields) > 1 {
+			a.errorf(source, fields[1].col, "%s doesn't take any arguments: %s", directive, line)
+			return
+		}
+
+		a.section = sectionText
+		if directive == directiveData {
+			a.section = sectionData
+		}
+	case directiveGlobal, directiveExtern:
+		if len(fields) < 2 {
+			a.errorf(source, col, "%s wanted at least 1 name: %s", directive, line)
+			return
+		}
+
+		for _, name := range fields[1:] {
+			if !isIdentifier(name.text) {
+				a.errorf(source, name.col, "invalid symbol name: %s", name.text)
+			} else if directive == directiveGlobal {
+				a.globals = append(a.globals, symbolDecl{name: name.text, source: source, col: name.col})
+			} else {
+				a.externs[name.text] = true
+			}
+		}
+	case directiveInclude, directiveImport:
+		a.preprocessInclude(source, line, fields)
+	case directiveMacro:
+		a.beginMacro(source, line, fields)
+	case directiveEndm:
+		a.errorf(source, col, "%s without %s", directiveEndm, directiveMacro)
+	default:
+		a.preprocessDataDirective(source, line, fields)
+	}
+}
+
+// Handles the directives that add static data to the .data section
+func (a *assembler) preprocessDataDirective(source sourceLine, line string, fields []sourceField) {
+	directive, col, args := fields[0].text, fields[0].col, fields[1:]
+
+	switch directive {
+	case directiveByte, directiveWord, directiveFloat, directiveASCII, directiveASCIZ, directiveSpace, directiveAlign:
+		if a.section != sectionData {
+			a.errorf(source, col, "%s is only allowed in the .data section", directive)
+			return
+		} else if len(args) == 0 {
+			a.errorf(source, col, "%s wanted at least 1 argument: %s", directive, line)
+			return
+		}
+	default:
+		a.errorf(source, col, "unknown directive: %s", directive)
+		return
+	}
+
+	switch directive {
+	case directiveByte, directiveWord, directiveFloat:
+		size := 1
+		if directive != directiveByte {
+			size = int(varchBytes)
+		}
+
+		for _, arg := range args {
+			a.dataItems = append(a.dataItems, dataItem{
+				source:  source,
+				scope:   a.currentScope(source),
+				col:     arg.col,
+				value:   arg.text,
+				offset:  len(a.data),
+				size:    size,
+				isFloat: directive == directiveFloat,
+			})
+			a.data = append(a.data, make([]byte, size)...)
+		}
+	case directiveASCII, directiveASCIZ:
+		str := args[0].text
+		if len(args) > 1 || !strings.HasPrefix(str, "\"") || !strings.HasSuffix(str, "\"") {
+			a.errorf(source, args[0].col, "%s wanted a string: %s", directive, line)
+			return
+		}
+
+		a.data = append(a.data, insertEscapeSeqReplacements(str[1:len(str)-1])...)
+		if directive == directiveASCIZ {
+			a.data = append(a.data, 0)
+		}
+	case directiveSpace:
+		if len(args) > 2 {
+			a.errorf(source, args[2].col, "%s wanted a size and an optional fill value: %s", directive, line)
+			return
+		}
+
+		// The size needs to be known right away so that the labels that follow get the right address
+		size, ok := a.evalDataArg(source, args[0], 0, math.MaxInt32)
+		fill := int64(0)
+		if len(args) > 1 {
+			fill, ok = a.evalDataArg(source, args[1], math.MinInt8, math.MaxUint8)
+		}
+
+		if ok {
+			a.data = append(a.data, bytes.Repeat([]byte{byte(fill)}, int(size))...)
+		}
+	case directiveAlign:
+		if len(args) > 1 {
+			a.errorf(source, args[1].col, "%s wanted 1 argument: %s", directive, line)
+			return
+		}
+
+		alignment, ok := a.evalDataArg(source, args[0], 1, math.MaxInt32)
+		if ok && alignment&(alignment-1) != 0 {
+			a.errorf(source, args[0].col, "alignment %d is not a power of 2", alignment)
+		} else if ok {
+			for int64(len(a.data))%alignment != 0 {
+				a.data = append(a.data, 0)
+			}
+
+			// The linker keeps the alignment by placing the data at a multiple of the largest alignment
+			a.dataAlign = max(a.dataAlign, int(alignment))
+		}
+	}
+}
+
+// Evaluates a directive argument that is needed before all labels are known, making sure it falls
+// within [min, max]
+func (a *assembler) evalDataArg(source sourceLine, arg sourceField, min, max int64) (int64, bool) {
+	v, err := evalAbsExpr(arg.text, a.symbolLookup(a.currentScope(source)))
+	if err != nil {
+		a.exprErrorf(source, arg.col, err)
+		return 0, false
+	} else if v < min || v > max {
+		a.errorf(source, arg.col, "value %d is out of range [%d, %d]", v, min, max)
+		return 0, false
+	}
+
+	return v, true
+}
+
+// Fills in a static data value now that all labels are known
+func (a *assembler) evalDataItem(item dataItem) {
+	lookup := a.symbolLookup(item.scope)
+	if item.isFloat {
+		var f float32
+		if isFloatLiteral(item.value) {
+			f64, _ := strconv.ParseFloat(item.value, 32)
+			f = float32(f64)
+		} else if c, ok := a.lookupConstant(item.scope.file, item.value); ok && a.evalConstant(c) && c.isFloat {
+			f = math.Float32frombits(uint32(c.result.n))
+		} else {
+			// Integer expressions are converted to floating point
+			v, err := evalAbsExpr(item.value, lookup)
+			if err != nil {
+				a.exprErrorf(item.source, item.col, err)
+				return
+			}
+			f = float32(v)
+		}
+
+		float32ToBytes(f, a.data[item.offset:])
+		return
+	}
+
+	if item.size == 1 {
+		v, err := evalAbsExpr(item.value, lookup)
+		if err != nil {
+			a.exprErrorf(item.source, item.col, err)
+		} else if v < math.MinInt8 || v > math.MaxUint8 {
+			a.errorf(item.source, item.col, "value %d does not fit in 8 bits", v)
+		} else {
+			a.data[item.offset] = byte(v)
+		}
+		return
+	}
+
+	v, err := evalExpr32(item.value, lookup)
+	if err != nil {
+		a.exprErrorf(item.source, item.col, err)
+		return
+	}
+
+	uint32ToBytes(uint32(v.n), a.data[item.offset:])
+	if v.base != "" {
+		a.relocations = append(a.relocations, relocation{kind: relocDataWord, offset: item.offset, base: v.base, addend: v.n})
+	}
+}
+
+// Looks up a constant as seen from the given file. File constants shadow global ones.
+func (a *assembler) lookupConstant(file, name string) (*constant, bool) {
+	if c, ok := a.fileConstants[file][name]; ok {
+		return c, true
+	}
+
+	c, ok := a.globalConstants[name]
+	return c, ok
+}
+
+// Evaluates the constant's value if it hasn't been already. Problems are reported at the constant's
+// definition. Returns false if the constant's value couldn't be evaluated.
+func (a *assembler) evalConstant(c *constant) bool {
+	switch c.state {
+	case constantResolved:
+		return true
+	case constantFailed:
+		return false
+	}
+
+	c.state = constantResolving
+	if isFloatLiteral(c.value) {
+		f, _ := strconv.ParseFloat(c.value, 32)
+		c.result, c.isFloat = exprValue{n: int64(math.Float32bits(float32(f)))}, true
+		c.state = constantResolved
+		return true
+	}
+
+	v, err := evalExpr(c.value, a.symbolLookup(c.scope))
+	if err != nil {
+		a.exprErrorf(c.source, c.valueCol, err)
+		c.state = constantFailed
+		return false
+	}
+
+	c.result, c.state = v, constantResolved
+	return true
+}
+
+// Returns a function for looking up symbols in expressions as seen from the given scope. Constants
+// take priority over labels, and labels take priority over builtin symbols.
+func (a *assembler) symbolLookup(scope symbolScope) symbolLookup {
+	return func(name string) (exprValue, error) {
+		if c, ok := a.lookupConstant(scope.file, name); ok {
+			if c.state == constantResolving {
+				return exprValue{}, fmt.Errorf("constant %s is defined in terms of itself", name)
+			} else if !a.evalConstant(c) {
+				return exprValue{}, errAlreadyReported
+			} else if c.isFloat {
+				return exprValue{}, fmt.Errorf("floating point constant %s can't be used in an expression", name)
+			}
+
+			return c.result, nil
+		}
+
+		label, err := a.resolveLabelRef(scope, name)
+		if err != nil {
+			return exprValue{}, err
+		}
+
+		// Label addresses are relative to the start of their section until the program is linked
+		if l, ok := a.labels[label]; ok {
+			return exprValue{n: int64(l.offset), base: l.section.relocationBase()}, nil
+		} else if a.externs[label] {
+			return exprValue{base: label}, nil
+		}
+
+		if v, ok := builtinSymbols[label]; ok {
+			return exprValue{n: v}, nil
+		}
+
+		// Errors use the name as it was written rather than the internal name of the label
+		if isLocalLabel(name) {
+			return exprValue{}, fmt.Errorf("undefined symbol: %s (in scope %s)", name, scope.label)
+		}
+		return exprValue{}, fmt.Errorf("undefined symbol: %s", name)
+	}
+}
+
+// Records an error from evaluating an expression that starts at the given column
+func (a *assembler) exprErrorf(source sourceLine, col int, err error) {
+	if err == errAlreadyReported {
+		return
+	}
+
+	var exprErr *exprError
+	if errors.As(err, &exprErr) {
+		col += exprErr.offset
+	}
+
+	a.errorf(source, col, "%s", err)
+}
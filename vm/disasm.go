@@ -0,0 +1,335 @@
+package gvm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+// Number of nops in a row that mark the end of the program when disassembling a memory dump
+const maxDisassemblyNopRun uint32 = 16
+
+// Number of zero bytes in a row that separate the static data (and anything after it) from the stack when
+// disassembling a memory dump
+const minDisassemblyStackGap = maxDisassemblyNopRun * instructionBytes
+
+// Names for the exception handler entries in the interrupt vector table (see hardwareExceptionMap)
+var ivtExceptionNames = map[uint32]string{
+	hardwareExceptionMap[ErrSegmentationFault]:  "segfault",
+	hardwareExceptionMap[ErrDivisionByZero]:     "divbyzero",
+	hardwareExceptionMap[ErrUnknownInstruction]: "unknowninstr",
+	hardwareExceptionMap[ErrIllegalInstruction]: "illegalinstr",
+	hardwareExceptionMap[ErrIO]:                 "ioerror",
+}
+
+// Holds everything needed to turn a region of memory back into assembly source
+type disassembler struct {
+	memory []byte
+	// Code occupies [start, end)
+	start, end uint32
+	entryPoint uint32
+	// Number of static data bytes directly following the code
+	dataBytes int
+	// Maps from address -> label name
+	labels map[uint32]string
+	// Maps from address -> list of IVT entries that point to it
+	ivtRefs     map[uint32][]uint32
+	debugSymMap map[int]string
+}
+
+// Writes assembly source for the program that can be reassembled into the same program.
+// Labels are synthesized for all jump and call targets.
+func (p Program) Disassemble(w io.Writer) error {
+	start := p.loadAddr
+	if start == 0 {
+		start = reservedBytes
+	}
+
+	end := start + uint32(len(p.instructions))*instructionBytes
+	memory := make([]byte, end+uint32(len(p.data)))
+	for i, instr := range p.instructions {
+		encodeInstruction(instr, memory[start+uint32(i)*instructionBytes:])
+	}
+	copy(memory[end:], p.data)
+
+	d := newDisassembler(memory, start, end, p.entryPoint, p.debugSymMap)
+	d.dataBytes = len(p.data)
+	d.findIVTStores()
+	d.findDataTargets()
+	return d.write(w)
+}
+
+// Writes assembly source for a raw memory dump (such as one written by VM.WriteMemoryDump), where the first
+// byte of the dump is address 0. The program is assumed to start directly after the interrupt vector table
+// and to continue until the first invalid instruction. The memory after it is written as static data, up to
+// the last non-zero byte below the stack (the stack is the top of memory down to the first long run of
+// zeros). Interrupt vector table entries that point into the program are shown symbolically.
+func DisassembleMemory(memory []byte, w io.Writer) error {
+	if uint64(len(memory)) < uint64(reservedBytes) {
+		return fmt.Errorf("memory dump (%d bytes) is smaller than the interrupt vector table (%d bytes)", len(memory), reservedBytes)
+	}
+
+	// Unused memory decodes as a series of nops, so a long enough run of them is treated as the end of the
+	// program (short runs can come from labels in programs assembled with debug symbols)
+	end, zeroRun := reservedBytes, uint32(0)
+	for uint64(end)+uint64(instructionBytes) <= uint64(len(memory)) && zeroRun < maxDisassemblyNopRun {
+		instr := decodeInstructionTyped(memory[end:])
+		if !isValidInstruction(instr) {
+			break
+		}
+
+		if instr == (Instruction{}) {
+			zeroRun++
+		} else {
+			zeroRun = 0
+		}
+		end += instructionBytes
+	}
+
+	// Trim off any nops that were part of the unused memory
+	for end > reservedBytes && decodeInstructionTyped(memory[end-instructionBytes:]) == (Instruction{}) {
+		end -= instructionBytes
+	}
+
+	d := newDisassembler(memory, reservedBytes, end, reservedBytes, nil)
+	d.dataBytes = int(memoryDataEnd(memory, end) - uint64(end))
+	d.findIVTTargets()
+	d.findDataTargets()
+	return d.write(w)
+}
+
+// Returns the end of the static data that starts at end in a memory dump
+func memoryDataEnd(memory []byte, end uint32) uint64 {
+	// Skip over the stack at the top of memory
+	stackStart, zeroRun := uint64(len(memory)), uint32(0)
+	for stackStart > uint64(end) && zeroRun < minDisassemblyStackGap {
+		stackStart--
+		if memory[stackStart] == 0 {
+			zeroRun++
+		} else {
+			zeroRun = 0
+		}
+	}
+
+	// Zeros after the last non-zero byte are unused memory
+	dataEnd := stackStart
+	for dataEnd > uint64(end) && memory[dataEnd-1] == 0 {
+		dataEnd--
+	}
+	return dataEnd
+}
+
+func newDisassembler(memory []byte, start, end, entryPoint uint32, debugSymMap map[int]string) *disassembler {
+	d := &disassembler{
+		memory:      memory,
+		start:       start,
+		end:         end,
+		entryPoint:  entryPoint,
+		labels:      make(map[uint32]string),
+		ivtRefs:     make(map[uint32][]uint32),
+		debugSymMap: debugSymMap,
+	}
+
+	if d.entryPoint == 0 {
+		d.entryPoint = start
+	}
+
+	d.findBranchTargets()
+	return d
+}
+
+// Returns true if the address points to the beginning of an instruction in the code region
+func (d *disassembler) isCodeAddr(addr uint32) bool {
+	return addr >= d.start && addr < d.end && (addr-d.start)%instructionBytes == 0
+}
+
+// Synthesizes labels for the targets of all jumps and calls with inlined addresses
+func (d *disassembler) findBranchTargets() {
+	for addr := d.start; addr < d.end; addr += instructionBytes {
+		instr := decodeInstructionTyped(d.memory[addr:])
+		if instr.numArgs() == 1 && isBranch(instr.bytecode()) && d.isCodeAddr(instr.arg) {
+			if _, ok := d.labels[instr.arg]; !ok {
+				d.labels[instr.arg] = fmt.Sprintf("L_%04X", instr.arg)
+			}
+		}
+	}
+}
+
+// Synthesizes labels for static data addresses that are pushed with const
+func (d *disassembler) findDataTargets() {
+	dataEnd := uint64(d.end) + uint64(d.dataBytes)
+	for addr := d.start; addr < d.end; addr += instructionBytes {
+		instr := decodeInstructionTyped(d.memory[addr:])
+		if instr.numArgs() == 1 && instr.bytecode() == Const && instr.arg >= d.end && uint64(instr.arg) < dataEnd {
+			d.labels[instr.arg] = fmt.Sprintf("D_%04X", instr.arg)
+		}
+	}
+}
+
+// Labels handler addresses found in the interrupt vector table after the IVT entry
+func (d *disassembler) findIVTTargets() {
+	for entry := uint32(0); entry < reservedBytes; entry += varchBytes {
+		d.addIVTRef(entry, uint32FromBytes(d.memory[entry:]))
+	}
+}
+
+// Labels handler addresses that the code stores into the interrupt vector table with
+// const handler; const entry; storep32 (which is how handlers are usually installed)
+func (d *disassembler) findIVTStores() {
+	for addr := d.start; addr+2*instructionBytes < d.end; addr += instructionBytes {
+		handler := decodeInstructionTyped(d.memory[addr:])
+		entry := decodeInstructionTyped(d.memory[addr+instructionBytes:])
+		store := decodeInstructionTyped(d.memory[addr+2*instructionBytes:])
+		if handler.bytecode() == Const && entry.bytecode() == Const && entry.arg < reservedBytes && entry.arg%varchBytes == 0 &&
+			store.bytecode() == Storep32 && store.numArgs() == 0 {
+			d.addIVTRef(entry.arg, handler.arg)
+		}
+	}
+}
+
+// Records that the IVT entry points to handlerAddr if it's an instruction in the code
+func (d *disassembler) addIVTRef(entry, handlerAddr uint32) {
+	if !d.isCodeAddr(handlerAddr) || slices.Contains(d.ivtRefs[handlerAddr], entry) {
+		return
+	}
+
+	refs := d.ivtRefs[handlerAddr]
+	if len(refs) == 0 {
+		// The first IVT entry that points to an address gives it its name
+		d.labels[handlerAddr] = "ivt." + ivtEntryName(entry)
+	}
+	d.ivtRefs[handlerAddr] = append(refs, entry)
+}
+
+// Returns a name for the interrupt vector table entry at the given address
+func ivtEntryName(entry uint32) string {
+	if entry < hwInterruptAddrRange {
+		return fmt.Sprintf("port%d", entry/varchBytes)
+	} else if name, ok := ivtExceptionNames[entry]; ok {
+		return name
+	} else if entry < restrictedInterruptsAddrRange {
+		return fmt.Sprintf("restricted_0x%02X", entry)
+	} else {
+		return fmt.Sprintf("public_0x%02X", entry)
+	}
+}
+
+func (d *disassembler) write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "// program occupies [0x%04X, 0x%04X), entry point 0x%04X\n", d.start, d.end, d.entryPoint)
+
+	if len(d.ivtRefs) > 0 {
+		fmt.Fprintln(bw, "//")
+		fmt.Fprintln(bw, "// interrupt vector table:")
+		handlers := make([]uint32, 0, len(d.ivtRefs))
+		for handlerAddr := range d.ivtRefs {
+			handlers = append(handlers, handlerAddr)
+		}
+		slices.Sort(handlers)
+
+		for _, handlerAddr := range handlers {
+			for _, entry := range d.ivtRefs[handlerAddr] {
+				fmt.Fprintf(bw, "//     0x%02X (%s) -> %s\n", entry, ivtEntryName(entry), d.labels[handlerAddr])
+			}
+		}
+	}
+
+	for addr := d.start; addr < d.end; addr += instructionBytes {
+		if label, ok := d.labels[addr]; ok {
+			fmt.Fprintf(bw, "\n%s:\n", label)
+		}
+
+		line := "    " + d.formatInstruction(decodeInstructionTyped(d.memory[addr:]))
+		if source, ok := d.debugSymMap[int(addr)]; ok {
+			line = fmt.Sprintf("%-40s // %s", line, source)
+		}
+		fmt.Fprintln(bw, line)
+	}
+
+	if d.dataBytes > 0 {
+		fmt.Fprintf(bw, "\n%s\n", directiveData)
+		d.writeData(bw)
+	}
+
+	return bw.Flush()
+}
+
+// Writes static data as .byte directives, starting a new line at each label
+func (d *disassembler) writeData(w io.Writer) {
+	const bytesPerLine = 16
+
+	line := make([]string, 0, bytesPerLine)
+	flush := func() {
+		if len(line) > 0 {
+			fmt.Fprintf(w, "    %s %s\n", directiveByte, strings.Join(line, " "))
+			line = line[:0]
+		}
+	}
+
+	for addr := uint64(d.end); addr < uint64(d.end)+uint64(d.dataBytes); addr++ {
+		if label, ok := d.labels[uint32(addr)]; ok {
+			flush()
+			fmt.Fprintf(w, "%s:\n", label)
+		}
+
+		line = append(line, fmt.Sprintf("0x%02X", d.memory[addr]))
+		if len(line) == bytesPerLine {
+			flush()
+		}
+	}
+
+	flush()
+}
+
+// Formats an instruction the same way it would be written in assembly source, using label names
+// for any inlined address that points to a labeled instruction
+func (d *disassembler) formatInstruction(instr Instruction) string {
+	code := instr.bytecode()
+	numArgs := instr.numArgs()
+	if numArgs == 0 {
+		return code.String()
+	}
+
+	if code.IsRegisterOp() || code.IsPrivilegedRegisterOp() || numArgs > 1 {
+		if numArgs == 1 {
+			return fmt.Sprintf("%s %d", code, instr.register)
+		}
+
+		return fmt.Sprintf("%s %d %s", code, instr.register, formatIntArg(instr.arg))
+	}
+
+	if label, ok := d.labels[instr.arg]; ok && (isBranch(code) || code == Const) {
+		return fmt.Sprintf("%s %s", code, label)
+	} else if code == Byte && instr.arg >= ' ' && instr.arg <= '~' && instr.arg != '\'' && instr.arg != '\\' {
+		return fmt.Sprintf("%s '%c'", code, rune(instr.arg))
+	}
+
+	return fmt.Sprintf("%s %s", code, formatIntArg(instr.arg))
+}
+
+// Negative numbers are easier to read as signed values (-1 instead of 4294967295)
+func formatIntArg(arg uint32) string {
+	if int32(arg) < 0 {
+		return fmt.Sprintf("%d", int32(arg))
+	}
+
+	return fmt.Sprintf("%d", arg)
+}
+
+// Returns true if the instruction transfers control to its inlined address argument
+func isBranch(code Bytecode) bool {
+	return code == Jmp || code == Jz || code == Jnz || code == Jle || code == Jl || code == Jge || code == Jg || code == Call
+}
+
+// Returns true if the instruction could have been produced by the assembler
+func isValidInstruction(instr Instruction) bool {
+	code := instr.bytecode()
+	if _, ok := instrToStrMap[code]; !ok {
+		return false
+	}
+
+	numArgs := instr.numArgs()
+	return numArgs >= code.NumRequiredOpArgs() && numArgs <= code.NumRequiredOpArgs()+code.NumOptionalOpArgs()
+}
@@ -0,0 +1,459 @@
+package gvm
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+/*
+	Constant expressions in instruction arguments and directive values
+
+	Expressions are evaluated at assembly time using 64-bit signed arithmetic, and the final
+	result must fit into 32 bits (either signed or unsigned). Operators from lowest to highest
+	precedence (the same as C):
+
+		|
+		^
+		&
+		<< >>
+		+ -
+		* / %
+		unary - ~ +
+
+	Operands are decimal or hex (0x) numbers, characters ('a', '\n'), parentheses, labels
+	(including local labels like .loop and numeric label references like 1b and 1f) and constants. Since whitespace separates instruction arguments, expressions that contain spaces
+	need to be wrapped in parentheses:
+
+		const buffer+16
+		const (buffer + 16)
+
+	Label addresses aren't known until the program is linked, so an expression that uses a label
+	can only add a constant to it or subtract a constant from it. The difference between two labels
+	in the same section is a constant.
+*/
+
+// An error at a specific byte offset inside of an expression
+type exprError struct {
+	offset int
+	msg    string
+}
+
+func (e *exprError) Error() string {
+	return e.msg
+}
+
+// Returned by symbol lookups when the problem has already been reported somewhere else
+var errAlreadyReported = errors.New("error already reported")
+
+// The value of an expression. Addresses are kept as an offset from a relocation base (a section
+// of the object being assembled or an imported symbol) since they aren't known until the program is
+// linked. Values that don't depend on an address have no base.
+type exprValue struct {
+	n    int64
+	base string
+}
+
+// Looks up the value of a symbol used inside of an expression
+type symbolLookup func(name string) (exprValue, error)
+
+type exprTokenKind int
+
+const (
+	exprEnd exprTokenKind = iota
+	exprNumber
+	exprSymbol
+	exprOperator
+)
+
+type exprToken struct {
+	kind   exprTokenKind
+	text   string
+	offset int
+	// Only valid for numbers (including characters)
+	value int64
+}
+
+type exprParser struct {
+	text   string
+	pos    int
+	tok    exprToken
+	lookup symbolLookup
+}
+
+// Evaluates an expression, looking up any symbols it contains with lookup. The result can depend on
+// an address.
+func evalExpr(text string, lookup symbolLookup) (exprValue, error) {
+	p := &exprParser{text: text, lookup: lookup}
+	if err := p.next(); err != nil {
+		return exprValue{}, err
+	}
+
+	if p.tok.kind == exprEnd {
+		return exprValue{}, &exprError{offset: 0, msg: "missing value"}
+	}
+
+	v, err := p.parseBinary(0)
+	if err != nil {
+		return exprValue{}, err
+	}
+
+	if p.tok.kind != exprEnd {
+		return exprValue{}, p.errorf("unexpected %s", p.tok.text)
+	}
+
+	return v, nil
+}
+
+// Evaluates an expression whose value has to be known while assembling (it can't depend on an address)
+func evalAbsExpr(text string, lookup symbolLookup) (int64, error) {
+	v, err := evalExpr(text, lookup)
+	if err != nil {
+		return 0, err
+	} else if v.base != "" {
+		return 0, &exprError{offset: 0, msg: "value depends on an address that isn't known until the program is linked"}
+	}
+
+	return v.n, nil
+}
+
+// Evaluates an expression and makes sure the result fits into 32 bits. For addresses it's the offset
+// from the relocation base that has to fit.
+func evalExpr32(text string, lookup symbolLookup) (exprValue, error) {
+	v, err := evalExpr(text, lookup)
+	if err != nil {
+		return exprValue{}, err
+	}
+
+	if v.n < math.MinInt32 || v.n > math.MaxUint32 || (v.base != "" && v.n > math.MaxInt32) {
+		return exprValue{}, &exprError{offset: 0, msg: fmt.Sprintf("value %d does not fit in 32 bits", v.n)}
+	}
+
+	return v, nil
+}
+
+// Returns true if text is a single floating point number (such as 1.5 or -0.25)
+func isFloatLiteral(text string) bool {
+	if !strings.Contains(text, ".") {
+		return false
+	}
+
+	_, err := strconv.ParseFloat(text, 32)
+	return err == nil
+}
+
+func (p *exprParser) errorf(format string, args ...any) error {
+	return &exprError{offset: p.tok.offset, msg: fmt.Sprintf(format, args...)}
+}
+
+// Reads the next token into p.tok
+func (p *exprParser) next() error {
+	for p.pos < len(p.text) && unicode.IsSpace(rune(p.text[p.pos])) {
+		p.pos++
+	}
+
+	start := p.pos
+	p.tok = exprToken{offset: start}
+	if p.pos >= len(p.text) {
+		p.tok.kind = exprEnd
+		p.tok.text = "end of expression"
+		return nil
+	}
+
+	r, size := utf8.DecodeRuneInString(p.text[p.pos:])
+	switch {
+	case unicode.IsDigit(r):
+		for p.pos < len(p.text) && (isIdentifierRune(rune(p.text[p.pos]), true)) {
+			p.pos++
+		}
+
+		// Numeric label references look like numbers (1b, 1f)
+		if p.tok.text = p.text[start:p.pos]; isNumericLabelRef(p.tok.text) {
+			p.tok.kind = exprSymbol
+			return nil
+		}
+
+		p.tok.kind = exprNumber
+		return p.parseNumber()
+	case isIdentifierRune(r, false) || (r == '.' && p.pos+1 < len(p.text) && isIdentifierRune(rune(p.text[p.pos+1]), false)):
+		// Local labels start with a .
+		p.pos += size
+		for p.pos < len(p.text) && isIdentifierRune(rune(p.text[p.pos]), true) {
+			p.pos++
+		}
+
+		p.tok.kind, p.tok.text = exprSymbol, p.text[start:p.pos]
+		return nil
+	case r == '\'':
+		return p.parseChar()
+	}
+
+	// Operators are either 1 or 2 characters long
+	p.tok.kind = exprOperator
+	if op := p.text[p.pos:min(p.pos+2, len(p.text))]; op == "<<" || op == ">>" {
+		p.pos += 2
+		p.tok.text = op
+		return nil
+	}
+
+	p.pos += size
+	p.tok.text = string(r)
+	if !strings.ContainsRune("+-*/%&|^~()", r) {
+		return p.errorf("unexpected character %q", r)
+	}
+
+	return nil
+}
+
+func (p *exprParser) parseNumber() error {
+	text, base := p.tok.text, 10
+	if strings.HasPrefix(text, "0x") || strings.HasPrefix(text, "0X") {
+		text, base = text[2:], 16
+	}
+
+	v, err := strconv.ParseUint(text, base, 64)
+	if err != nil || v > math.MaxInt64 {
+		var numErr *strconv.NumError
+		if errors.As(err, &numErr) && numErr.Err == strconv.ErrSyntax {
+			return p.errorf("invalid number: %s", p.tok.text)
+		}
+
+		return p.errorf("number %s is too large", p.tok.text)
+	}
+
+	p.tok.value = int64(v)
+	return nil
+}
+
+// Characters are either a single rune or an escape sequence between single quotes
+func (p *exprParser) parseChar() error {
+	end := strings.IndexByte(p.text[p.pos+1:], '\'')
+	// A quote character is written as '\''
+	if end == 1 && p.text[p.pos+1] == '\\' {
+		if end = strings.IndexByte(p.text[p.pos+3:], '\''); end >= 0 {
+			end += 2
+		}
+	}
+
+	if end < 0 {
+		return p.errorf("unterminated character: %s", p.text[p.pos:])
+	}
+
+	inner := p.text[p.pos+1 : p.pos+1+end]
+	p.tok.kind, p.tok.text = exprNumber, p.text[p.pos:p.pos+end+2]
+	p.pos += end + 2
+
+	if inner == "\\'" {
+		p.tok.value = '\''
+		return nil
+	} else if inner == "\\\\" {
+		p.tok.value = '\\'
+		return nil
+	} else if replaced, ok := escapeSeqReplacements[inner]; ok {
+		inner = replaced
+	}
+
+	if utf8.RuneCountInString(inner) != 1 {
+		return p.errorf("character is too large to fit into 32 bits: %s", p.tok.text)
+	}
+
+	r, _ := utf8.DecodeRuneInString(inner)
+	p.tok.value = int64(r)
+	return nil
+}
+
+// Binary operators grouped by precedence from lowest to highest
+var exprPrecedence = [][]string{
+	{"|"},
+	{"^"},
+	{"&"},
+	{"<<", ">>"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+// Parses binary operators with at least the given precedence level
+func (p *exprParser) parseBinary(level int) (exprValue, error) {
+	if level == len(exprPrecedence) {
+		return p.parseUnary()
+	}
+
+	lhs, err := p.parseBinary(level + 1)
+	if err != nil {
+		return exprValue{}, err
+	}
+
+	for p.tok.kind == exprOperator && slices.Contains(exprPrecedence[level], p.tok.text) {
+		op := p.tok
+		if err := p.next(); err != nil {
+			return exprValue{}, err
+		}
+
+		rhs, err := p.parseBinary(level + 1)
+		if err != nil {
+			return exprValue{}, err
+		}
+
+		lhs, err = applyBinaryOp(op, lhs, rhs)
+		if err != nil {
+			return exprValue{}, err
+		}
+	}
+
+	return lhs, nil
+}
+
+func (p *exprParser) parseUnary() (exprValue, error) {
+	if p.tok.kind == exprOperator && (p.tok.text == "-" || p.tok.text == "~" || p.tok.text == "+") {
+		op := p.tok
+		if err := p.next(); err != nil {
+			return exprValue{}, err
+		}
+
+		v, err := p.parseUnary()
+		if err != nil {
+			return exprValue{}, err
+		}
+
+		if v.base != "" && op.text != "+" {
+			return exprValue{}, &exprError{offset: op.offset, msg: fmt.Sprintf("operator %s can't be used on an address", op.text)}
+		}
+
+		switch op.text {
+		case "-":
+			if v.n == math.MinInt64 {
+				return exprValue{}, &exprError{offset: op.offset, msg: "overflow in expression"}
+			}
+			return exprValue{n: -v.n}, nil
+		case "~":
+			return exprValue{n: ^v.n}, nil
+		default:
+			return v, nil
+		}
+	}
+
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (exprValue, error) {
+	tok := p.tok
+	switch tok.kind {
+	case exprNumber:
+		return exprValue{n: tok.value}, p.next()
+	case exprSymbol:
+		v, err := p.lookup(tok.text)
+		if err != nil {
+			if err == errAlreadyReported {
+				return exprValue{}, err
+			}
+			return exprValue{}, &exprError{offset: tok.offset, msg: err.Error()}
+		}
+		return v, p.next()
+	case exprOperator:
+		if tok.text == "(" {
+			if err := p.next(); err != nil {
+				return exprValue{}, err
+			}
+
+			v, err := p.parseBinary(0)
+			if err != nil {
+				return exprValue{}, err
+			}
+
+			if p.tok.kind != exprOperator || p.tok.text != ")" {
+				return exprValue{}, &exprError{offset: tok.offset, msg: "unbalanced parentheses"}
+			}
+			return v, p.next()
+		}
+	}
+
+	return exprValue{}, p.errorf("unexpected %s", tok.text)
+}
+
+// Applies a binary operator, keeping track of whether the result is an address. Addresses can only
+// have constants added to or subtracted from them, and subtracting 2 addresses with the same base
+// gives a constant.
+func applyBinaryOp(op exprToken, lhs, rhs exprValue) (exprValue, error) {
+	base := ""
+	switch {
+	case lhs.base == "" && rhs.base == "":
+	case op.text == "+" && (lhs.base == "" || rhs.base == ""):
+		base = lhs.base + rhs.base
+	case op.text == "-" && rhs.base == "":
+		base = lhs.base
+	case op.text == "-" && lhs.base == rhs.base:
+		// Same base, so the difference doesn't depend on where it ends up
+	case op.text == "+" || op.text == "-":
+		return exprValue{}, &exprError{offset: op.offset, msg: fmt.Sprintf("operator %s can't be used on addresses from different sections", op.text)}
+	default:
+		return exprValue{}, &exprError{offset: op.offset, msg: fmt.Sprintf("operator %s can't be used on an address", op.text)}
+	}
+
+	n, err := applyIntOp(op, lhs.n, rhs.n)
+	return exprValue{n: n, base: base}, err
+}
+
+func applyIntOp(op exprToken, lhs, rhs int64) (int64, error) {
+	overflow := &exprError{offset: op.offset, msg: "overflow in expression"}
+	switch op.text {
+	case "|":
+		return lhs | rhs, nil
+	case "^":
+		return lhs ^ rhs, nil
+	case "&":
+		return lhs & rhs, nil
+	case "<<", ">>":
+		if rhs < 0 || rhs > 63 {
+			return 0, &exprError{offset: op.offset, msg: fmt.Sprintf("invalid shift amount %d", rhs)}
+		}
+
+		if op.text == ">>" {
+			return lhs >> rhs, nil
+		}
+
+		if result := lhs << rhs; result>>rhs == lhs {
+			return result, nil
+		}
+		return 0, overflow
+	case "+":
+		result := lhs + rhs
+		if (lhs > 0 && rhs > 0 && result < 0) || (lhs < 0 && rhs < 0 && result >= 0) {
+			return 0, overflow
+		}
+		return result, nil
+	case "-":
+		result := lhs - rhs
+		if (lhs >= 0 && rhs < 0 && result < 0) || (lhs < 0 && rhs > 0 && result >= 0) {
+			return 0, overflow
+		}
+		return result, nil
+	case "*":
+		result := lhs * rhs
+		if lhs != 0 && (result/lhs != rhs || (lhs == -1 && rhs == math.MinInt64)) {
+			return 0, overflow
+		}
+		return result, nil
+	default:
+		// / and %
+		if rhs == 0 {
+			return 0, &exprError{offset: op.offset, msg: "division by zero in expression"}
+		} else if lhs == math.MinInt64 && rhs == -1 {
+			return 0, overflow
+		}
+
+		if op.text == "/" {
+			return lhs / rhs, nil
+		}
+		return lhs % rhs, nil
+	}
+}
+
+// Returns true if r can be used in a symbol name. Digits and . can't start a name.
+func isIdentifierRune(r rune, inner bool) bool {
+	return unicode.IsLetter(r) || r == '_' || (inner && (unicode.IsDigit(r) || r == '.'))
+}
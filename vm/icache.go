@@ -0,0 +1,138 @@
+package gvm
+
+import "math/bits"
+
+/*
+	Instruction cache
+
+	execInstructions would otherwise decode the little endian bytes of every instruction each time it runs.
+	The cache holds the decoded form of every instruction in the program that was loaded (the instruction
+	section placed at the load address), indexed by (address - load address) / instructionBytes. It's filled
+	once when the program is loaded.
+
+	Instructions outside of the loaded program (such as code jumped to in the interrupt vector table or
+	copied into the heap at runtime) and addresses that aren't aligned to an instruction are decoded
+	straight from memory every time.
+
+	Memory writes that can land on the program (storep8/16/32, the block memory instructions and the atomic
+	instructions) call codeWritten or blockWritten so that any instructions they overwrite are decoded again.
+
+	Writes the stack makes aren't tracked one by one. Instead the cache stops short of the stack pointer
+	whenever the stack grows into the program (stackGrew is called by everything that pushes), and grows
+	back to cover the whole program once the stack pointer moves back above it (stackMoved is called
+	wherever the stack pointer can be set to an arbitrary value, such as return and resume). Instructions
+	that are added back are decoded from memory again since the stack may have written over them.
+*/
+
+// An instruction after it has been decoded from memory
+type decodedInstruction struct {
+	code     uint16
+	register uint16
+	arg      uint32
+}
+
+type instructionCache struct {
+	// Address of the first cached instruction
+	start uint32
+	// Number of bytes of the program the cache was built for (0 when the cache is disabled)
+	size uint32
+	// Instructions that fit in [start, end) are currently cached, which is the whole program unless the
+	// stack has grown into it. count is the number of them.
+	end   uint32
+	count uint32
+
+	instructions []decodedInstruction
+}
+
+// log2(instructionBytes), used to turn an offset into the cache into an index
+const instructionShift = 3
+
+// Decodes the numBytes bytes of instructions starting at addr
+func newInstructionCache(memory []byte, addr, numBytes uint32) instructionCache {
+	cache := instructionCache{
+		start:        addr,
+		size:         numBytes,
+		end:          addr,
+		instructions: make([]decodedInstruction, numBytes/instructionBytes),
+	}
+
+	cache.resize(memory, addr+numBytes)
+	return cache
+}
+
+// Returns the index of the cached instruction at addr, or a number >= count if addr isn't cached. The
+// offset is rotated instead of shifted so that addresses that aren't aligned to an instruction end
+// up with high bits set (and so fail the same bounds check as everything else outside of the cache).
+func (c *instructionCache) index(addr uint32) uint32 {
+	return bits.RotateLeft32(addr-c.start, -instructionShift)
+}
+
+// Moves the end of the cache to end (clamped to the program). Instructions that weren't cached before
+// are decoded from memory.
+func (c *instructionCache) resize(memory []byte, end uint32) {
+	first := c.count
+	c.setEnd(min(max(end, c.start), c.start+c.size))
+	for i := first; i < c.count; i++ {
+		c.decode(memory, int(i))
+	}
+}
+
+// Sets end along with the number of instructions that fit before it
+func (c *instructionCache) setEnd(end uint32) {
+	c.end = end
+	c.count = (end - c.start) >> instructionShift
+}
+
+// Called after the stack pointer moved down and the stack was written to, so the cache can stop short of
+// it. This is inlined into every push, and when the cache is disabled or the stack is nowhere near the
+// program it's a single comparison.
+func (vm *VM) stackGrew() {
+	if *vm.sp < vm.icache.end {
+		vm.icache.setEnd(max(*vm.sp, vm.icache.start))
+	}
+}
+
+// Called after the stack pointer was set to a value that could be anywhere, so the cache can stop short of
+// the stack or grow back to the whole program
+func (vm *VM) stackMoved() {
+	end := *vm.sp
+	if end == 0 {
+		// Memory spans the full address space and the stack is empty
+		end = vm.icache.start + vm.icache.size
+	}
+	vm.icache.resize(vm.memory, end)
+}
+
+// Decodes the i'th cached instruction from memory
+func (c *instructionCache) decode(memory []byte, i int) {
+	code, register, arg := decodeInstruction(memory[c.start+uint32(i)*instructionBytes:])
+	c.instructions[i] = decodedInstruction{code: code, register: register, arg: arg}
+}
+
+// Called after numBytes of memory were written starting at addr so that any cached instructions that
+// were overwritten are decoded again
+func (vm *VM) codeWritten(addr, numBytes uint32) {
+	// Writes can't wrap around the end of memory since the program (and the cache) is never at the very end
+	if addr < vm.icache.end && addr+numBytes > vm.icache.start {
+		vm.redecode(addr, addr+numBytes)
+	}
+}
+
+// Same as codeWritten, but for block writes that can be large enough to end at the very end of a full
+// 32-bit address space (where addr+numBytes would wrap around to 0)
+func (vm *VM) blockWritten(addr, numBytes uint32) {
+	end := min(uint64(addr)+uint64(numBytes), uint64(vm.icache.end))
+	if addr < vm.icache.end && end > uint64(vm.icache.start) {
+		vm.redecode(addr, uint32(end))
+	}
+}
+
+// Decodes every cached instruction that overlaps [addr, end) again
+func (vm *VM) redecode(addr, end uint32) {
+	c := &vm.icache
+	first := (max(addr, c.start) - c.start) / instructionBytes
+	last := (min(end, c.end) - 1 - c.start) / instructionBytes
+	for i := int(first); i <= int(last); i++ {
+		c.decode(vm.memory, i)
+	}
+}
@@ -0,0 +1,333 @@
+package gvm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+)
+
+/*
+	Binary image format for assembled programs (all values little endian)
+
+	Header
+		- 4 bytes: magic number "GVMI"
+		- 2 bytes: format version
+		- 2 bytes: flags (currently unused, must be 0)
+		- 4 bytes: entry point address
+		- 4 bytes: load address
+		- 4 bytes: number of sections
+
+	Each section
+		- 4 bytes: section kind
+		- 4 bytes: section length in bytes (not including the kind/length fields)
+		- <length> bytes: section contents
+
+	Section kinds
+		- 0x01 instructions: sequence of 8 byte instructions encoded the same way they are in VM memory
+		- 0x02 data (optional): raw bytes placed in memory directly after the instructions
+		- 0x03 debug symbols (optional): 4 byte entry count followed by each entry as
+			- 4 bytes: address
+			- <string> source
+
+	Strings are stored as a 4 byte length followed by the bytes of the string.
+
+	Unknown section kinds are skipped when reading so that newer optional sections don't break
+	older readers.
+*/
+
+type imageSectionKind = uint32
+
+const (
+	imageVersion uint16 = 1
+
+	imageSectionInstructions imageSectionKind = 0x01
+	imageSectionData         imageSectionKind = 0x02
+	imageSectionDebugSymbols imageSectionKind = 0x03
+
+	// magic (4) + version (2) + flags (2) + entry point (4) + load address (4) + section count (4)
+	imageHeaderBytes uint32 = 20
+	// kind (4) + length (4)
+	imageSectionHeaderBytes uint32 = 8
+)
+
+var (
+	imageMagic = [4]byte{'G', 'V', 'M', 'I'}
+
+	errInvalidImage = errors.New("invalid program image")
+)
+
+// Serializes the program into the binary image format
+func (p Program) WriteImage(w io.Writer) error {
+	sections := []fileSection{{imageSectionInstructions, encodeImageInstructions(p.instructions)}}
+	if len(p.data) > 0 {
+		sections = append(sections, fileSection{imageSectionData, p.data})
+	}
+
+	if p.debugSymMap != nil {
+		sections = append(sections, fileSection{imageSectionDebugSymbols, encodeDebugSymbols(p.debugSymMap)})
+	}
+
+	loadAddr := p.loadAddr
+	if loadAddr == 0 {
+		loadAddr = reservedBytes
+	}
+
+	header := make([]byte, imageHeaderBytes)
+	copy(header, imageMagic[:])
+	uint16ToBytes(imageVersion, header[4:])
+	uint16ToBytes(0, header[6:])
+	uint32ToBytes(p.entryPoint, header[8:])
+	uint32ToBytes(loadAddr, header[12:])
+	uint32ToBytes(uint32(len(sections)), header[16:])
+
+	bw := bufio.NewWriter(w)
+	bw.Write(header)
+	writeSections(bw, sections)
+
+	// bufio.Writer remembers the first write error so only the flush needs to be checked
+	return bw.Flush()
+}
+
+// Reads a program that was previously serialized with WriteImage
+func ReadImage(r io.Reader) (Program, error) {
+	header := make([]byte, imageHeaderBytes)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return Program{}, fmt.Errorf("%w: could not read header: %w", errInvalidImage, err)
+	}
+
+	if !bytes.Equal(header[:4], imageMagic[:]) {
+		return Program{}, fmt.Errorf("%w: bad magic number", errInvalidImage)
+	}
+
+	if version := uint16FromBytes(header[4:]); version != imageVersion {
+		return Program{}, fmt.Errorf("%w: unsupported version %d", errInvalidImage, version)
+	}
+
+	program := Program{entryPoint: uint32FromBytes(header[8:]), loadAddr: uint32FromBytes(header[12:])}
+	sections, err := readSections(r, uint32FromBytes(header[16:]), errInvalidImage)
+	if err != nil {
+		return Program{}, err
+	}
+
+	contents, ok := sections[imageSectionInstructions]
+	if !ok {
+		return Program{}, fmt.Errorf("%w: missing instruction section", errInvalidImage)
+	}
+
+	if program.instructions, err = decodeImageInstructions(contents, errInvalidImage); err != nil {
+		return Program{}, err
+	}
+
+	program.data = sections[imageSectionData]
+	if contents, ok := sections[imageSectionDebugSymbols]; ok {
+		if program.debugSymMap, err = decodeDebugSymbols(contents, errInvalidImage); err != nil {
+			return Program{}, err
+		}
+	}
+
+	if program.loadAddr < reservedBytes || program.loadAddr%instructionBytes != 0 {
+		return Program{}, fmt.Errorf("%w: invalid load address %d", errInvalidImage, program.loadAddr)
+	}
+
+	programEnd := uint64(program.loadAddr) + uint64(len(program.instructions))*uint64(instructionBytes)
+	if program.entryPoint != 0 && (program.entryPoint < program.loadAddr || uint64(program.entryPoint) >= programEnd ||
+		(program.entryPoint-program.loadAddr)%instructionBytes != 0) {
+		return Program{}, fmt.Errorf("%w: entry point %d is not an instruction address", errInvalidImage, program.entryPoint)
+	}
+
+	return program, nil
+}
+
+// A section of an image or object file
+type fileSection struct {
+	kind     imageSectionKind
+	contents []byte
+}
+
+// Writes each section along with its kind and length
+func writeSections(bw *bufio.Writer, sections []fileSection) {
+	for _, section := range sections {
+		sectionHeader := make([]byte, imageSectionHeaderBytes)
+		uint32ToBytes(section.kind, sectionHeader)
+		uint32ToBytes(uint32(len(section.contents)), sectionHeader[4:])
+		bw.Write(sectionHeader)
+		bw.Write(section.contents)
+	}
+}
+
+// Reads the given number of sections, returning the contents of each one by kind. errInvalid is
+// the error that problems are wrapped in.
+func readSections(r io.Reader, numSections uint32, errInvalid error) (map[imageSectionKind][]byte, error) {
+	sections := make(map[imageSectionKind][]byte)
+	for i := uint32(0); i < numSections; i++ {
+		sectionHeader := make([]byte, imageSectionHeaderBytes)
+		if _, err := io.ReadFull(r, sectionHeader); err != nil {
+			return nil, fmt.Errorf("%w: could not read section header: %w", errInvalid, err)
+		}
+
+		kind, length := uint32FromBytes(sectionHeader), uint32FromBytes(sectionHeader[4:])
+		if _, ok := sections[kind]; ok {
+			return nil, fmt.Errorf("%w: duplicate section 0x%02X", errInvalid, kind)
+		}
+
+		// Read through a limited reader so that a corrupted length can't force a huge allocation
+		// before we find out the file is truncated
+		var contents bytes.Buffer
+		if n, err := io.Copy(&contents, io.LimitReader(r, int64(length))); err != nil || n != int64(length) {
+			return nil, fmt.Errorf("%w: section 0x%02X is truncated", errInvalid, kind)
+		}
+
+		// Unknown optional sections are kept here but ignored by the caller
+		sections[kind] = contents.Bytes()
+	}
+
+	return sections, nil
+}
+
+// Writes the program to a binary image file
+func (p Program) WriteImageFile(filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+
+	if err := p.WriteImage(file); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// Reads a program from a binary image file
+func ReadImageFile(filename string) (Program, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return Program{}, err
+	}
+	defer file.Close()
+
+	return ReadImage(bufio.NewReader(file))
+}
+
+// Returns true if the file starts with the binary image magic number
+func IsImageFile(filename string) bool {
+	return fileHasMagic(filename, imageMagic)
+}
+
+func fileHasMagic(filename string, want [4]byte) bool {
+	file, err := os.Open(filename)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	magic := [4]byte{}
+	if _, err := io.ReadFull(file, magic[:]); err != nil {
+		return false
+	}
+
+	return magic == want
+}
+
+func encodeImageInstructions(instructions []Instruction) []byte {
+	out := make([]byte, len(instructions)*int(instructionBytes))
+	for i, instr := range instructions {
+		encodeInstruction(instr, out[i*int(instructionBytes):])
+	}
+
+	return out
+}
+
+func decodeImageInstructions(contents []byte, errInvalid error) ([]Instruction, error) {
+	if uint32(len(contents))%instructionBytes != 0 {
+		return nil, fmt.Errorf("%w: instruction section length %d is not a multiple of %d", errInvalid, len(contents), instructionBytes)
+	}
+
+	instructions := make([]Instruction, len(contents)/int(instructionBytes))
+	for i := range instructions {
+		instructions[i] = decodeInstructionTyped(contents[i*int(instructionBytes):])
+	}
+
+	return instructions, nil
+}
+
+// Debug symbols are written in address order so that the same program always produces the same image
+func encodeDebugSymbols(debugSymMap map[int]string) []byte {
+	addrs := make([]int, 0, len(debugSymMap))
+	for addr := range debugSymMap {
+		addrs = append(addrs, addr)
+	}
+	slices.Sort(addrs)
+
+	out := binary.LittleEndian.AppendUint32(nil, uint32(len(addrs)))
+	for _, addr := range addrs {
+		out = binary.LittleEndian.AppendUint32(out, uint32(addr))
+		out = appendString(out, debugSymMap[addr])
+	}
+
+	return out
+}
+
+func decodeDebugSymbols(contents []byte, errInvalid error) (map[int]string, error) {
+	r := &sectionReader{contents: contents}
+	count := r.uint32()
+	debugSymMap := make(map[int]string)
+	for i := uint32(0); i < count && !r.truncated; i++ {
+		addr := r.uint32()
+		debugSymMap[int(addr)] = r.string()
+	}
+
+	if r.truncated {
+		return nil, fmt.Errorf("%w: debug symbol section is truncated", errInvalid)
+	}
+
+	return debugSymMap, nil
+}
+
+// Strings are written as a 4 byte length followed by the bytes of the string
+func appendString(out []byte, s string) []byte {
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(s)))
+	return append(out, s...)
+}
+
+// Reads values from the contents of a section. Once the contents run out every read returns 0 and
+// truncated is set.
+type sectionReader struct {
+	contents  []byte
+	truncated bool
+}
+
+func (r *sectionReader) next(n uint32) []byte {
+	if r.truncated || uint32(len(r.contents)) < n {
+		r.truncated = true
+		return make([]byte, n)
+	}
+
+	b := r.contents[:n]
+	r.contents = r.contents[n:]
+	return b
+}
+
+func (r *sectionReader) uint8() uint8 {
+	return r.next(1)[0]
+}
+
+func (r *sectionReader) uint32() uint32 {
+	return uint32FromBytes(r.next(varchBytes))
+}
+
+func (r *sectionReader) string() string {
+	length := r.uint32()
+	if r.truncated || uint32(len(r.contents)) < length {
+		r.truncated = true
+		return ""
+	}
+
+	return string(r.next(length))
+}
@@ -0,0 +1,135 @@
+package gvm
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// .include "file" - assembles the file in place (each time it's included)
+	directiveInclude = ".include"
+	// .import "file" - assembles the file in place unless it has already been assembled
+	directiveImport = ".import"
+)
+
+// Reads each line of a source file
+func readSourceFile(filename string) ([]sourceLine, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	lines := make([]sourceLine, 0)
+	reader := bufio.NewReader(file)
+	for lineNum := 1; ; lineNum++ {
+		line, _, err := reader.ReadLine()
+		if err != nil {
+			break
+		}
+
+		lines = append(lines, sourceLine{file: filename, line: lineNum, text: string(line)})
+	}
+
+	return lines, nil
+}
+
+// Preprocesses the lines of a file unless it would create an include cycle. If once is true the
+// file is skipped when it has already been assembled. Returns the cycle (if any) so the caller can
+// report it.
+func (a *assembler) preprocessIncludedFile(filename string, lines []sourceLine, once bool) []string {
+	path := absPath(filename)
+	for i, including := range a.includeStack {
+		if including == path {
+			return append(append([]string{}, a.includeStack[i:]...), path)
+		}
+	}
+
+	if once && a.included[path] {
+		return nil
+	}
+
+	a.included[path] = true
+	a.includeStack = append(a.includeStack, path)
+	a.preprocessFile(lines)
+	a.includeStack = a.includeStack[:len(a.includeStack)-1]
+	return nil
+}
+
+// Handles .include and .import
+func (a *assembler) preprocessInclude(source sourceLine, line string, fields []sourceField) {
+	directive, col := fields[0].text, fields[0].col
+	if len(fields) != 2 || !strings.HasPrefix(fields[1].text, "\"") || !strings.HasSuffix(fields[1].text, "\"") {
+		a.errorf(source, col, "%s wanted a quoted file name: %s", directive, line)
+		return
+	}
+	name := fields[1].text[1 : len(fields[1].text)-1]
+
+	filename, ok := a.findIncludeFile(source.file, name)
+	if !ok {
+		a.errorf(source, fields[1].col, "could not find %s in %s", name, strings.Join(a.includeSearchDirs(source.file), ", "))
+		return
+	}
+
+	lines, err := readSourceFile(filename)
+	if err != nil {
+		a.errorf(source, fields[1].col, "could not read %s: %s", filename, err)
+		return
+	}
+
+	if cycle := a.preprocessIncludedFile(filename, lines, directive == directiveImport); cycle != nil {
+		for i := range cycle {
+			cycle[i] = displayPath(cycle[i])
+		}
+		a.errorf(source, col, "include cycle: %s", strings.Join(cycle, " -> "))
+	}
+}
+
+// Directories searched for included files, starting with the directory of the including file
+func (a *assembler) includeSearchDirs(includingFile string) []string {
+	dirs := []string{filepath.Dir(includingFile)}
+	return append(dirs, a.includePaths...)
+}
+
+// Returns the path of an included file, searching each include directory in order
+func (a *assembler) findIncludeFile(includingFile, name string) (string, bool) {
+	if filepath.IsAbs(name) {
+		return name, fileExists(name)
+	}
+
+	for _, dir := range a.includeSearchDirs(includingFile) {
+		if path := filepath.Join(dir, name); fileExists(path) {
+			return path, true
+		}
+	}
+
+	return "", false
+}
+
+func fileExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir()
+}
+
+// Files are identified by their absolute path so that the same file reached through different
+// relative paths is only assembled once
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+
+	return filepath.Clean(path)
+}
+
+// Shortens an absolute path to be relative to the working directory when possible
+func displayPath(path string) string {
+	if wd, err := os.Getwd(); err == nil {
+		if rel, err := filepath.Rel(wd, path); err == nil && !strings.HasPrefix(rel, "..") {
+			return rel
+		}
+	}
+
+	return path
+}
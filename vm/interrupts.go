@@ -0,0 +1,138 @@
+package gvm
+
+/*
+	Interrupt controller
+
+	Device responses reach the program through an interrupt controller that lives in special registers
+	34-39 (read with srload and written with srstore). Every hardware port is an interrupt line, and bit n
+	of the line masks below belongs to port n.
+
+		sr 34: mask - responses for a line whose bit is set wait on the response bus until the bit is cleared
+		sr 35: pending - bit set for every line that has a response waiting (read only)
+		sr 36: in service - bit set for every line whose handler is running. Storing to it clears the bits
+		       that are set in the stored value (end of interrupt)
+		sr 37: priorities of lines 0-7, 4 bits per line starting from the lowest bits
+		sr 38: priorities of lines 8-15
+		sr 39: control - when bit 0 is set, in service bits are only cleared by storing to sr 36. Otherwise
+		       resume clears the bit of the line whose handler it returns from
+
+	A response is delivered once its line isn't masked and its priority (0-15, higher is more urgent) is
+	greater than the priority of every line in service, so a handler can only be interrupted by a line with
+	a higher priority. Out of the responses that can be delivered, the one with the highest priority goes
+	first, and ones with the same priority go in the order they were sent.
+
+	Everything starts out as 0: no lines are masked, every line has the same priority and resume ends the
+	interrupt. Device errors and responses that aren't for a hardware port aren't controlled by it and are
+	delivered right away (cli still holds them back).
+*/
+
+const (
+	picMaskRegister       = numRegisters + 2
+	picPendingRegister    = numRegisters + 3
+	picInServiceRegister  = numRegisters + 4
+	picPriorityRegister   = numRegisters + 5 // lines 0-7, and the register after it has lines 8-15
+	picControlRegister    = numRegisters + 7
+	picManualEndInterrupt = 1 << 0
+
+	// Line of a response the interrupt controller doesn't handle (also used for interrupts that
+	// aren't from a device)
+	noInterruptLine = maxHWDevices
+
+	linePriorityBits = 4
+	linesPerRegister = 32 / linePriorityBits
+)
+
+// Returns the port a device response was sent from, or noInterruptLine
+func interruptLine(resp *Response) uint32 {
+	if resp.deviceErr != nil || resp.interruptAddr%varchBytes != 0 || resp.interruptAddr/varchBytes >= maxHWDevices {
+		return noInterruptLine
+	}
+	return resp.interruptAddr / varchBytes
+}
+
+func (vm *VM) linePriority(line uint32) int {
+	priorities := vm.registers[picPriorityRegister+line/linesPerRegister]
+	return int(priorities>>(line%linesPerRegister*linePriorityBits)) & (1<<linePriorityBits - 1)
+}
+
+// Returns the priority a response needs to be greater than to interrupt the running code (-1 when no
+// line is in service)
+func (vm *VM) runningPriority() int {
+	priority := -1
+	for line := range maxHWDevices {
+		if vm.registers[picInServiceRegister]&(1<<line) != 0 {
+			priority = max(priority, vm.linePriority(line))
+		}
+	}
+	return priority
+}
+
+// Returns the index of the response that should be delivered next, or -1 if every one of them is
+// being held back
+func (vm *VM) chooseResponse(responses []*Response) int {
+	chosen, chosenPriority := -1, vm.runningPriority()
+	for i, resp := range responses {
+		line := interruptLine(resp)
+		if line == noInterruptLine {
+			return i
+		}
+
+		if vm.registers[picMaskRegister]&(1<<line) != 0 {
+			continue
+		}
+
+		if priority := vm.linePriority(line); priority > chosenPriority {
+			chosen, chosenPriority = i, priority
+		}
+	}
+	return chosen
+}
+
+// Called by resume with the frame pointer of the handler that's returning. Unless the controller only
+// ends interrupts through sr 36, the line that frame was handling is no longer in service (along with any
+// lines whose handlers ran inside of it and never resumed).
+func (vm *VM) endInterrupts(fp uint32) {
+	vm.heldResponses = 0
+	if vm.registers[picControlRegister]&picManualEndInterrupt != 0 {
+		return
+	}
+
+	for line := range maxHWDevices {
+		if vm.interruptFrames[line] <= fp {
+			vm.registers[picInServiceRegister] &^= 1 << line
+		}
+	}
+}
+
+// Sets the pending register to the lines that have responses waiting on the bus
+func (vm *VM) updatePendingInterrupts() {
+	pending := register(0)
+	for _, resp := range vm.responseBus.pending() {
+		if line := interruptLine(resp); line != noInterruptLine {
+			pending |= 1 << line
+		}
+	}
+	vm.registers[picPendingRegister] = pending
+}
+
+// Handles srstore for the interrupt controller's registers
+func (vm *VM) storeInterruptControllerRegister(index uint32, value register) {
+	switch index {
+	case picPendingRegister:
+		// Read only
+	case picInServiceRegister:
+		vm.registers[index] &^= value
+	default:
+		vm.registers[index] = value
+	}
+
+	// Anything that was held back might be deliverable now
+	vm.heldResponses = 0
+}
+
+// Unmasks every line and sets them back to the same priority with nothing in service
+func (vm *VM) resetInterruptController() {
+	clear(vm.registers[picMaskRegister : picControlRegister+1])
+	clear(vm.interruptFrames[:])
+	vm.heldResponses = 0
+}
@@ -0,0 +1,102 @@
+package gvm
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+/*
+	Labels come in 3 kinds
+
+		global:  name:   - can be used anywhere
+		local:   .name:  - scoped to the global label before it, so each function can have its own
+		                   .loop and .done (internally the label is named global.name)
+		numeric: 1:      - can be defined any number of times. 1b refers to the closest 1: before
+		                   the reference and 1f refers to the closest 1: after it.
+
+	Labels that come from a macro expansion never start a new scope for local labels.
+*/
+
+// Internal names of numeric labels start with this so they can't clash with other labels
+const numericLabelPrefix = "__numeric_"
+
+// Returns true if the label is a local label (.name)
+func isLocalLabel(label string) bool {
+	return strings.HasPrefix(label, ".") && isIdentifier(label[1:])
+}
+
+// Returns true if the label is a numeric label (all decimal digits)
+func isNumericLabel(label string) bool {
+	return label != "" && strings.IndexFunc(label, func(r rune) bool { return !unicode.IsDigit(r) }) < 0
+}
+
+// Returns the internal name of the i'th definition of a numeric label
+func numericLabelName(label string, i int) string {
+	return fmt.Sprintf("%s%s_%d", numericLabelPrefix, label, i)
+}
+
+// Converts a label definition into the name it's stored under. Global labels that don't come from
+// a macro expansion become the new scope for local labels.
+func (a *assembler) labelName(source sourceLine, label string, col int) (string, bool) {
+	switch {
+	case isNumericLabel(label):
+		name := numericLabelName(label, len(a.numericLabels[label]))
+		a.numericLabels[label] = append(a.numericLabels[label], a.linePos)
+		return name, true
+	case isLocalLabel(label):
+		if a.labelScope == "" {
+			a.errorf(source, col, "local label %s is not inside of a global label", label)
+			return "", false
+		}
+		return a.labelScope + label, true
+	case isIdentifier(label):
+		if len(source.expansions) == 0 {
+			a.labelScope = label
+		}
+		return label, true
+	}
+
+	a.errorf(source, col, "invalid label: %s:", label)
+	return "", false
+}
+
+// Returns true if name refers to a numeric label (1b or 1f)
+func isNumericLabelRef(name string) bool {
+	if len(name) < 2 {
+		return false
+	}
+
+	direction := name[len(name)-1]
+	return isNumericLabel(name[:len(name)-1]) && (direction == 'b' || direction == 'f')
+}
+
+// Converts a reference to a local or numeric label into the name the label is stored under. Any other
+// name is returned unchanged.
+func (a *assembler) resolveLabelRef(scope symbolScope, name string) (string, error) {
+	if isLocalLabel(name) {
+		if scope.label == "" {
+			return "", fmt.Errorf("local label %s is not inside of a global label", name)
+		}
+		return scope.label + name, nil
+	} else if !isNumericLabelRef(name) {
+		return name, nil
+	}
+
+	// Definitions are stored in the order they appear, so the first one after the reference is
+	// what 1f refers to and the one before that is what 1b refers to
+	label, direction := name[:len(name)-1], name[len(name)-1]
+	defs := a.numericLabels[label]
+	i, _ := slices.BinarySearch(defs, scope.pos)
+	if direction == 'b' {
+		if i == 0 {
+			return "", fmt.Errorf("no numeric label %s: before %s", label, name)
+		}
+		i--
+	} else if i == len(defs) {
+		return "", fmt.Errorf("no numeric label %s: after %s", label, name)
+	}
+
+	return numericLabelName(label, i), nil
+}
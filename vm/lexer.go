@@ -0,0 +1,109 @@
+package gvm
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A whitespace separated piece of a line along with its 1-based starting column
+type sourceField struct {
+	text string
+	col  int
+}
+
+// A line of source split into fields. This is the first step of assembling every line: labels,
+// directives, macros and instructions are all recognized from the fields.
+type lexedLine struct {
+	// The line with the comment and surrounding whitespace removed, and the 1-based column it starts at
+	text string
+	col  int
+	// Whitespace separated fields. Whitespace inside of parentheses, strings and characters doesn't end a field.
+	fields []sourceField
+	// Column of a string that is missing its closing quote (0 if every string was closed)
+	unterminated int
+}
+
+// Splits a line of source into fields, dropping any comment. A // inside of a string or character
+// doesn't start a comment.
+func lexLine(text string) lexedLine {
+	var l lexedLine
+	start, end, depth := -1, 0, 0
+
+scan:
+	for i := 0; i < len(text); {
+		c := text[i]
+		switch {
+		case c == '/' && strings.HasPrefix(text[i:], "//"):
+			break scan
+		case isSpaceByte(c) && depth == 0:
+			if start >= 0 {
+				l.fields = append(l.fields, sourceField{text: text[start:i], col: start + 1})
+				start = -1
+			}
+			i++
+			continue
+		}
+
+		if start < 0 {
+			start = i
+		}
+
+		switch c {
+		case '"', '\'':
+			closing := quoteEnd(text, i)
+			if closing < 0 {
+				if c == '"' && l.unterminated == 0 {
+					l.unterminated = i + 1
+				}
+				closing = len(text)
+			}
+			i = closing
+		case '(':
+			depth++
+			i++
+		case ')':
+			depth = max(depth-1, 0)
+			i++
+		default:
+			i++
+		}
+
+		if !isSpaceByte(c) {
+			end = i
+		}
+	}
+
+	if start >= 0 {
+		l.fields = append(l.fields, sourceField{text: text[start:end], col: start + 1})
+	}
+
+	if len(l.fields) > 0 {
+		l.col = l.fields[0].col
+		l.text = text[l.col-1 : end]
+	}
+
+	return l
+}
+
+// Returns the index just past the quote that closes the string or character starting at text[start],
+// or -1 if it's never closed
+func quoteEnd(text string, start int) int {
+	quote := text[start]
+	for i := start + 1; i < len(text); i++ {
+		switch text[i] {
+		case '\\':
+			i++
+		case quote:
+			return i + 1
+		}
+	}
+
+	return -1
+}
+
+// Only ASCII whitespace separates fields so that bytes inside of multi-byte characters are never
+// mistaken for whitespace
+func isSpaceByte(c byte) bool {
+	return c < utf8.RuneSelf && unicode.IsSpace(rune(c))
+}
@@ -0,0 +1,234 @@
+package gvm
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+const (
+	// .macro NAME [param...] starts a macro definition that runs until .endm (params can also be
+	// separated by commas)
+	directiveMacro = ".macro"
+	directiveEndm  = ".endm"
+
+	// Max number of nested macro expansions (stops macros that expand themselves forever)
+	maxMacroExpansionDepth = 64
+)
+
+// A macro defined with .macro. The body is kept as source text and substituted each time the
+// macro is used.
+type macro struct {
+	name   string
+	params []string
+	body   []sourceLine
+	source sourceLine
+	// Labels defined inside of the body, which are given unique names for each expansion
+	labels []string
+	// Set when the parameters had problems. The macro is still defined so that its uses don't each
+	// report an unknown bytecode, but they expand to nothing.
+	invalid bool
+}
+
+// Identifies one step in the chain of macro expansions that produced a line of source
+type MacroExpansion struct {
+	// Name of the macro that was expanded
+	Macro string
+	// Where the macro was used
+	File string
+	Line int
+}
+
+func (e MacroExpansion) String() string {
+	return fmt.Sprintf("in expansion of macro %s at %s:%d", e.Macro, displayFileName(e.File), e.Line)
+}
+
+// Starts recording a macro definition. Lines are added to the macro's body until .endm.
+func (a *assembler) beginMacro(source sourceLine, line string, fields []sourceField) {
+	col := fields[0].col
+	if len(fields) < 2 {
+		a.errorf(source, col, "%s wanted a name: %s", directiveMacro, line)
+	}
+
+	// Even if the definition has problems, the body still needs to be skipped
+	m := &macro{source: source}
+	a.macro = m
+	if len(fields) < 2 {
+		return
+	}
+
+	name := fields[1]
+	if !isIdentifier(name.text) {
+		a.errorf(source, name.col, "invalid macro name: %s", name.text)
+		return
+	} else if _, ok := strToInstrMap[name.text]; ok {
+		a.errorf(source, name.col, "macro %s has the same name as an instruction", name.text)
+		return
+	} else if prev, ok := a.macros[name.text]; ok {
+		a.errorf(source, name.col, "macro %s redefined (previous definition at %s:%d)", name.text, displayFileName(prev.source.file), prev.source.line)
+		return
+	}
+
+	m.name = name.text
+	params, ok := splitMacroParams(fields[2:])
+	if !ok {
+		a.errorf(source, fields[2].col, "invalid macro parameter list: %s", line)
+		m.invalid = true
+	}
+
+	for _, param := range params {
+		if !isIdentifier(param.text) {
+			a.errorf(source, param.col, "invalid macro parameter name: %s", param.text)
+			m.invalid = true
+		} else if slices.Contains(m.params, param.text) {
+			a.errorf(source, param.col, "duplicate macro parameter: %s", param.text)
+			m.invalid = true
+		}
+		m.params = append(m.params, param.text)
+	}
+}
+
+// Splits the parameters of a macro definition or the arguments of a macro use, which can be
+// separated by whitespace, a comma or both. Returns false if a comma doesn't come between two parameters.
+func splitMacroParams(fields []sourceField) ([]sourceField, bool) {
+	var params []sourceField
+	afterComma := false
+	for _, field := range fields {
+		col := field.col
+		for i, text := range strings.Split(field.text, ",") {
+			if i > 0 {
+				if afterComma || len(params) == 0 {
+					return nil, false
+				}
+				afterComma = true
+				col++
+			}
+
+			if text != "" {
+				params = append(params, sourceField{text: text, col: col})
+				afterComma = false
+			}
+			col += len(text)
+		}
+	}
+
+	return params, !afterComma
+}
+
+// Adds a line to the macro currently being defined, or finishes the definition if the line is .endm
+func (a *assembler) recordMacroLine(source sourceLine, line string, col int) {
+	m := a.macro
+	if line == directiveEndm {
+		a.macro = nil
+		// Macros without a valid name are dropped (the problem has already been reported)
+		if m.name != "" {
+			a.macros[m.name] = m
+		}
+		return
+	} else if strings.HasPrefix(line, directiveMacro) && isDirective(line) {
+		a.errorf(source, col, "macro definitions can't be nested (missing %s for macro %s?)", directiveEndm, m.name)
+		return
+	}
+
+	if label, ok := strings.CutSuffix(line, ":"); ok && (isIdentifier(label) || isLocalLabel(label)) && !slices.Contains(m.labels, label) {
+		m.labels = append(m.labels, label)
+	}
+	m.body = append(m.body, source)
+}
+
+// Reports a macro definition that was never finished
+func (a *assembler) checkUnterminatedMacro() {
+	// Macros without a valid name have already been reported
+	if a.macro != nil && a.macro.name != "" {
+		a.errorf(a.macro.source, 0, "macro %s is missing %s", a.macro.name, directiveEndm)
+	}
+	a.macro = nil
+}
+
+// Expands a use of a macro by substituting the arguments into the body and preprocessing each
+// resulting line
+func (a *assembler) expandMacro(m *macro, source sourceLine, line string, fields []sourceField) {
+	col := fields[0].col
+	if m.invalid {
+		return
+	}
+
+	args, ok := splitMacroParams(fields[1:])
+	if !ok {
+		a.errorf(source, fields[1].col, "invalid macro argument list: %s", line)
+		return
+	}
+
+	if len(source.expansions) >= maxMacroExpansionDepth {
+		a.errorf(source, col, "macro expansion of %s is nested too deeply (max depth %d)", m.name, maxMacroExpansionDepth)
+		return
+	}
+
+	if len(args) != len(m.params) {
+		a.errorf(source, col, "macro %s wanted %d args but got %d", m.name, len(m.params), len(args))
+		return
+	}
+
+	replacements := make(map[string]string, len(m.params)+len(m.labels))
+	a.macroExpansions++
+	for _, label := range m.labels {
+		replacements[label] = fmt.Sprintf("%s.%s.%d", label, m.name, a.macroExpansions)
+	}
+	for i, param := range m.params {
+		replacements[param] = args[i].text
+	}
+
+	expansions := append(append([]MacroExpansion{}, source.expansions...), MacroExpansion{Macro: m.name, File: source.file, Line: source.line})
+	for _, bodyLine := range m.body {
+		a.preprocessLine(sourceLine{
+			file:       bodyLine.file,
+			line:       bodyLine.line,
+			text:       replaceIdentifiers(bodyLine.text, replacements),
+			expansions: expansions,
+		})
+	}
+}
+
+// Replaces whole identifiers found in text (outside of strings, characters and comments)
+func replaceIdentifiers(text string, replacements map[string]string) string {
+	var out strings.Builder
+	for i := 0; i < len(text); {
+		c := rune(text[i])
+		switch {
+		case strings.HasPrefix(text[i:], "//"):
+			out.WriteString(text[i:])
+			return out.String()
+		case c == '"' || c == '\'':
+			// Copy everything up to and including the closing quote
+			end := i + 1
+			for end < len(text) && rune(text[end]) != c {
+				if text[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			end = min(end+1, len(text))
+			out.WriteString(text[i:end])
+			i = end
+		case isIdentifierRune(c, true):
+			// Numbers are skipped as a whole so that 0xFF isn't treated as 0 followed by xFF
+			end := i
+			for end < len(text) && isIdentifierRune(rune(text[end]), true) {
+				end++
+			}
+
+			word := text[i:end]
+			if replacement, ok := replacements[word]; ok && !unicode.IsDigit(c) {
+				word = replacement
+			}
+			out.WriteString(word)
+			i = end
+		default:
+			out.WriteByte(text[i])
+			i++
+		}
+	}
+
+	return out.String()
+}
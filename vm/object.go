@@ -0,0 +1,319 @@
+package gvm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strings"
+)
+
+/*
+	Relocatable objects and linking
+
+	Each object is assembled on its own without knowing where it will end up in memory, so the
+	addresses of its labels are kept relative to the start of their section. Every place that uses
+	an address gets a relocation: the base the address is relative to (the object's .text or .data
+	section, or a symbol imported with .extern) and an addend.
+
+	Link places the .text sections of every object one after the other starting at the load address,
+	followed by every .data section, and then fills in each relocation with the final address.
+	Labels named by .global are visible to the other objects being linked.
+*/
+
+// Kinds of places that a relocation fills in
+type relocationKind uint8
+
+const (
+	// The 32-bit argument of an instruction (offset is the index of the instruction)
+	relocInstructionArg relocationKind = iota
+	// 4 bytes in the .data section (offset is the byte offset into the section)
+	relocDataWord
+)
+
+// Relocation bases for addresses relative to the start of one of the object's own sections. Symbol names
+// can't start with a . so these never clash with imported symbols.
+const (
+	relocBaseText = directiveText
+	relocBaseData = directiveData
+)
+
+// A place in an object where an address needs to be filled in by the linker
+type relocation struct {
+	kind   relocationKind
+	offset int
+	// Either relocBaseText, relocBaseData or the name of an imported symbol
+	base   string
+	addend int64
+}
+
+// A label defined by an object
+type objectSymbol struct {
+	labelLocation
+	// True if the label was named by .global
+	exported bool
+}
+
+// A relocatable object produced by assembling source files. Objects are turned into a program that
+// can be run with Link.
+type Object struct {
+	// Source file the object was assembled from
+	name string
+
+	instructions []Instruction
+	data         []byte
+	// The .data section has to be placed at a multiple of this when linking
+	dataAlign int
+
+	// Every label defined by the object, the symbols it expects other objects to provide and the
+	// places where addresses need to be filled in
+	symbols     map[string]objectSymbol
+	imports     []string
+	relocations []relocation
+
+	// Maps from offset into the .text section -> source
+	debugSymMap   map[int]string
+	warnings      Diagnostics
+	optimizations OptimizationReport
+}
+
+// Returns the name of the source file the object was assembled from
+func (o *Object) Name() string {
+	return o.name
+}
+
+// Returns the warnings produced while assembling the object
+func (o *Object) Warnings() Diagnostics {
+	return o.warnings
+}
+
+// Returns the relocation base for addresses relative to the start of the section
+func (s section) relocationBase() string {
+	if s == sectionData {
+		return relocBaseData
+	}
+
+	return relocBaseText
+}
+
+// Options that control how objects are linked into a program
+type LinkOptions struct {
+	// Address the program's instructions are loaded at, with the static data directly after them. Has to
+	// be a multiple of the instruction size and can't overlap the interrupt vector table. 0 means directly
+	// after the interrupt vector table.
+	LoadAddress uint32
+	// If set, a map of where every section and label ended up is written here
+	Map io.Writer
+}
+
+// Where each object's sections ended up
+type objectLayout struct {
+	textAddr uint32
+	dataAddr uint32
+}
+
+// Links objects into a program. The first instruction of the first object is where the program starts
+// executing. Every symbol imported by an object has to be exported by exactly one of the objects.
+func Link(objects []*Object, options LinkOptions) (Program, error) {
+	if len(objects) == 0 {
+		return Program{}, errors.New("no objects to link")
+	}
+
+	loadAddr := options.LoadAddress
+	if loadAddr == 0 {
+		loadAddr = reservedBytes
+	}
+
+	if loadAddr < reservedBytes {
+		return Program{}, fmt.Errorf("load address 0x%X overlaps the interrupt vector table (which ends at 0x%X)", loadAddr, reservedBytes)
+	} else if loadAddr%instructionBytes != 0 {
+		return Program{}, fmt.Errorf("load address 0x%X is not a multiple of %d", loadAddr, instructionBytes)
+	}
+
+	// All instructions come first so that the static data directly follows them
+	layouts := make([]objectLayout, len(objects))
+	addr := uint64(loadAddr)
+	for i, obj := range objects {
+		layouts[i].textAddr = uint32(min(addr, math.MaxUint32))
+		addr += uint64(len(obj.instructions)) * uint64(instructionBytes)
+	}
+
+	dataStart := addr
+	for i, obj := range objects {
+		for addr%uint64(obj.dataAlign) != 0 {
+			addr++
+		}
+		layouts[i].dataAddr = uint32(min(addr, math.MaxUint32))
+		addr += uint64(len(obj.data))
+	}
+
+	if addr > math.MaxUint32 {
+		return Program{}, fmt.Errorf("linked program (%d bytes) does not fit into the 32-bit address space", addr-uint64(loadAddr))
+	}
+
+	var errs []error
+	exports := make(map[string]uint32)
+	exportedBy := make(map[string]*Object)
+	for i, obj := range objects {
+		for _, name := range sortedSymbolNames(obj.symbols) {
+			sym := obj.symbols[name]
+			if !sym.exported {
+				continue
+			} else if other, ok := exportedBy[name]; ok {
+				errs = append(errs, fmt.Errorf("symbol %s is exported by both %s and %s", name, displayFileName(other.name), displayFileName(obj.name)))
+				continue
+			}
+
+			exports[name] = layouts[i].symbolAddress(sym.labelLocation)
+			exportedBy[name] = obj
+		}
+	}
+
+	for _, obj := range objects {
+		for _, name := range obj.imports {
+			if _, ok := exports[name]; !ok {
+				errs = append(errs, fmt.Errorf("undefined symbol %s (imported by %s)", name, displayFileName(obj.name)))
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return Program{}, errors.Join(errs...)
+	}
+
+	program := Program{
+		data:       make([]byte, addr-dataStart),
+		entryPoint: loadAddr,
+		loadAddr:   loadAddr,
+	}
+
+	for i, obj := range objects {
+		layout := layouts[i]
+		firstInstr := len(program.instructions)
+		program.instructions = append(program.instructions, obj.instructions...)
+		objData := program.data[uint64(layout.dataAddr)-dataStart:]
+		copy(objData, obj.data)
+
+		for _, reloc := range obj.relocations {
+			var base uint32
+			switch reloc.base {
+			case relocBaseText:
+				base = layout.textAddr
+			case relocBaseData:
+				base = layout.dataAddr
+			default:
+				base = exports[reloc.base]
+			}
+
+			value := int64(base) + reloc.addend
+			if value < 0 || value > math.MaxUint32 {
+				errs = append(errs, fmt.Errorf("%s: address %d is outside of the 32-bit address space", displayFileName(obj.name), value))
+				continue
+			}
+
+			if reloc.kind == relocInstructionArg {
+				program.instructions[firstInstr+reloc.offset].arg = uint32(value)
+			} else {
+				uint32ToBytes(uint32(value), objData[reloc.offset:])
+			}
+		}
+
+		if obj.debugSymMap != nil {
+			if program.debugSymMap == nil {
+				program.debugSymMap = make(map[int]string)
+			}
+
+			for offset, source := range obj.debugSymMap {
+				program.debugSymMap[int(layout.textAddr)+offset] = source
+			}
+		}
+
+		program.warnings = append(program.warnings, obj.warnings...)
+		program.optimizations.InstructionsBefore += obj.optimizations.InstructionsBefore
+		program.optimizations.InstructionsAfter += obj.optimizations.InstructionsAfter
+		program.optimizations.Optimizations = append(program.optimizations.Optimizations, obj.optimizations.Optimizations...)
+	}
+
+	if len(errs) > 0 {
+		return Program{}, errors.Join(errs...)
+	}
+
+	if options.Map != nil {
+		if err := writeLinkMap(options.Map, objects, layouts, loadAddr); err != nil {
+			return Program{}, err
+		}
+	}
+
+	return program, nil
+}
+
+// Returns the final address of a label in an object that has been placed
+func (l objectLayout) symbolAddress(loc labelLocation) uint32 {
+	if loc.section == sectionData {
+		return l.dataAddr + uint32(loc.offset)
+	}
+
+	return l.textAddr + uint32(loc.offset)
+}
+
+// Symbols are always handled in name order so that linking gives the same result every time
+func sortedSymbolNames(symbols map[string]objectSymbol) []string {
+	names := make([]string, 0, len(symbols))
+	for name := range symbols {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Writes where each section and label ended up, sorted by address
+func writeLinkMap(w io.Writer, objects []*Object, layouts []objectLayout, loadAddr uint32) error {
+	var out strings.Builder
+	fmt.Fprintf(&out, "Load address: 0x%08X\n\nSections:\n", loadAddr)
+	for i, obj := range objects {
+		textBytes := uint32(len(obj.instructions)) * instructionBytes
+		fmt.Fprintf(&out, "  0x%08X-0x%08X  .text  %s\n", layouts[i].textAddr, layouts[i].textAddr+textBytes, displayFileName(obj.name))
+	}
+	for i, obj := range objects {
+		if len(obj.data) > 0 {
+			fmt.Fprintf(&out, "  0x%08X-0x%08X  .data  %s\n", layouts[i].dataAddr, layouts[i].dataAddr+uint32(len(obj.data)), displayFileName(obj.name))
+		}
+	}
+
+	type mapSymbol struct {
+		addr     uint32
+		name     string
+		obj      *Object
+		exported bool
+	}
+
+	symbols := make([]mapSymbol, 0)
+	for i, obj := range objects {
+		for name, sym := range obj.symbols {
+			// Numeric labels don't have a name worth showing
+			if !strings.HasPrefix(name, numericLabelPrefix) {
+				symbols = append(symbols, mapSymbol{layouts[i].symbolAddress(sym.labelLocation), name, obj, sym.exported})
+			}
+		}
+	}
+
+	slices.SortFunc(symbols, func(a, b mapSymbol) int {
+		if a.addr != b.addr {
+			return int(int64(a.addr) - int64(b.addr))
+		}
+		return strings.Compare(a.name, b.name)
+	})
+
+	out.WriteString("\nSymbols:\n")
+	for _, sym := range symbols {
+		visibility := "local"
+		if sym.exported {
+			visibility = "global"
+		}
+		fmt.Fprintf(&out, "  0x%08X  %-6s  %s  (%s)\n", sym.addr, visibility, sym.name, displayFileName(sym.obj.name))
+	}
+
+	_, err := io.WriteString(w, out.String())
+	return err
+}
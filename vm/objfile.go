@@ -0,0 +1,296 @@
+package gvm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+)
+
+/*
+	Binary format for relocatable objects (all values little endian, strings are stored the same
+	way as in images)
+
+	Header
+		- 4 bytes: magic number "GVMO"
+		- 2 bytes: format version
+		- 2 bytes: flags (currently unused, must be 0)
+		- 4 bytes: alignment of the data section
+		- 4 bytes: number of sections
+
+	Sections use the same layout as images, and the instruction, data and debug symbol sections are
+	encoded the same way (debug symbol addresses are offsets into the instructions). Other section kinds
+	are
+		- 0x10 name: <string> source file the object was assembled from
+		- 0x11 symbols: 4 byte count followed by each symbol as
+			- 1 byte: section (0 = .text, 1 = .data)
+			- 1 byte: 1 if the symbol is exported, otherwise 0
+			- 2 bytes: unused (must be 0)
+			- 4 bytes: offset into the section
+			- <string> name
+		- 0x12 imports: 4 byte count followed by the <string> name of each imported symbol
+		- 0x13 relocations: 4 byte count followed by each relocation as
+			- 1 byte: kind (0 = instruction argument, 1 = 32-bit data value)
+			- 3 bytes: unused (must be 0)
+			- 4 bytes: offset (instruction index or byte offset into the data section)
+			- 4 bytes: signed addend
+			- <string> base (".text", ".data" or the name of an imported symbol)
+*/
+
+const (
+	objectVersion uint16 = 1
+
+	objectSectionName        imageSectionKind = 0x10
+	objectSectionSymbols     imageSectionKind = 0x11
+	objectSectionImports     imageSectionKind = 0x12
+	objectSectionRelocations imageSectionKind = 0x13
+
+	// magic (4) + version (2) + flags (2) + data alignment (4) + section count (4)
+	objectHeaderBytes uint32 = 16
+)
+
+var (
+	objectMagic = [4]byte{'G', 'V', 'M', 'O'}
+
+	errInvalidObject = errors.New("invalid object file")
+)
+
+// Serializes the object into the binary object format
+func (o *Object) WriteObject(w io.Writer) error {
+	sections := []fileSection{
+		{imageSectionInstructions, encodeImageInstructions(o.instructions)},
+		{objectSectionName, appendString(nil, o.name)},
+		{objectSectionSymbols, o.encodeSymbols()},
+		{objectSectionImports, encodeStrings(o.imports)},
+		{objectSectionRelocations, o.encodeRelocations()},
+	}
+
+	if len(o.data) > 0 {
+		sections = append(sections, fileSection{imageSectionData, o.data})
+	}
+
+	if o.debugSymMap != nil {
+		sections = append(sections, fileSection{imageSectionDebugSymbols, encodeDebugSymbols(o.debugSymMap)})
+	}
+
+	header := make([]byte, objectHeaderBytes)
+	copy(header, objectMagic[:])
+	uint16ToBytes(objectVersion, header[4:])
+	uint16ToBytes(0, header[6:])
+	uint32ToBytes(uint32(o.dataAlign), header[8:])
+	uint32ToBytes(uint32(len(sections)), header[12:])
+
+	bw := bufio.NewWriter(w)
+	bw.Write(header)
+	writeSections(bw, sections)
+
+	// bufio.Writer remembers the first write error so only the flush needs to be checked
+	return bw.Flush()
+}
+
+// Reads an object that was previously serialized with WriteObject
+func ReadObject(r io.Reader) (*Object, error) {
+	header := make([]byte, objectHeaderBytes)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("%w: could not read header: %w", errInvalidObject, err)
+	}
+
+	if !bytes.Equal(header[:4], objectMagic[:]) {
+		return nil, fmt.Errorf("%w: bad magic number", errInvalidObject)
+	}
+
+	if version := uint16FromBytes(header[4:]); version != objectVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", errInvalidObject, version)
+	}
+
+	obj := &Object{dataAlign: int(uint32FromBytes(header[8:])), symbols: make(map[string]objectSymbol)}
+	if obj.dataAlign <= 0 || obj.dataAlign&(obj.dataAlign-1) != 0 {
+		return nil, fmt.Errorf("%w: data alignment %d is not a power of 2", errInvalidObject, obj.dataAlign)
+	}
+
+	sections, err := readSections(r, uint32FromBytes(header[12:]), errInvalidObject)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, kind := range []imageSectionKind{imageSectionInstructions, objectSectionName, objectSectionSymbols, objectSectionImports, objectSectionRelocations} {
+		if _, ok := sections[kind]; !ok {
+			return nil, fmt.Errorf("%w: missing section 0x%02X", errInvalidObject, kind)
+		}
+	}
+
+	if obj.instructions, err = decodeImageInstructions(sections[imageSectionInstructions], errInvalidObject); err != nil {
+		return nil, err
+	}
+
+	obj.data = sections[imageSectionData]
+	if contents, ok := sections[imageSectionDebugSymbols]; ok {
+		if obj.debugSymMap, err = decodeDebugSymbols(contents, errInvalidObject); err != nil {
+			return nil, err
+		}
+	}
+
+	name := &sectionReader{contents: sections[objectSectionName]}
+	obj.name = name.string()
+	imports := &sectionReader{contents: sections[objectSectionImports]}
+	obj.imports = decodeStrings(imports)
+	if name.truncated || imports.truncated {
+		return nil, fmt.Errorf("%w: name or imports section is truncated", errInvalidObject)
+	}
+
+	if err := obj.decodeSymbols(sections[objectSectionSymbols]); err != nil {
+		return nil, err
+	}
+
+	if err := obj.decodeRelocations(sections[objectSectionRelocations]); err != nil {
+		return nil, err
+	}
+
+	return obj, nil
+}
+
+// Writes the object to a binary object file
+func (o *Object) WriteObjectFile(filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+
+	if err := o.WriteObject(file); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// Reads an object from a binary object file
+func ReadObjectFile(filename string) (*Object, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ReadObject(bufio.NewReader(file))
+}
+
+// Returns true if the file starts with the object file magic number
+func IsObjectFile(filename string) bool {
+	return fileHasMagic(filename, objectMagic)
+}
+
+func encodeStrings(strs []string) []byte {
+	out := binary.LittleEndian.AppendUint32(nil, uint32(len(strs)))
+	for _, s := range strs {
+		out = appendString(out, s)
+	}
+
+	return out
+}
+
+func decodeStrings(r *sectionReader) []string {
+	count := r.uint32()
+	var strs []string
+	for i := uint32(0); i < count && !r.truncated; i++ {
+		strs = append(strs, r.string())
+	}
+
+	return strs
+}
+
+// Symbols are written in name order so that the same object always produces the same file
+func (o *Object) encodeSymbols() []byte {
+	names := sortedSymbolNames(o.symbols)
+	out := binary.LittleEndian.AppendUint32(nil, uint32(len(names)))
+	for _, name := range names {
+		sym := o.symbols[name]
+		exported := byte(0)
+		if sym.exported {
+			exported = 1
+		}
+
+		out = append(out, byte(sym.section), exported, 0, 0)
+		out = binary.LittleEndian.AppendUint32(out, uint32(sym.offset))
+		out = appendString(out, name)
+	}
+
+	return out
+}
+
+func (o *Object) decodeSymbols(contents []byte) error {
+	r := &sectionReader{contents: contents}
+	count := r.uint32()
+	for i := uint32(0); i < count && !r.truncated; i++ {
+		sec, exported := section(r.uint8()), r.uint8() == 1
+		r.next(2)
+		offset := int(r.uint32())
+		name := r.string()
+
+		sectionBytes := len(o.instructions) * int(instructionBytes)
+		if sec == sectionData {
+			sectionBytes = len(o.data)
+		}
+
+		if !r.truncated && (sec > sectionData || offset > sectionBytes) {
+			return fmt.Errorf("%w: symbol %s is outside of its section", errInvalidObject, name)
+		}
+
+		o.symbols[name] = objectSymbol{labelLocation: labelLocation{section: sec, offset: offset}, exported: exported}
+	}
+
+	if r.truncated {
+		return fmt.Errorf("%w: symbol section is truncated", errInvalidObject)
+	}
+
+	return nil
+}
+
+func (o *Object) encodeRelocations() []byte {
+	out := binary.LittleEndian.AppendUint32(nil, uint32(len(o.relocations)))
+	for _, reloc := range o.relocations {
+		out = append(out, byte(reloc.kind), 0, 0, 0)
+		out = binary.LittleEndian.AppendUint32(out, uint32(reloc.offset))
+		out = binary.LittleEndian.AppendUint32(out, uint32(int32(reloc.addend)))
+		out = appendString(out, reloc.base)
+	}
+
+	return out
+}
+
+func (o *Object) decodeRelocations(contents []byte) error {
+	r := &sectionReader{contents: contents}
+	count := r.uint32()
+	for i := uint32(0); i < count && !r.truncated; i++ {
+		kind := relocationKind(r.uint8())
+		r.next(3)
+		reloc := relocation{kind: kind, offset: int(r.uint32()), addend: int64(int32(r.uint32())), base: r.string()}
+		if r.truncated {
+			break
+		}
+
+		// Make sure the linker won't write outside of the object's sections
+		switch {
+		case kind == relocInstructionArg && reloc.offset < len(o.instructions):
+		case kind == relocDataWord && reloc.offset+int(varchBytes) <= len(o.data):
+		default:
+			return fmt.Errorf("%w: relocation %d is outside of its section", errInvalidObject, i)
+		}
+
+		if reloc.base != relocBaseText && reloc.base != relocBaseData && !slices.Contains(o.imports, reloc.base) {
+			return fmt.Errorf("%w: relocation %d is relative to %s, which isn't imported", errInvalidObject, i, reloc.base)
+		}
+
+		o.relocations = append(o.relocations, reloc)
+	}
+
+	if r.truncated {
+		return fmt.Errorf("%w: relocation section is truncated", errInvalidObject)
+	}
+
+	return nil
+}
@@ -0,0 +1,422 @@
+package gvm
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+/*
+	Peephole optimizer
+
+	Runs over the instructions of an assembled object before it's linked. Each pass looks at a small
+	window of instructions:
+		- const X followed by an instruction that can inline its argument becomes one instruction
+		  (const 4; addi -> addi 4, const 1; raddi 3 -> raddi 3 1, const label; jmp -> jmp label)
+		- nops are dropped when the program isn't being debugged
+		- instructions after an unconditional jmp are dropped until the next label or address that
+		  something refers to
+		- a jump to a jmp goes straight to where the jmp ends up
+
+	The passes are repeated until none of them change anything. Every label, relocation and debug symbol
+	is moved to match the instructions that are left.
+
+	Only addresses the assembler knows about are updated, so code that jumps to a hardcoded number or
+	to an offset into another object (fmt.Print+8) can't be optimized safely.
+*/
+
+// Kinds of changes the optimizer makes
+type OptimizationKind int
+
+const (
+	OptimizationFusedConst OptimizationKind = iota
+	OptimizationRemovedNop
+	OptimizationRemovedDeadCode
+	OptimizationThreadedJump
+)
+
+func (k OptimizationKind) String() string {
+	switch k {
+	case OptimizationFusedConst:
+		return "fused const"
+	case OptimizationRemovedNop:
+		return "removed nop"
+	case OptimizationRemovedDeadCode:
+		return "removed dead code"
+	case OptimizationThreadedJump:
+		return "threaded jump"
+	default:
+		return fmt.Sprintf("OptimizationKind(%d)", int(k))
+	}
+}
+
+// A single change made by the optimizer
+type Optimization struct {
+	Kind OptimizationKind
+	// Where the changed instruction came from (File is empty when the source came from a buffer)
+	File    string
+	Line    int
+	Message string
+}
+
+// Formats the change as file:line: kind: message
+func (o Optimization) String() string {
+	return fmt.Sprintf("%s:%d: %s: %s", displayFileName(o.File), o.Line, o.Kind, o.Message)
+}
+
+// What the optimizer changed
+type OptimizationReport struct {
+	// Number of instructions before and after optimizing
+	InstructionsBefore int
+	InstructionsAfter  int
+	// Every change in the order it was made
+	Optimizations []Optimization
+}
+
+// Summarizes the report followed by one line per change
+func (r OptimizationReport) String() string {
+	var out strings.Builder
+	fmt.Fprintf(&out, "%d instructions -> %d instructions", r.InstructionsBefore, r.InstructionsAfter)
+
+	counts := make(map[OptimizationKind]int)
+	for _, o := range r.Optimizations {
+		counts[o.Kind]++
+	}
+
+	for kind := OptimizationFusedConst; kind <= OptimizationThreadedJump; kind++ {
+		if counts[kind] > 0 {
+			fmt.Fprintf(&out, ", %s x%d", kind, counts[kind])
+		}
+	}
+
+	for _, o := range r.Optimizations {
+		out.WriteString("\n" + o.String())
+	}
+
+	return out.String()
+}
+
+// Returns what the optimizer changed while assembling the object (empty if it wasn't optimized)
+func (o *Object) OptimizationReport() OptimizationReport {
+	return o.optimizations
+}
+
+// Returns what the optimizer changed in each of the objects the program was linked from
+func (p Program) OptimizationReport() OptimizationReport {
+	return p.optimizations
+}
+
+// Holds the state for a single round of optimization passes over an object
+type optimizer struct {
+	obj *Object
+	// Where each instruction came from
+	sources []sourceLine
+	report  *OptimizationReport
+
+	// Maps from instruction index -> index into obj.relocations for instructions with an address argument
+	argRelocations map[int]int
+	// Instructions that a label or address points to. These can't be dropped as dead code or merged into
+	// the instruction before them.
+	targets map[int]bool
+	// Maps from .text offset -> label name (used in the report)
+	labelNames map[int]string
+	// Instructions that will be dropped once the round is over
+	removed []bool
+}
+
+// Optimizes the instructions of an object in place. sources holds the source of each instruction.
+// nops are kept when debugging so that every line can still have a breakpoint set on it.
+func optimizeObject(obj *Object, sources []sourceLine, keepNops bool) OptimizationReport {
+	report := OptimizationReport{InstructionsBefore: len(obj.instructions)}
+	for {
+		o := newOptimizer(obj, sources, &report)
+		changed := o.fuseConstants()
+		changed = o.threadJumps() || changed
+		changed = o.removeDeadCode() || changed
+		if !keepNops {
+			changed = o.removeNops() || changed
+		}
+
+		if !changed {
+			break
+		}
+
+		sources = o.compact()
+	}
+
+	report.InstructionsAfter = len(obj.instructions)
+	return report
+}
+
+func newOptimizer(obj *Object, sources []sourceLine, report *OptimizationReport) *optimizer {
+	o := &optimizer{
+		obj:            obj,
+		sources:        sources,
+		report:         report,
+		argRelocations: make(map[int]int),
+		targets:        make(map[int]bool),
+		labelNames:     make(map[int]string),
+		removed:        make([]bool, len(obj.instructions)),
+	}
+
+	for i, reloc := range obj.relocations {
+		if reloc.kind == relocInstructionArg {
+			o.argRelocations[reloc.offset] = i
+		}
+
+		if reloc.base == relocBaseText {
+			o.targets[int(reloc.addend)/int(instructionBytes)] = true
+		}
+	}
+
+	for _, name := range sortedSymbolNames(obj.symbols) {
+		sym := obj.symbols[name]
+		if sym.section != sectionText {
+			continue
+		}
+
+		o.targets[sym.offset/int(instructionBytes)] = true
+		if _, ok := o.labelNames[sym.offset]; !ok && !strings.HasPrefix(name, numericLabelPrefix) {
+			o.labelNames[sym.offset] = name
+		}
+	}
+
+	return o
+}
+
+// Records a change made to the instruction at index i
+func (o *optimizer) record(kind OptimizationKind, i int, format string, args ...any) {
+	source := o.sources[i]
+	o.report.Optimizations = append(o.report.Optimizations, Optimization{
+		Kind:    kind,
+		File:    source.file,
+		Line:    source.line,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// Source of the instruction at index i without any comment or surrounding whitespace
+func (o *optimizer) sourceText(i int) string {
+	return lexLine(o.sources[i].text).text
+}
+
+// Label name for a .text offset, or the offset itself if there isn't a label there
+func (o *optimizer) labelName(offset int) string {
+	if name, ok := o.labelNames[offset]; ok {
+		return name
+	}
+
+	return fmt.Sprintf(".text+%d", offset)
+}
+
+// Returns true for instructions where `const X; op` does the same thing as `op X`. Instructions like subi
+// and loadp32 aren't included since the pushed constant isn't used the same way as the inlined argument
+// (const X; subi computes X - stack[0] while subi X computes stack[0] - X).
+func fusesWithConstant(code Bytecode) bool {
+	switch code {
+	case Addi, Addf, Muli, Mulf, And, Or, Xor, Push, Pop, Pick:
+		return true
+	default:
+		return isBranch(code) || code.IsUnaryArithmeticOp()
+	}
+}
+
+// Merges const X with the instruction after it when it can take X as an argument instead
+func (o *optimizer) fuseConstants() bool {
+	changed := false
+	instructions := o.obj.instructions
+	for i := 0; i+1 < len(instructions); i++ {
+		constant, next := instructions[i], instructions[i+1]
+		if o.removed[i] || o.removed[i+1] || o.targets[i+1] || constant.bytecode() != Const {
+			continue
+		}
+
+		code := next.bytecode()
+		var fused Instruction
+		switch {
+		case next.numArgs() == 0 && fusesWithConstant(code):
+			fused = NewInstruction(1, code, 0, constant.arg)
+		case next.numArgs() == 1 && code.IsRegisterReadWriteOp():
+			// const X; raddi r pushes X and replaces it with r+X, which is what raddi r X pushes
+			fused = NewInstruction(2, code, next.register, constant.arg)
+		default:
+			continue
+		}
+
+		o.record(OptimizationFusedConst, i, "%s; %s", o.sourceText(i), o.sourceText(i+1))
+		if debugSymMap := o.obj.debugSymMap; debugSymMap != nil {
+			offset := i * int(instructionBytes)
+			debugSymMap[offset] += "; " + debugSymMap[offset+int(instructionBytes)]
+		}
+
+		instructions[i] = fused
+		o.removed[i+1] = true
+		changed = true
+		i++
+	}
+
+	return changed
+}
+
+// Points jumps whose target is a jmp directly at where that jmp goes
+func (o *optimizer) threadJumps() bool {
+	changed := false
+	for i, instr := range o.obj.instructions {
+		r, ok := o.argRelocations[i]
+		if o.removed[i] || !ok || instr.numArgs() != 1 || !isBranch(instr.bytecode()) || o.obj.relocations[r].base != relocBaseText {
+			continue
+		}
+
+		start := o.obj.relocations[r].addend
+		target, visited, loops := start, map[int64]bool{start: true}, false
+		for {
+			next, ok := o.jmpTarget(target)
+			if !ok {
+				break
+			} else if visited[next] {
+				loops = true
+				break
+			}
+
+			visited[next] = true
+			target = next
+		}
+
+		// A chain of jumps that loops back on itself never gets anywhere, so leave it alone
+		if loops || target == start {
+			continue
+		}
+
+		o.record(OptimizationThreadedJump, i, "%s now jumps directly to %s", o.sourceText(i), o.labelName(int(target)))
+		o.obj.relocations[r].addend = target
+		changed = true
+	}
+
+	return changed
+}
+
+// If the instruction at the .text offset is a jmp to a label in the same object, returns the offset
+// it jumps to
+func (o *optimizer) jmpTarget(offset int64) (int64, bool) {
+	i := offset / int64(instructionBytes)
+	if offset%int64(instructionBytes) != 0 || i < 0 || i >= int64(len(o.obj.instructions)) || o.removed[i] {
+		return 0, false
+	}
+
+	instr := o.obj.instructions[i]
+	r, ok := o.argRelocations[int(i)]
+	if !ok || instr.bytecode() != Jmp || instr.numArgs() != 1 || o.obj.relocations[r].base != relocBaseText {
+		return 0, false
+	}
+
+	return o.obj.relocations[r].addend, true
+}
+
+// Drops instructions that come after an unconditional jmp and that nothing points to
+func (o *optimizer) removeDeadCode() bool {
+	changed := false
+	instructions := o.obj.instructions
+	for i := 0; i < len(instructions); i++ {
+		if o.removed[i] || instructions[i].bytecode() != Jmp {
+			continue
+		}
+
+		first, count := i+1, 0
+		for i+1 < len(instructions) && !o.targets[i+1] {
+			i++
+			if !o.removed[i] {
+				o.removed[i] = true
+				count++
+			}
+		}
+
+		if count > 0 {
+			o.record(OptimizationRemovedDeadCode, first, "%d unreachable instruction(s) starting with %s", count, o.sourceText(first))
+			changed = true
+		}
+	}
+
+	return changed
+}
+
+// Drops every nop
+func (o *optimizer) removeNops() bool {
+	changed := false
+	for i, instr := range o.obj.instructions {
+		if !o.removed[i] && instr.bytecode() == Nop {
+			o.record(OptimizationRemovedNop, i, "%s", o.sourceText(i))
+			o.removed[i] = true
+			changed = true
+		}
+	}
+
+	return changed
+}
+
+// Drops the removed instructions and moves every label, relocation and debug symbol to match. Returns
+// the sources of the instructions that are left.
+func (o *optimizer) compact() []sourceLine {
+	obj := o.obj
+	n := len(obj.instructions)
+
+	// Maps from old instruction index -> new index. Removed instructions map to the instruction after
+	// them so that anything pointing at them ends up pointing at what comes next.
+	newIndex := make([]int, n+1)
+	kept := 0
+	for i := range newIndex {
+		newIndex[i] = kept
+		if i < n && !o.removed[i] {
+			kept++
+		}
+	}
+
+	remap := func(offset int) int {
+		i := min(max(offset/int(instructionBytes), 0), n)
+		return offset - (i-newIndex[i])*int(instructionBytes)
+	}
+
+	instructions := make([]Instruction, 0, kept)
+	sources := make([]sourceLine, 0, kept)
+	for i, instr := range obj.instructions {
+		if !o.removed[i] {
+			instructions = append(instructions, instr)
+			sources = append(sources, o.sources[i])
+		}
+	}
+	obj.instructions = instructions
+
+	relocations := obj.relocations[:0]
+	for _, reloc := range obj.relocations {
+		if reloc.kind == relocInstructionArg {
+			if o.removed[reloc.offset] {
+				continue
+			}
+			reloc.offset = newIndex[reloc.offset]
+		}
+
+		if reloc.base == relocBaseText {
+			reloc.addend = int64(remap(int(reloc.addend)))
+		}
+		relocations = append(relocations, reloc)
+	}
+	obj.relocations = slices.Clip(relocations)
+
+	for name, sym := range obj.symbols {
+		if sym.section == sectionText {
+			sym.offset = remap(sym.offset)
+			obj.symbols[name] = sym
+		}
+	}
+
+	if obj.debugSymMap != nil {
+		debugSymMap := make(map[int]string, len(obj.debugSymMap))
+		for offset, source := range obj.debugSymMap {
+			if i := offset / int(instructionBytes); i >= n || !o.removed[i] {
+				debugSymMap[remap(offset)] = source
+			}
+		}
+		obj.debugSymMap = debugSymMap
+	}
+
+	return sources
+}
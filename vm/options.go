@@ -0,0 +1,141 @@
+package gvm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Configures a VM when passed to NewVirtualMachine
+type VMOption func(*vmConfig) error
+
+// Collects everything that can be configured about a VM before it's created
+type vmConfig struct {
+	// Size of physical memory (shared with the interrupt vector table, program and stack)
+	memorySizeBytes uint64
+
+	// Where the console IO device writes output and reads input. When stdout isn't set, output goes to
+	// os.Stdout, or is only kept for the debugger when the program has debug symbols.
+	stdout io.Writer
+	stdin  io.Reader
+
+	// Maps from port -> device constructor for devices that should be attached
+	// at startup (nil constructor means leave the port empty)
+	devices map[uint32]DeviceConstructor
+
+	// If false, debug symbols included with the program are ignored
+	useDebugSymbols bool
+
+	// CPU mode the VM starts (and restarts) in
+	privilegeMode uint32
+
+	// If false, every instruction is decoded from memory each time it runs
+	instructionCache bool
+}
+
+func newDefaultVMConfig() *vmConfig {
+	return &vmConfig{
+		memorySizeBytes:  heapSizeBytes,
+		stdin:            os.Stdin,
+		devices:          make(map[uint32]DeviceConstructor),
+		useDebugSymbols:  true,
+		privilegeMode:    0,
+		instructionCache: true,
+	}
+}
+
+// Applies the options on top of the default config
+func newVMConfig(options []VMOption) (*vmConfig, error) {
+	cfg := newDefaultVMConfig()
+	for _, option := range options {
+		if err := option(cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	return cfg, nil
+}
+
+// Sets the size of physical memory in bytes (up to the full 32-bit address space)
+func WithMemorySize(numBytes uint64) VMOption {
+	return func(cfg *vmConfig) error {
+		if numBytes < minHeapSizeBytes || numBytes > maxHeapSizeBytes {
+			return fmt.Errorf("invalid memory size %d (must be between %d and %d bytes)", numBytes, minHeapSizeBytes, maxHeapSizeBytes)
+		}
+
+		cfg.memorySizeBytes = numBytes
+		return nil
+	}
+}
+
+// Sets where the console IO device writes its output. Programs with debug symbols write to it as well as
+// to the output the debugger shows.
+func WithStdout(w io.Writer) VMOption {
+	return func(cfg *vmConfig) error {
+		if w == nil {
+			return errors.New("stdout writer cannot be nil")
+		}
+
+		cfg.stdout = w
+		return nil
+	}
+}
+
+// Sets where the console IO device reads its input from
+func WithStdin(r io.Reader) VMOption {
+	return func(cfg *vmConfig) error {
+		if r == nil {
+			return errors.New("stdin reader cannot be nil")
+		}
+
+		cfg.stdin = r
+		return nil
+	}
+}
+
+// Attaches a device to the given port at startup, replacing the default device for that port
+// if there is one. Passing a nil constructor leaves the port empty.
+//
+// The power controller (port 1) and memory management unit (port 2) are required by the CPU
+// and can't be replaced.
+func WithDevice(port uint32, newDevice DeviceConstructor) VMOption {
+	return func(cfg *vmConfig) error {
+		if port >= maxHWDevices {
+			return fmt.Errorf("invalid device port %d (must be less than %d)", port, maxHWDevices)
+		}
+
+		if port == 1 || port == 2 {
+			return fmt.Errorf("device port %d is reserved and can't be replaced", port)
+		}
+
+		cfg.devices[port] = newDevice
+		return nil
+	}
+}
+
+// Controls whether debug symbols included with the program are used. When disabled the program
+// runs as if it had been compiled without debug symbols.
+func WithDebugSymbols(enabled bool) VMOption {
+	return func(cfg *vmConfig) error {
+		cfg.useDebugSymbols = enabled
+		return nil
+	}
+}
+
+// Sets the CPU mode the VM starts in, where 0 = max privilege and anything else is unprivileged
+func WithPrivilegeMode(mode uint32) VMOption {
+	return func(cfg *vmConfig) error {
+		cfg.privilegeMode = mode
+		return nil
+	}
+}
+
+// Controls whether the loaded program's instructions are decoded once up front and cached (the default)
+// instead of being decoded from memory every time they run. Programs behave the same either way.
+func WithInstructionCache(enabled bool) VMOption {
+	return func(cfg *vmConfig) error {
+		cfg.instructionCache = enabled
+		return nil
+	}
+}
@@ -2,13 +2,20 @@ package gvm
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"fmt"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
-func (vm *VM) RunProgramDebugMode() {
+// Runs the program one instruction at a time, taking commands from stdin. Returns the same errors as
+// RunProgram.
+func (vm *VM) RunProgramDebugMode() error {
+	vm.started = true
+
 	fmt.Printf("Commands:\n\tn or next: execute next instruction\n\tr or run: run program\n\tb or break <line>: break on line (or remove break on line)\n\n")
 
 	vm.printCurrentState()
@@ -40,7 +47,8 @@ func (vm *VM) RunProgramDebugMode() {
 			// Reset break flag
 			lastBreakLine = -1
 
-			result := vm.execInstructions(true)
+			vm.instructionBudget = 1
+			result := vm.execInstructions()
 			if waitForInput {
 				// Only print state after each instruction if we're also waiting for input
 				// after each instruction
@@ -51,12 +59,11 @@ func (vm *VM) RunProgramDebugMode() {
 				continue
 			} else if vm.errcode != nil {
 				vm.printDebugOutput()
-				if vm.errcode != errSystemShutdown {
-					// pc-instructionBytes should be the instruction that failed
-					fmt.Println(formatInstructionStr(vm, *vm.pc-instructionBytes, vm.errcode.Error()))
+				if vm.errcode == ErrSystemShutdown {
+					return nil
 				}
 
-				return
+				return vm.newRunError()
 			}
 		} else if line == "p" || line == "program" {
 			vm.printProgram()
@@ -81,16 +88,195 @@ func (vm *VM) RunProgramDebugMode() {
 	}
 }
 
-func (vm *VM) RunProgram() {
-	// While execInstructions returns true, keep allowing it to execute
-	// (sometimes it temporarily returns when it is trying to recover from an error)
-	for vm.execInstructions(false) {
+// Runs the program until it powers off or stops because of an error that it doesn't handle. Returns nil
+// if it powered off, otherwise a *RunError.
+func (vm *VM) RunProgram() error {
+	return vm.Run(context.Background(), RunLimits{}).Err
+}
+
+// Describes why a program stopped and what the VM looked like when it did. Unwraps to one of the
+// exported errors (such as ErrSegmentationFault) so that errors.Is can be used.
+type RunError struct {
+	// Address of the instruction that caused the error
+	PC uint32
+	// The instruction at PC (zero if PC is outside of memory)
+	Instruction Instruction
+	// Source the instruction was assembled from when the program has debug symbols
+	Source string
+	// CPU mode when the error happened (0 is privileged)
+	Mode uint32
+	// Copy of the bytes on the stack, starting at the top (empty if the stack pointer was invalid)
+	Stack []byte
+
+	Err error
+}
+
+func (e *RunError) Error() string {
+	if e.Source != "" {
+		return fmt.Sprintf("%s %d: %s", e.Err, e.PC, e.Source)
 	}
 
-	if err := vm.errcode; err != nil {
-		if err != errSystemShutdown {
-			// pc-instructionBytes should be the instruction that failed
-			fmt.Println(formatInstructionStr(vm, *vm.pc-instructionBytes, vm.errcode.Error()))
+	return fmt.Sprintf("%s %d: %s", e.Err, e.PC, e.Instruction)
+}
+
+func (e *RunError) Unwrap() error {
+	return e.Err
+}
+
+// Captures the state of the VM after an error stopped it. pc has already moved past the instruction that
+// failed.
+func (vm *VM) newRunError() *RunError {
+	err := &RunError{PC: *vm.pc - instructionBytes, Mode: *vm.mode, Err: vm.errcode}
+	if uint64(err.PC)+uint64(instructionBytes) <= uint64(len(vm.memory)) {
+		err.Instruction = decodeInstructionTyped(vm.memory[err.PC:])
+		if vm.debugSym != nil {
+			err.Source = vm.debugSym.source[int(err.PC)]
 		}
 	}
+
+	if relsp := vm.computeRelativeStackPointer(*vm.sp); uint64(relsp) <= uint64(len(vm.activeSegment)) {
+		err.Stack = bytes.Clone(vm.stackBytes())
+	}
+
+	return err
+}
+
+// Number of instructions run between checks of the deadline and context
+const runCheckInterval = 1 << 16
+
+// Bounds how long Run can execute a program for. The zero value means no limits.
+type RunLimits struct {
+	// Maximum number of instructions to execute (0 means no limit). The count is exact, so a program
+	// always stops at the same place for the same budget.
+	MaxInstructions uint64
+
+	// Time to stop at (zero means no deadline). It's checked every few thousand instructions, so the
+	// program can run slightly past it.
+	Deadline time.Time
+
+	// If set, Run returns as soon as the program executes a halt instruction
+	StopOnHalt bool
+}
+
+// Why Run returned
+type StopReason int
+
+const (
+	// The program powered off
+	StopShutdown StopReason = iota
+	// The program stopped because of an error it didn't handle (see RunResult.Err)
+	StopFault
+	// The program executed halt and RunLimits.StopOnHalt was set
+	StopHalted
+	// RunLimits.MaxInstructions instructions were executed
+	StopBudget
+	// RunLimits.Deadline passed
+	StopDeadline
+	// The context was canceled or its deadline passed (see RunResult.Err)
+	StopCanceled
+)
+
+func (r StopReason) String() string {
+	switch r {
+	case StopShutdown:
+		return "shutdown"
+	case StopFault:
+		return "fault"
+	case StopHalted:
+		return "halted"
+	case StopBudget:
+		return "instruction budget exhausted"
+	case StopDeadline:
+		return "deadline exceeded"
+	case StopCanceled:
+		return "canceled"
+	default:
+		return fmt.Sprintf("StopReason(%d)", int(r))
+	}
+}
+
+// What happened during a call to Run
+type RunResult struct {
+	Reason StopReason
+
+	// Number of instructions executed by this call to Run
+	Instructions uint64
+
+	// For StopFault, the *RunError that stopped the program. For StopCanceled, the context's error.
+	Err error
+
+	// Address of the instruction that caused the fault for StopFault, otherwise the address of the next
+	// instruction to execute
+	PC uint32
+}
+
+func (r RunResult) String() string {
+	switch r.Reason {
+	case StopFault:
+		return fmt.Sprintf("%s after %d instructions: %s", r.Reason, r.Instructions, r.Err)
+	case StopCanceled:
+		return fmt.Sprintf("%s at pc %d after %d instructions: %s", r.Reason, r.PC, r.Instructions, r.Err)
+	default:
+		return fmt.Sprintf("%s at pc %d after %d instructions", r.Reason, r.PC, r.Instructions)
+	}
+}
+
+// Runs the program until it powers off, faults or reaches one of the limits. Nothing is printed, so
+// the result is the only way to find out why it stopped.
+//
+// When the program stops because of a limit, halt or the context, the VM is left in a state where
+// calling Run again continues from where it stopped.
+func (vm *VM) Run(ctx context.Context, limits RunLimits) RunResult {
+	vm.started = true
+	vm.stopOnHalt = limits.StopOnHalt
+	defer func() { vm.stopOnHalt = false }()
+
+	result := RunResult{}
+	for {
+		if err := ctx.Err(); err != nil {
+			result.Reason, result.Err = StopCanceled, err
+			break
+		}
+
+		if !limits.Deadline.IsZero() && !time.Now().Before(limits.Deadline) {
+			result.Reason = StopDeadline
+			break
+		}
+
+		budget := uint64(runCheckInterval)
+		if limits.MaxInstructions != 0 {
+			if result.Instructions == limits.MaxInstructions {
+				result.Reason = StopBudget
+				break
+			}
+			budget = min(budget, limits.MaxInstructions-result.Instructions)
+		}
+
+		vm.instructionBudget = budget
+		// execInstructions also returns true (with the error code set) when it needs to be called again
+		// to recover from an error
+		running := vm.execInstructions()
+		result.Instructions += budget - vm.instructionBudget
+		vm.instructionBudget = 0
+
+		if !running {
+			if vm.errcode == ErrSystemShutdown {
+				result.Reason = StopShutdown
+				break
+			}
+
+			err := vm.newRunError()
+			result.Reason, result.Err, result.PC = StopFault, err, err.PC
+			return result
+		}
+
+		if vm.halted {
+			vm.halted = false
+			result.Reason = StopHalted
+			break
+		}
+	}
+
+	result.PC = *vm.pc
+	return result
 }
@@ -0,0 +1,545 @@
+package gvm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+)
+
+/*
+	Snapshot format for a paused VM (all values little endian)
+
+	Header
+		- 4 bytes: magic number "GVMS"
+		- 2 bytes: format version
+		- 2 bytes: flags (currently unused, must be 0)
+		- 4 bytes: number of sections
+
+	Sections are written the same way as in program images (see image.go).
+
+	Section kinds
+		- 0x20 machine state
+			- 8 bytes: physical memory size
+			- 4 bytes each: load address, program instruction bytes, program data bytes, entry point,
+			  starting CPU mode, stack offset, active segment start
+			- 8 bytes: active segment end
+			- 4 bytes each: instruction cache start and size (size is 0 when the cache is off)
+			- 1 byte: flags (bit 0 set if the VM has started running, bit 1 set if interrupts are disabled by cli)
+			- <string> pending error ("" if there isn't one)
+		- 0x21 registers: 4 byte count followed by each register (including the special registers)
+		- 0x22 memory: every 4096 byte page of memory that isn't all zeros as
+			- 4 bytes: address
+			- 4 bytes: length (only shorter than a page at the end of memory)
+			- <length> bytes: contents
+		- 0x23 devices: 4 byte count followed by each port that has a device as
+			- 4 bytes: port
+			- 4 bytes: HWID
+			- 1 byte: 1 if the device saved its state (see StatefulDevice)
+			- <string> state
+		- 0x24 pending responses: 4 byte count followed by each response that was sent by a device but
+		  not received by the CPU yet, in order, as
+			- 4 bytes: interrupt address
+			- 4 bytes: interaction ID
+			- <string> data
+			- <string> device error ("" if there isn't one)
+		- 0x25 debug symbols (optional): same as in program images
+		- 0x26 interrupt frames (optional, all 0 if missing): 4 bytes each for the frame pointer of the handler
+		  of every interrupt line (see interrupts.go)
+
+	Devices keep running while a snapshot is written, so it should be taken while the VM is stopped (such
+	as after Run returns). A response a device sends while the snapshot is being written might be missing
+	from it. Timers are saved with the time they had left, and keep counting from there once the snapshot
+	is read.
+*/
+
+const (
+	snapshotVersion uint16 = 1
+
+	snapshotSectionState        imageSectionKind = 0x20
+	snapshotSectionRegisters    imageSectionKind = 0x21
+	snapshotSectionMemory       imageSectionKind = 0x22
+	snapshotSectionDevices      imageSectionKind = 0x23
+	snapshotSectionResponses    imageSectionKind = 0x24
+	snapshotSectionDebugSymbols imageSectionKind = 0x25
+	snapshotSectionInterrupts   imageSectionKind = 0x26
+
+	// magic (4) + version (2) + flags (2) + section count (4)
+	snapshotHeaderBytes uint32 = 12
+
+	snapshotPageBytes uint32 = 4096
+
+	// Machine state flags
+	snapshotStarted            uint8 = 1 << 0
+	snapshotInterruptsDisabled uint8 = 1 << 1
+)
+
+var (
+	snapshotMagic = [4]byte{'G', 'V', 'M', 'S'}
+
+	errInvalidSnapshot = errors.New("invalid snapshot")
+
+	// Errors that are restored as themselves (instead of a new error with the same message) so that
+	// they're still recognized as hardware exceptions
+	snapshotErrors = []error{
+		ErrSystemShutdown,
+		ErrSegmentationFault,
+		ErrDivisionByZero,
+		ErrUnknownInstruction,
+		ErrIllegalInstruction,
+		ErrIO,
+	}
+)
+
+// Saves the complete state of the VM (registers, memory, devices and pending device responses) so that
+// ReadSnapshot can resume it later from exactly where it is now. The VM shouldn't be running.
+func (vm *VM) WriteSnapshot(w io.Writer) error {
+	memory, err := vm.encodeSnapshotMemory()
+	if err != nil {
+		return err
+	}
+
+	devices, responses, err := vm.encodeSnapshotDevicesAndResponses()
+	if err != nil {
+		return err
+	}
+
+	sections := []fileSection{
+		{snapshotSectionState, vm.encodeSnapshotState()},
+		{snapshotSectionRegisters, vm.encodeSnapshotRegisters()},
+		{snapshotSectionMemory, memory},
+		{snapshotSectionDevices, devices},
+		{snapshotSectionResponses, responses},
+		{snapshotSectionInterrupts, vm.encodeSnapshotInterrupts()},
+	}
+
+	if vm.debugSym != nil {
+		sections = append(sections, fileSection{snapshotSectionDebugSymbols, encodeDebugSymbols(vm.debugSym.source)})
+	}
+
+	header := make([]byte, snapshotHeaderBytes)
+	copy(header, snapshotMagic[:])
+	uint16ToBytes(snapshotVersion, header[4:])
+	uint16ToBytes(0, header[6:])
+	uint32ToBytes(uint32(len(sections)), header[8:])
+
+	bw := bufio.NewWriter(w)
+	bw.Write(header)
+	writeSections(bw, sections)
+
+	return bw.Flush()
+}
+
+// Creates a VM from a snapshot written by WriteSnapshot. The VM continues from where the snapshot was
+// taken when it's run.
+//
+// Options work the same as for NewVirtualMachine, except that the memory size and privilege mode come from
+// the snapshot. Devices have to be attached to the same ports as when the snapshot was taken (using
+// WithDevice), and any that implement StatefulDevice get their saved state back.
+func ReadSnapshot(r io.Reader, options ...VMOption) (*VM, error) {
+	cfg, err := newVMConfig(options)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, snapshotHeaderBytes)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("%w: could not read header: %w", errInvalidSnapshot, err)
+	}
+
+	if !bytes.Equal(header[:4], snapshotMagic[:]) {
+		return nil, fmt.Errorf("%w: bad magic number", errInvalidSnapshot)
+	}
+
+	if version := uint16FromBytes(header[4:]); version != snapshotVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", errInvalidSnapshot, version)
+	}
+
+	sections, err := readSections(r, uint32FromBytes(header[8:]), errInvalidSnapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, kind := range []imageSectionKind{snapshotSectionState, snapshotSectionRegisters, snapshotSectionMemory,
+		snapshotSectionDevices, snapshotSectionResponses} {
+		if _, ok := sections[kind]; !ok {
+			return nil, fmt.Errorf("%w: missing section 0x%02X", errInvalidSnapshot, kind)
+		}
+	}
+
+	state := &sectionReader{contents: sections[snapshotSectionState]}
+	cfg.memorySizeBytes = binary.LittleEndian.Uint64(state.next(8))
+	if cfg.memorySizeBytes < minHeapSizeBytes || cfg.memorySizeBytes > maxHeapSizeBytes {
+		return nil, fmt.Errorf("%w: invalid memory size %d", errInvalidSnapshot, cfg.memorySizeBytes)
+	}
+
+	var debugSymMap map[int]string
+	if contents, ok := sections[snapshotSectionDebugSymbols]; ok {
+		if debugSymMap, err = decodeDebugSymbols(contents, errInvalidSnapshot); err != nil {
+			return nil, err
+		}
+	}
+
+	vm, err := newVM(cfg, debugSymMap)
+	if err != nil {
+		return nil, err
+	}
+
+	err = vm.decodeSnapshotState(state)
+	if err == nil {
+		err = vm.decodeSnapshotRegisters(sections[snapshotSectionRegisters])
+	}
+	if err == nil {
+		err = vm.decodeSnapshotMemory(sections[snapshotSectionMemory])
+	}
+	if err == nil {
+		err = vm.decodeSnapshotDevices(sections[snapshotSectionDevices])
+	}
+	if err == nil {
+		err = vm.decodeSnapshotResponses(sections[snapshotSectionResponses])
+	}
+	if contents, ok := sections[snapshotSectionInterrupts]; ok && err == nil {
+		err = vm.decodeSnapshotInterrupts(contents)
+	}
+
+	if err != nil {
+		// Stop the goroutines of the devices that were created
+		for _, device := range vm.devices {
+			device.Close()
+		}
+		return nil, err
+	}
+
+	if vm.icache.size > 0 && cfg.instructionCache {
+		vm.icache = newInstructionCache(vm.memory, vm.icache.start, vm.icache.size)
+		vm.stackMoved()
+	} else {
+		vm.icache = instructionCache{}
+	}
+
+	return vm, nil
+}
+
+// Writes a snapshot of the VM to a file
+func (vm *VM) WriteSnapshotFile(filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+
+	if err := vm.WriteSnapshot(file); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// Creates a VM from a snapshot file
+func ReadSnapshotFile(filename string, options ...VMOption) (*VM, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ReadSnapshot(bufio.NewReader(file), options...)
+}
+
+// Returns true if the file starts with the snapshot magic number
+func IsSnapshotFile(filename string) bool {
+	return fileHasMagic(filename, snapshotMagic)
+}
+
+func (vm *VM) encodeSnapshotState() []byte {
+	// The active segment is always sliced from memory without limiting its capacity, so its start can be
+	// found from how much capacity it has left
+	segmentStart := uint32(cap(vm.memory) - cap(vm.activeSegment))
+	segmentEnd := uint64(segmentStart) + uint64(len(vm.activeSegment))
+
+	out := binary.LittleEndian.AppendUint64(nil, uint64(len(vm.memory)))
+	for _, value := range []uint32{vm.loadAddr, vm.processInstructionBytes, vm.processDataBytes, vm.entryPoint,
+		vm.initialMode, vm.stackOffsetBytes, segmentStart} {
+		out = binary.LittleEndian.AppendUint32(out, value)
+	}
+	out = binary.LittleEndian.AppendUint64(out, segmentEnd)
+	out = binary.LittleEndian.AppendUint32(out, vm.icache.start)
+	out = binary.LittleEndian.AppendUint32(out, vm.icache.size)
+
+	flags := uint8(0)
+	if vm.started {
+		flags |= snapshotStarted
+	}
+	if vm.interruptsDisabled {
+		flags |= snapshotInterruptsDisabled
+	}
+	out = append(out, flags)
+
+	return appendString(out, errorMessage(vm.errcode))
+}
+
+// r has already had the memory size read from it
+func (vm *VM) decodeSnapshotState(r *sectionReader) error {
+	vm.loadAddr, vm.processInstructionBytes, vm.processDataBytes = r.uint32(), r.uint32(), r.uint32()
+	vm.entryPoint, vm.initialMode, vm.stackOffsetBytes = r.uint32(), r.uint32(), r.uint32()
+	segmentStart, segmentEnd := r.uint32(), binary.LittleEndian.Uint64(r.next(8))
+	icacheStart, icacheSize := r.uint32(), r.uint32()
+	flags := r.uint8()
+	vm.started = flags&snapshotStarted != 0
+	vm.interruptsDisabled = flags&snapshotInterruptsDisabled != 0
+	vm.errcode = errorFromMessage(r.string())
+
+	if r.truncated {
+		return fmt.Errorf("%w: machine state section is truncated", errInvalidSnapshot)
+	}
+
+	if uint64(segmentStart) > segmentEnd || segmentEnd > uint64(len(vm.memory)) {
+		return fmt.Errorf("%w: active segment [%d, %d) is outside of memory", errInvalidSnapshot, segmentStart, segmentEnd)
+	}
+	vm.activeSegment = vm.memory[segmentStart:segmentEnd]
+
+	if icacheSize%instructionBytes != 0 || uint64(icacheStart)+uint64(icacheSize) > uint64(len(vm.memory)) {
+		return fmt.Errorf("%w: invalid instruction cache range", errInvalidSnapshot)
+	}
+	vm.icache = instructionCache{start: icacheStart, size: icacheSize, end: icacheStart + icacheSize}
+
+	return nil
+}
+
+func (vm *VM) encodeSnapshotRegisters() []byte {
+	out := binary.LittleEndian.AppendUint32(nil, uint32(len(vm.registers)))
+	for _, value := range vm.registers {
+		out = binary.LittleEndian.AppendUint32(out, value)
+	}
+
+	return out
+}
+
+func (vm *VM) decodeSnapshotRegisters(contents []byte) error {
+	r := &sectionReader{contents: contents}
+	if count := r.uint32(); count != uint32(len(vm.registers)) {
+		return fmt.Errorf("%w: expected %d registers but found %d", errInvalidSnapshot, len(vm.registers), count)
+	}
+
+	for i := range vm.registers {
+		vm.registers[i] = r.uint32()
+	}
+
+	if r.truncated {
+		return fmt.Errorf("%w: register section is truncated", errInvalidSnapshot)
+	}
+	return nil
+}
+
+func (vm *VM) encodeSnapshotInterrupts() []byte {
+	var out []byte
+	for _, fp := range vm.interruptFrames {
+		out = binary.LittleEndian.AppendUint32(out, fp)
+	}
+
+	return out
+}
+
+func (vm *VM) decodeSnapshotInterrupts(contents []byte) error {
+	r := &sectionReader{contents: contents}
+	for i := range vm.interruptFrames {
+		vm.interruptFrames[i] = r.uint32()
+	}
+
+	if r.truncated {
+		return fmt.Errorf("%w: interrupt frame section is truncated", errInvalidSnapshot)
+	}
+	return nil
+}
+
+// Pages that are all zeros are left out since memory starts out zeroed
+func (vm *VM) encodeSnapshotMemory() ([]byte, error) {
+	var out []byte
+	for addr := uint64(0); addr < uint64(len(vm.memory)); addr += uint64(snapshotPageBytes) {
+		page := vm.memory[addr:min(addr+uint64(snapshotPageBytes), uint64(len(vm.memory)))]
+		if !slices.ContainsFunc(page, func(b byte) bool { return b != 0 }) {
+			continue
+		}
+
+		if uint64(len(out))+uint64(len(page))+uint64(varchBytesx2) > math.MaxUint32 {
+			return nil, errors.New("memory is too large to fit into a snapshot")
+		}
+
+		out = binary.LittleEndian.AppendUint32(out, uint32(addr))
+		out = binary.LittleEndian.AppendUint32(out, uint32(len(page)))
+		out = append(out, page...)
+	}
+
+	return out, nil
+}
+
+func (vm *VM) decodeSnapshotMemory(contents []byte) error {
+	r := &sectionReader{contents: contents}
+	for len(r.contents) > 0 {
+		addr, length := r.uint32(), r.uint32()
+		if r.truncated || uint64(addr)+uint64(length) > uint64(len(vm.memory)) {
+			return fmt.Errorf("%w: memory page at %d is outside of memory", errInvalidSnapshot, addr)
+		}
+
+		page := r.next(length)
+		if r.truncated {
+			return fmt.Errorf("%w: memory section is truncated", errInvalidSnapshot)
+		}
+		copy(vm.memory[addr:], page)
+	}
+
+	return nil
+}
+
+// Saves the devices along with the responses they've sent but that haven't been received yet. Both are
+// taken under the bus's snapshot lock so that a device can't send a response in between for state that
+// was saved as still pending (see systemTimer.fire).
+func (vm *VM) encodeSnapshotDevicesAndResponses() ([]byte, []byte, error) {
+	vm.responseBus.snapshotLock.Lock()
+	defer vm.responseBus.snapshotLock.Unlock()
+
+	devices, err := vm.encodeSnapshotDevices()
+	if err != nil {
+		return nil, nil, err
+	}
+	return devices, encodeSnapshotResponses(vm.responseBus.pending()), nil
+}
+
+func (vm *VM) encodeSnapshotDevices() ([]byte, error) {
+	var out []byte
+	count := uint32(0)
+	for port, device := range vm.devices {
+		if _, ok := device.(*nodevice); ok {
+			continue
+		}
+
+		out = binary.LittleEndian.AppendUint32(out, uint32(port))
+		out = binary.LittleEndian.AppendUint32(out, device.GetInfo().HWID)
+
+		if stateful, ok := device.(StatefulDevice); ok {
+			state, err := stateful.SaveState()
+			if err != nil {
+				return nil, fmt.Errorf("could not save state of device on port %d: %w", port, err)
+			}
+			out = append(out, 1)
+			out = appendString(out, string(state))
+		} else {
+			out = append(out, 0)
+			out = appendString(out, "")
+		}
+		count++
+	}
+
+	return append(binary.LittleEndian.AppendUint32(nil, count), out...), nil
+}
+
+func (vm *VM) decodeSnapshotDevices(contents []byte) error {
+	r := &sectionReader{contents: contents}
+	count := r.uint32()
+	saved := make(map[uint32]bool)
+	for i := uint32(0); i < count && !r.truncated; i++ {
+		port, hwid := r.uint32(), r.uint32()
+		hasState, state := r.uint8() != 0, r.string()
+		if r.truncated {
+			break
+		}
+
+		if port >= maxHWDevices || saved[port] {
+			return fmt.Errorf("%w: invalid device port %d", errInvalidSnapshot, port)
+		}
+		saved[port] = true
+
+		device := vm.devices[port]
+		if _, ok := device.(*nodevice); ok {
+			return fmt.Errorf("snapshot has a device on port %d but none is attached", port)
+		}
+		if device.GetInfo().HWID != hwid {
+			return fmt.Errorf("snapshot has device 0x%02X on port %d but 0x%02X is attached", hwid, port, device.GetInfo().HWID)
+		}
+
+		if !hasState {
+			continue
+		}
+
+		stateful, ok := device.(StatefulDevice)
+		if !ok {
+			return fmt.Errorf("device on port %d can't restore its saved state", port)
+		}
+		if err := stateful.RestoreState([]byte(state)); err != nil {
+			return fmt.Errorf("could not restore state of device on port %d: %w", port, err)
+		}
+	}
+
+	if r.truncated {
+		return fmt.Errorf("%w: device section is truncated", errInvalidSnapshot)
+	}
+
+	for port, device := range vm.devices {
+		if _, ok := device.(*nodevice); !ok && !saved[uint32(port)] {
+			return fmt.Errorf("device is attached to port %d but the snapshot has none there", port)
+		}
+	}
+
+	return nil
+}
+
+func encodeSnapshotResponses(responses []*Response) []byte {
+	out := binary.LittleEndian.AppendUint32(nil, uint32(len(responses)))
+	for _, resp := range responses {
+		out = binary.LittleEndian.AppendUint32(out, resp.interruptAddr)
+		out = binary.LittleEndian.AppendUint32(out, resp.id)
+		out = appendString(out, string(resp.data))
+		out = appendString(out, errorMessage(resp.deviceErr))
+	}
+
+	return out
+}
+
+func (vm *VM) decodeSnapshotResponses(contents []byte) error {
+	r := &sectionReader{contents: contents}
+	count := r.uint32()
+	var responses []*Response
+	for i := uint32(0); i < count && !r.truncated; i++ {
+		interruptAddr, id := r.uint32(), r.uint32()
+		data, deviceErr := r.string(), errorFromMessage(r.string())
+
+		// Keep nil data as nil since devices such as the timer send responses without any
+		var respData []byte
+		if data != "" {
+			respData = []byte(data)
+		}
+		responses = append(responses, NewResponse(interruptAddr, id, respData, deviceErr))
+	}
+
+	if r.truncated {
+		return fmt.Errorf("%w: pending response section is truncated", errInvalidSnapshot)
+	}
+
+	vm.responseBus.restore(responses)
+	return nil
+}
+
+func errorMessage(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func errorFromMessage(message string) error {
+	if message == "" {
+		return nil
+	}
+
+	for _, err := range snapshotErrors {
+		if err.Error() == message {
+			return err
+		}
+	}
+	return errors.New(message)
+}
@@ -2,12 +2,16 @@ package gvm
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"math"
 	"os"
+	"slices"
 	"strings"
+	"sync"
 	"sync/atomic"
 )
 
@@ -23,10 +27,20 @@ type debugSymbols struct {
 	source map[int]string
 }
 
-// Allows devices to communicate information back to the CPU
-type deviceResponseBus struct {
+// Allows devices to communicate information back to the CPU. Devices should call Send
+// with a response created by NewResponse to raise an interrupt.
+type DeviceResponseBus struct {
 	responses     chan *Response
 	responseCount atomic.Int32
+
+	// Responses taken off of the channel when a snapshot is written, or put back when one is read.
+	// They're received before anything still in the channel.
+	backlogLock sync.Mutex
+	backlog     []*Response
+
+	// Held while a snapshot saves the devices and the pending responses. Devices that change their
+	// state when they send a response hold it too, and use trySend so that they never block with it.
+	snapshotLock sync.Mutex
 }
 
 type VM struct {
@@ -39,20 +53,51 @@ type VM struct {
 	fp           *register // frame pointer
 	mode         *register // CPU mode where 0x00 = max privilege, 0x01 = min privilege
 
-	memory [heapSizeBytes]byte
+	// CPU mode to use when starting or restarting
+	initialMode register
+
+	memory []byte
 	// activeSegment is a byte slice into the VM's memory
 	// At the beginning it points to the entire available memory range, but can be restricted at
 	// runtime
 	activeSegment []byte
 
 	devices     [maxHWDevices]HardwareDevice
-	responseBus *deviceResponseBus
+	responseBus *DeviceResponseBus
+
+	// Set once the VM has started executing (devices can no longer be attached)
+	started bool
+
+	// Set by cli and cleared by sti. While set, device responses stay on the response bus
+	// instead of interrupting the program (exceptions are still raised)
+	interruptsDisabled bool
+
+	// Frame pointer of the handler for each interrupt line that's in service, and the number of responses
+	// on the bus that the interrupt controller is holding back (see interrupts.go). The bus is only looked
+	// at again once it has more responses than that or the controller's state changes.
+	interruptFrames [maxHWDevices]uint32
+	heldResponses   int32
 
 	// For when the stack size has been restricted to a certain region of memory
 	stackOffsetBytes uint32
 
-	// Tells us how many bytes the initial loaded program was
+	// Tells us where the initial loaded program was placed and how many bytes it was (instructions
+	// followed by static data)
+	loadAddr                uint32
 	processInstructionBytes uint32
+	processDataBytes        uint32
+
+	// Address of the first instruction to execute when starting or restarting
+	entryPoint uint32
+
+	// Decoded copy of the loaded program's instructions (see icache.go)
+	icache instructionCache
+
+	// Number of instructions execInstructions can run before returning
+	instructionBudget uint64
+	// If set, execInstructions returns after running a halt instruction and sets halted
+	stopOnHalt bool
+	halted     bool
 
 	// Allows vm to read/write to some type of output
 	stdout *bufio.Writer
@@ -91,7 +136,10 @@ const (
 	reservedBytes        uint32 = maxInterrupts * varchBytes
 	numRegisters         uint32 = 32
 	numReservedRegisters uint32 = 8
-	heapSizeBytes        uint32 = 65536
+	// Default, minimum and maximum physical memory sizes (max is the full 32-bit address space)
+	heapSizeBytes    uint64 = 65536
+	minHeapSizeBytes uint64 = 4096
+	maxHeapSizeBytes uint64 = 1 << 32
 
 	// These are the memory address ranges that the interrupts occupy
 	// [0, interruptsAddrRange) -> includes privileged and unprivileged
@@ -105,37 +153,52 @@ const (
 	publicInterruptsAddrRange uint32 = restrictedInterruptsAddrRange + maxPublicInterrupts*varchBytes
 )
 
+// Errors that stop a program. Apart from ErrSystemShutdown they're raised as hardware exceptions first,
+// and only stop the program if it hasn't set up a handler for them. Use errors.Is to check for them in the
+// error returned by RunProgram (which is a *RunError).
 var (
-	errSystemShutdown     = errors.New("system poweroff requested")
-	errSegmentationFault  = errors.New("segmentation fault")
-	errDivisionByZero     = errors.New("division by zero")
-	errUnknownInstruction = errors.New("instruction not recognized")
-	errIllegalInstruction = errors.New("illegal instruction (privilege too low)")
-	errIO                 = errors.New("input-output error")
+	// The program asked the power controller to power off (not returned as an error by RunProgram)
+	ErrSystemShutdown = errors.New("system poweroff requested")
+	// Memory outside of physical memory (or outside of the heap bounds in unprivileged mode) was accessed
+	ErrSegmentationFault = errors.New("segmentation fault")
+	ErrDivisionByZero    = errors.New("division by zero")
+	// The instruction's code doesn't exist, or a system interrupt without a handler was called
+	ErrUnknownInstruction = errors.New("instruction not recognized")
+	// A privileged instruction was run in unprivileged mode
+	ErrIllegalInstruction = errors.New("illegal instruction (privilege too low)")
+	// A device failed to carry out a request
+	ErrIO = errors.New("input-output error")
 
 	// Maps from error code -> exception (interrupt) handler address
 	hardwareExceptionMap = map[error]uint32{
-		errSegmentationFault:  hwInterruptAddrRange + 0*varchBytes,
-		errDivisionByZero:     hwInterruptAddrRange + 1*varchBytes,
-		errUnknownInstruction: hwInterruptAddrRange + 2*varchBytes,
-		errIllegalInstruction: hwInterruptAddrRange + 3*varchBytes,
-		errIO:                 hwInterruptAddrRange + 4*varchBytes,
+		ErrSegmentationFault:  hwInterruptAddrRange + 0*varchBytes,
+		ErrDivisionByZero:     hwInterruptAddrRange + 1*varchBytes,
+		ErrUnknownInstruction: hwInterruptAddrRange + 2*varchBytes,
+		ErrIllegalInstruction: hwInterruptAddrRange + 3*varchBytes,
+		ErrIO:                 hwInterruptAddrRange + 4*varchBytes,
 	}
 )
 
 func (vm *VM) setInitialVMState() {
 	// Set process start address
-	*vm.pc = reservedBytes
+	*vm.pc = vm.entryPoint
 
 	// Set stack pointer to be 1 after the last valid stack address
 	// (indexing this will trigger a seg fault)
-	*vm.sp = heapSizeBytes
+	//
+	// When memory spans the full 32-bit address space this wraps around to 0, which still
+	// works since the first push moves it back to the last valid address
+	*vm.sp = uint32(len(vm.memory))
 
 	// Clear the frame pointer
 	*vm.fp = *vm.sp
 
-	// Clear CPU mode (sets to max privilege)
-	*vm.mode = 0
+	// Reset CPU mode to the configured starting mode
+	*vm.mode = vm.initialMode
+
+	// Re-enable interrupts in case they were disabled by cli
+	vm.interruptsDisabled = false
+	vm.resetInterruptController()
 
 	// Clear error code
 	vm.errcode = nil
@@ -143,38 +206,168 @@ func (vm *VM) setInitialVMState() {
 	// Allow memory management device to potentially update memory bounds
 	vm.devices[2].TrySend(0, 3, nil)
 
-	// Push the number of reserved bytes and the length of the process instruction bytes
+	// Push the address the program was loaded at and the length of the process bytes (instructions + data)
 	// as the initial arguments
-	vm.pushStack(reservedBytes)
-	vm.pushStack(vm.processInstructionBytes)
+	vm.pushStack(vm.loadAddr)
+	vm.pushStack(vm.processInstructionBytes + vm.processDataBytes)
+
+	// The cache can cover the whole program again after a restart
+	vm.stackMoved()
 }
 
-func newDeviceResponseBus() *deviceResponseBus {
-	return &deviceResponseBus{
+func newDeviceResponseBus() *DeviceResponseBus {
+	return &DeviceResponseBus{
 		responses: make(chan *Response, 1),
 	}
 }
 
-func (bus *deviceResponseBus) Send(resp *Response) {
+// The count goes up first so that a response can't be received (or seen by pending) before it's counted
+func (bus *DeviceResponseBus) Send(resp *Response) {
+	bus.responseCount.Add(1)
 	bus.responses <- resp
+}
+
+// Like Send but returns false instead of blocking when the bus is full
+func (bus *DeviceResponseBus) trySend(resp *Response) bool {
 	bus.responseCount.Add(1)
+	select {
+	case bus.responses <- resp:
+		return true
+	default:
+		bus.responseCount.Add(-1)
+		return false
+	}
 }
 
-func (bus *deviceResponseBus) Ready() bool {
+func (bus *DeviceResponseBus) Ready() bool {
 	return bus.responseCount.Load() > 0
 }
 
-func (bus *deviceResponseBus) Receive() *Response {
+func (bus *DeviceResponseBus) Receive() *Response {
+	bus.backlogLock.Lock()
+	if len(bus.backlog) > 0 {
+		resp := bus.backlog[0]
+		bus.backlog = bus.backlog[1:]
+		bus.backlogLock.Unlock()
+		bus.responseCount.Add(-1)
+		return resp
+	}
+	bus.backlogLock.Unlock()
+
 	resp := <-bus.responses
 	bus.responseCount.Add(-1)
 	return resp
 }
 
+// Moves everything in the channel to the backlog (backlogLock must be held)
+func (bus *DeviceResponseBus) drain() {
+	for {
+		select {
+		case resp := <-bus.responses:
+			bus.backlog = append(bus.backlog, resp)
+		default:
+			return
+		}
+	}
+}
+
+// Returns every response that has been sent but not received yet, in the order they were sent,
+// without removing them from the bus
+func (bus *DeviceResponseBus) pending() []*Response {
+	bus.backlogLock.Lock()
+	defer bus.backlogLock.Unlock()
+
+	bus.drain()
+	return slices.Clone(bus.backlog)
+}
+
+// Receives the response at the index returned by choose, which is given every response that hasn't been
+// received yet in the order they were sent. If choose returns -1 nothing is received, and the number of
+// responses still on the bus is returned instead.
+func (bus *DeviceResponseBus) receiveChosen(choose func([]*Response) int) (*Response, int32) {
+	bus.backlogLock.Lock()
+	defer bus.backlogLock.Unlock()
+
+	bus.drain()
+	index := choose(bus.backlog)
+	if index < 0 {
+		return nil, int32(len(bus.backlog))
+	}
+
+	resp := bus.backlog[index]
+	bus.backlog = slices.Delete(bus.backlog, index, index+1)
+	bus.responseCount.Add(-1)
+	return resp, 0
+}
+
+// Queues responses that were pending when a snapshot was written
+func (bus *DeviceResponseBus) restore(responses []*Response) {
+	bus.backlogLock.Lock()
+	defer bus.backlogLock.Unlock()
+
+	bus.backlog = append(bus.backlog, responses...)
+	bus.responseCount.Add(int32(len(responses)))
+}
+
 // Takes a program and returns a VM that's ready to execute the program from
-// the beginning
-func NewVirtualMachine(program Program) *VM {
+// the beginning. Options can be used to change the default configuration.
+func NewVirtualMachine(program Program, options ...VMOption) (*VM, error) {
+	cfg, err := newVMConfig(options)
+	if err != nil {
+		return nil, err
+	}
+
+	loadAddr := program.loadAddr
+	if loadAddr == 0 {
+		loadAddr = reservedBytes
+	} else if loadAddr < reservedBytes {
+		return nil, fmt.Errorf("program load address %d overlaps the interrupt vector table", loadAddr)
+	}
+
+	programBytes := uint64(len(program.instructions))*uint64(instructionBytes) + uint64(len(program.data))
+	// Program needs to fit after its load address with enough room for the initial stack arguments
+	if uint64(loadAddr)+programBytes+uint64(varchBytesx2) > cfg.memorySizeBytes {
+		return nil, fmt.Errorf("program (%d bytes at address %d) does not fit into %d bytes of memory", programBytes, loadAddr, cfg.memorySizeBytes)
+	}
+
+	vm, err := newVM(cfg, program.debugSymMap)
+	if err != nil {
+		return nil, err
+	}
+
+	vm.entryPoint = program.entryPoint
+	vm.loadAddr = loadAddr
+	if vm.entryPoint == 0 {
+		vm.entryPoint = loadAddr
+	}
+
+	for i, instr := range program.instructions {
+		// Address in VM memory we will place this instruction
+		baseAddr := instructionBytes*uint32(i) + loadAddr
+		encodeInstruction(instr, vm.memory[baseAddr:])
+	}
+
+	vm.processInstructionBytes = uint32(len(program.instructions)) * instructionBytes
+	if cfg.instructionCache {
+		vm.icache = newInstructionCache(vm.memory, loadAddr, vm.processInstructionBytes)
+	}
+
+	// Static data goes directly after the instructions
+	copy(vm.memory[loadAddr+vm.processInstructionBytes:], program.data)
+	vm.processDataBytes = uint32(len(program.data))
+
+	vm.setInitialVMState()
+
+	return vm, nil
+}
+
+// Creates a VM with empty memory and the devices described by the config, but doesn't load anything
+// into it
+func newVM(cfg *vmConfig, debugSymMap map[int]string) (*VM, error) {
 	vm := &VM{
 		responseBus: newDeviceResponseBus(),
+		initialMode: cfg.privilegeMode,
+		memory:      make([]byte, cfg.memorySizeBytes),
 	}
 
 	vm.pubRegisters = vm.registers[:numRegisters]
@@ -186,11 +379,28 @@ func NewVirtualMachine(program Program) *VM {
 	// Set available segment to initially point to entire memory region
 	vm.activeSegment = vm.memory[:]
 
-	// Set up devices
-	vm.devices[0] = newSystemTimer(DeviceBaseInfo{InterruptAddr: 0, ResponseBus: vm.responseBus})
-	vm.devices[1] = newPowerController(DeviceBaseInfo{InterruptAddr: 1 * varchBytes, ResponseBus: vm.responseBus}, vm)
-	vm.devices[2] = newMemoryManagement(DeviceBaseInfo{InterruptAddr: 2 * varchBytes, ResponseBus: vm.responseBus}, vm)
-	vm.devices[3] = newConsoleIO(DeviceBaseInfo{InterruptAddr: 3 * varchBytes, ResponseBus: vm.responseBus}, vm)
+	// Set up devices, allowing the config to replace or remove the defaults
+	vm.devices[1] = newPowerController(vm.deviceBaseInfo(1), vm)
+	vm.devices[2] = newMemoryManagement(vm.deviceBaseInfo(2), vm)
+	if _, ok := cfg.devices[0]; !ok {
+		vm.devices[0] = newSystemTimer(vm.deviceBaseInfo(0))
+	}
+	if _, ok := cfg.devices[3]; !ok {
+		vm.devices[3] = newConsoleIO(vm.deviceBaseInfo(3), vm, cfg.stdin)
+	}
+
+	for port, newDevice := range cfg.devices {
+		if newDevice == nil {
+			continue
+		}
+
+		device := newDevice(vm.deviceBaseInfo(port))
+		if device == nil {
+			return nil, fmt.Errorf("device constructor for port %d returned nil", port)
+		}
+
+		vm.devices[port] = device
+	}
 
 	// Initialize remainder of device slots with nodevice marker
 	for i := 0; i < int(maxHWDevices); i++ {
@@ -199,30 +409,59 @@ func NewVirtualMachine(program Program) *VM {
 		}
 	}
 
-	if program.debugSymMap != nil {
+	if debugSymMap != nil && cfg.useDebugSymbols {
 		vm.debugOut = &strings.Builder{}
-		vm.debugSym = &debugSymbols{source: program.debugSymMap}
-		vm.stdout = bufio.NewWriter(vm.debugOut)
+		vm.debugSym = &debugSymbols{source: debugSymMap}
+		if cfg.stdout != nil {
+			vm.stdout = bufio.NewWriter(io.MultiWriter(vm.debugOut, cfg.stdout))
+		} else {
+			vm.stdout = bufio.NewWriter(vm.debugOut)
+		}
+	} else if cfg.stdout != nil {
+		vm.stdout = bufio.NewWriter(cfg.stdout)
 	} else {
 		vm.stdout = bufio.NewWriter(os.Stdout)
 	}
 
-	for i, instr := range program.instructions {
-		// Address in VM memory we will place this instruction
-		baseAddr := instructionBytes*uint32(i) + reservedBytes
-		bytes := vm.memory[baseAddr:]
+	return vm, nil
+}
+
+// Returns the base info for the device connected to the given port
+func (vm *VM) deviceBaseInfo(port uint32) DeviceBaseInfo {
+	return DeviceBaseInfo{InterruptAddr: port * varchBytes, ResponseBus: vm.responseBus}
+}
 
-		// Convert instruction to a series of bytes in memory
-		uint16ToBytes(instr.code, bytes)
-		uint16ToBytes(instr.register, bytes[2:])
-		uint32ToBytes(instr.arg, bytes[4:])
+// Attaches a custom hardware device to a free port. The constructor is handed the base info
+// for that port (interrupt address + response bus) so that the device can raise interrupts.
+//
+// Devices can only be attached before the VM starts running.
+func (vm *VM) AttachDevice(port uint32, newDevice DeviceConstructor) error {
+	if vm.started {
+		return errors.New("cannot attach device after the VM has started")
 	}
 
-	vm.processInstructionBytes = uint32(len(program.instructions)) * instructionBytes
+	if port >= maxHWDevices {
+		return fmt.Errorf("invalid device port %d (must be less than %d)", port, maxHWDevices)
+	}
 
-	vm.setInitialVMState()
+	if _, ok := vm.devices[port].(*nodevice); !ok {
+		return fmt.Errorf("device port %d is already in use", port)
+	}
+
+	device := newDevice(vm.deviceBaseInfo(port))
+	if device == nil {
+		return fmt.Errorf("device constructor for port %d returned nil", port)
+	}
 
-	return vm
+	vm.devices[port] = device
+	return nil
+}
+
+// Converts an instruction to a series of 8 bytes encoded as little endian
+func encodeInstruction(instr Instruction, bytes []byte) {
+	uint16ToBytes(instr.code, bytes)
+	uint16ToBytes(instr.register, bytes[2:])
+	uint32ToBytes(instr.arg, bytes[4:])
 }
 
 // Returns a tuple of (code, register, oparg) without packaging it into an Instruction type
@@ -252,7 +491,7 @@ func (vm *VM) computeRelativeStackPointer(sp uint32) uint32 {
 //  1. if debug symbols available, use that to print original source
 //  2. if no debug symbols, approximate the code (labels will have been replaced with numbers)
 func formatInstructionStr(vm *VM, pc register, prefix string) string {
-	if pc < heapSizeBytes {
+	if uint64(pc)+uint64(instructionBytes) <= uint64(len(vm.memory)) {
 		if vm.debugSym != nil {
 			// Use debug symbols to print source as it was when first read in
 			return fmt.Sprintf(prefix+" %d: %s", pc, vm.debugSym.source[int(pc)])
@@ -273,7 +512,7 @@ func (vm *VM) printCurrentState() {
 
 	fmt.Println("  general registers>", vm.pubRegisters)
 	fmt.Println("  special registers>", vm.registers[numRegisters:])
-	fmt.Println("  stack>", vm.activeSegment[vm.computeRelativeStackPointer(*vm.sp):])
+	fmt.Println("  stack>", vm.stackBytes())
 
 	vm.printDebugOutput()
 }
@@ -287,8 +526,8 @@ func (vm *VM) printDebugOutput() {
 func (vm *VM) printProgram() {
 	numInstructions := vm.processInstructionBytes / instructionBytes
 	for i := range numInstructions {
-		fmt.Print(formatInstructionStr(vm, register(i)*instructionBytes+reservedBytes, " "))
-		if (i*instructionBytes + reservedBytes) == *vm.pc {
+		fmt.Print(formatInstructionStr(vm, register(i)*instructionBytes+vm.loadAddr, " "))
+		if (i*instructionBytes + vm.loadAddr) == *vm.pc {
 			fmt.Print(" <- next instruction\n")
 		} else {
 			fmt.Println()
@@ -296,11 +535,24 @@ func (vm *VM) printProgram() {
 	}
 }
 
+// Writes all of physical memory, starting at address 0, so that it can be inspected later
+// (see DisassembleMemory)
+func (vm *VM) WriteMemoryDump(w io.Writer) error {
+	_, err := w.Write(vm.memory)
+	return err
+}
+
 // Converts uint16 to a sequence of 2 bytes encoded as little endian
 func uint16ToBytes(u uint16, bytes []byte) {
 	binary.LittleEndian.PutUint16(bytes, u)
 }
 
+// Converts bytes -> uint16, assuming the given bytes are at least
+// a sequence of 2 and that they were encoded as little endian
+func uint16FromBytes(bytes []byte) uint16 {
+	return binary.LittleEndian.Uint16(bytes)
+}
+
 // Converts bytes -> uint32, assuming the given bytes are at least
 // a sequence of 4 and that they were encoded as little endian
 func uint32FromBytes(bytes []byte) uint32 {
@@ -316,6 +568,17 @@ func float32ToBytes(f float32, bytes []byte) {
 	uint32ToBytes(math.Float32bits(f), bytes)
 }
 
+// Returns all bytes currently on the stack. When memory spans the full 32-bit address space
+// the top of the stack wraps around to 0, which is treated as an empty stack.
+func (vm *VM) stackBytes() []byte {
+	relsp := vm.computeRelativeStackPointer(*vm.sp)
+	if relsp == 0 && uint64(len(vm.activeSegment)) == maxHeapSizeBytes {
+		return nil
+	}
+
+	return vm.activeSegment[relsp:]
+}
+
 // Returns current top of stack without moving stack pointer
 func (vm *VM) peekStack() []byte {
 	return vm.activeSegment[vm.computeRelativeStackPointer(*vm.sp):]
@@ -324,6 +587,7 @@ func (vm *VM) peekStack() []byte {
 // Reserves space on the stack without returning anything
 func (vm *VM) pushStackFast(bytes uint32) {
 	*vm.sp -= bytes
+	vm.stackGrew()
 }
 
 // Removes bytes from the stack without returning anything
@@ -392,12 +656,14 @@ func (vm *VM) popPeekStack() ([]byte, []byte) {
 func (vm *VM) pushStackByte(value register) {
 	*vm.sp--
 	vm.activeSegment[vm.computeRelativeStackPointer(*vm.sp)] = byte(value)
+	vm.stackGrew()
 }
 
 // Pushes value to stack unmodified
 func (vm *VM) pushStack(value register) {
 	*vm.sp -= varchBytes
 	uint32ToBytes(value, vm.activeSegment[vm.computeRelativeStackPointer(*vm.sp):])
+	vm.stackGrew()
 }
 
 // Same as if push(v1); push(v0) had happened in order
@@ -406,6 +672,7 @@ func (vm *VM) pushStackTwo(v0, v1 register) {
 	bytes := vm.activeSegment[vm.computeRelativeStackPointer(*vm.sp):]
 	uint32ToBytes(v0, bytes)
 	uint32ToBytes(v1, bytes[varchBytes:])
+	vm.stackGrew()
 }
 
 // Same as if push(v2); push(v1); push(v0) had happened in order
@@ -415,6 +682,7 @@ func (vm *VM) pushStackThree(v0, v1, v2 register) {
 	uint32ToBytes(v0, bytes)
 	uint32ToBytes(v1, bytes[varchBytes:])
 	uint32ToBytes(v2, bytes[varchBytesx2:])
+	vm.stackGrew()
 }
 
 // Same as if push(v3); push(v2); push(v1); push(v0) had happened in order
@@ -425,6 +693,7 @@ func (vm *VM) pushStackFour(v0, v1, v2, v3 register) {
 	uint32ToBytes(v1, bytes[varchBytes:])
 	uint32ToBytes(v2, bytes[varchBytesx2:])
 	uint32ToBytes(v3, bytes[varchBytesx3:])
+	vm.stackGrew()
 }
 
 // Pushes a sequence of bytes to the stack (starts reading at the end of data down to 0)
@@ -440,6 +709,8 @@ func (vm *VM) pushStackSegment(data []byte) {
 	for i := lendata - 1; i >= 0; i-- {
 		bytes[i] = data[i]
 	}
+
+	vm.stackGrew()
 }
 
 // Peeks the first item off the stack, converts it to uint32 and returns the stack
@@ -456,6 +727,12 @@ func getStackTwoInputs(vm *VM) (uint32, uint32, []byte) {
 	return uint32FromBytes(x), uint32FromBytes(y), y
 }
 
+// Pushes a copy of stack[index]. Indexes past the bottom of the stack cause a segmentation fault.
+func pick(vm *VM, index uint32) {
+	// Computed in 64 bits so that large indexes can't wrap around
+	vm.pushStack(uint32FromBytes(vm.peekStack()[uint64(index)*uint64(varchBytes):]))
+}
+
 // compares 2 32-bit numbers and returns -1 (x<y), 0 (x==y), or 1 (x>y)
 func compare[T numeric32](x, y T) uint32 {
 	if x < y {
@@ -469,13 +746,58 @@ func compare[T numeric32](x, y T) uint32 {
 
 func arithRemi[T integer32](x, y T) (uint32, error) {
 	if y == 0 {
-		return 0, errDivisionByZero
+		return 0, ErrDivisionByZero
 	}
 
 	return uint32(x % y), nil
 }
 
-func (vm *VM) initForInterrupt() {
+func absf(f float32) float32 {
+	return float32(math.Abs(float64(f)))
+}
+
+// Rounding the float64 square root back to float32 gives the correctly rounded float32 result
+func sqrtf(f float32) float32 {
+	return float32(math.Sqrt(float64(f)))
+}
+
+func floorf(f float32) float32 {
+	return float32(math.Floor(float64(f)))
+}
+
+func ceilf(f float32) float32 {
+	return float32(math.Ceil(float64(f)))
+}
+
+// Truncates towards zero. Go leaves out of range conversions up to the platform, so values that don't fit
+// saturate to the closest int32 and NaN becomes 0 to behave the same everywhere.
+func floatToInt32(f float32) uint32 {
+	switch {
+	case f != f:
+		return 0
+	case f >= math.MaxInt32:
+		return math.MaxInt32
+	case f <= math.MinInt32:
+		return uint32(1 << 31) // math.MinInt32 as an unsigned value
+	default:
+		return uint32(int32(f))
+	}
+}
+
+// Same as floatToInt32 but saturates to the range of uint32 (negative values become 0)
+func floatToUint32(f float32) uint32 {
+	switch {
+	case f != f || f <= 0:
+		return 0
+	case f >= math.MaxUint32:
+		return math.MaxUint32
+	default:
+		return uint32(f)
+	}
+}
+
+// line is the port of the device that raised the interrupt, or noInterruptLine for exceptions and sysint
+func (vm *VM) initForInterrupt(line uint32) {
 	// Get snapshot of current stack pointer (resume will back up to this point)
 	sp := *vm.sp
 
@@ -485,6 +807,12 @@ func (vm *VM) initForInterrupt() {
 	// Update fp to point to new location
 	*vm.fp = *vm.sp
 
+	// The line stays in service until its handler is done (see interrupts.go)
+	if line != noInterruptLine {
+		vm.registers[picInServiceRegister] |= 1 << line
+		vm.interruptFrames[line] = *vm.fp
+	}
+
 	if *vm.mode != 0 {
 		// Clear the mode flag to signal max privilege
 		*vm.mode = 0
@@ -506,6 +834,9 @@ func returnFromCall(vm *VM) {
 	// Restore old PC and old FP
 	*vm.pc = oldPc
 	*vm.fp = oldFp
+
+	// The frame pointer could have been anywhere, so the stack may have moved away from the program
+	vm.stackMoved()
 }
 
 // load pointer 8, 16 and 32 bits
@@ -525,27 +856,105 @@ func loadp32(vm *VM, addr uint32, bytes []byte) {
 }
 
 // store pointer 8, 16 and 32 bits
+//
+// addr is a physical address, so it's also what the instruction cache is checked against
 func storep8(vm *VM, addr uint32, value []byte) {
-	addr = vm.computeRelativeStackPointer(addr)
-	vm.activeSegment[addr] = value[0]
+	relative := vm.computeRelativeStackPointer(addr)
+	vm.activeSegment[relative] = value[0]
+	vm.codeWritten(addr, 1)
 }
 
 func storep16(vm *VM, addr uint32, valueBytes []byte) {
-	addr = vm.computeRelativeStackPointer(addr)
+	relative := vm.computeRelativeStackPointer(addr)
 
 	// unrolled loop
-	vm.activeSegment[addr] = valueBytes[0]
-	vm.activeSegment[addr+1] = valueBytes[1]
+	vm.activeSegment[relative] = valueBytes[0]
+	vm.activeSegment[relative+1] = valueBytes[1]
+	vm.codeWritten(addr, 2)
 }
 
 func storep32(vm *VM, addr uint32, valueBytes []byte) {
-	addr = vm.computeRelativeStackPointer(addr)
+	relative := vm.computeRelativeStackPointer(addr)
 
 	// unrolled loop
-	vm.activeSegment[addr] = valueBytes[0]
-	vm.activeSegment[addr+1] = valueBytes[1]
-	vm.activeSegment[addr+2] = valueBytes[2]
-	vm.activeSegment[addr+3] = valueBytes[3]
+	vm.activeSegment[relative] = valueBytes[0]
+	vm.activeSegment[relative+1] = valueBytes[1]
+	vm.activeSegment[relative+2] = valueBytes[2]
+	vm.activeSegment[relative+3] = valueBytes[3]
+	vm.codeWritten(addr, 4)
+}
+
+// Returns the numBytes bytes starting at addr, which is translated the same way as loadpX/storepX. Ranges
+// outside of the active segment cause a segmentation fault.
+func (vm *VM) memoryRange(addr, numBytes uint32) []byte {
+	relative := vm.computeRelativeStackPointer(addr)
+	// Computed in 64 bits so that ranges past the end of memory can't wrap around
+	return vm.activeSegment[relative : uint64(relative)+uint64(numBytes)]
+}
+
+// Copies forward one byte at a time, which is what a loadp8/storep8 loop does. When dest overlaps the end
+// of src the bytes before dest repeat, so it's done in chunks of the distance between them.
+func memcpy(vm *VM, dest, src, numBytes uint32) {
+	to, from := vm.memoryRange(dest, numBytes), vm.memoryRange(src, numBytes)
+	if dest > src && dest-src < numBytes {
+		distance := dest - src
+		for i := uint32(0); i < numBytes; i += distance {
+			copy(to[i:], from[i:min(i+distance, numBytes)])
+		}
+	} else {
+		copy(to, from)
+	}
+
+	vm.blockWritten(dest, numBytes)
+}
+
+// Go's copy already handles overlapping ranges as if through a temporary buffer
+func memmove(vm *VM, dest, src, numBytes uint32) {
+	copy(vm.memoryRange(dest, numBytes), vm.memoryRange(src, numBytes))
+	vm.blockWritten(dest, numBytes)
+}
+
+func memset(vm *VM, dest, value, numBytes uint32) {
+	to := vm.memoryRange(dest, numBytes)
+	for i := range to {
+		to[i] = byte(value)
+	}
+
+	vm.blockWritten(dest, numBytes)
+}
+
+// Returns -1, 0 or 1 (as uint32) the same way as compare
+func memcmp(vm *VM, x, y, numBytes uint32) uint32 {
+	return uint32(bytes.Compare(vm.memoryRange(x, numBytes), vm.memoryRange(y, numBytes)))
+}
+
+// Each of these reads the 32-bit value at addr (translated the same way as loadpX/storepX), possibly
+// replaces it and returns the value from before. Since interrupts only run between instructions, nothing
+// else can observe or modify the value in between.
+func cas32(vm *VM, addr, expected, value uint32) uint32 {
+	bytes := vm.activeSegment[vm.computeRelativeStackPointer(addr):]
+	old := binary.LittleEndian.Uint32(bytes)
+	if old == expected {
+		binary.LittleEndian.PutUint32(bytes, value)
+		vm.codeWritten(addr, 4)
+	}
+	return old
+}
+
+func xchg32(vm *VM, addr, value uint32) uint32 {
+	bytes := vm.activeSegment[vm.computeRelativeStackPointer(addr):]
+	old := binary.LittleEndian.Uint32(bytes)
+	binary.LittleEndian.PutUint32(bytes, value)
+	vm.codeWritten(addr, 4)
+	return old
+}
+
+func fetchadd32(vm *VM, addr, delta uint32) uint32 {
+	bytes := vm.activeSegment[vm.computeRelativeStackPointer(addr):]
+	old := binary.LittleEndian.Uint32(bytes)
+	binary.LittleEndian.PutUint32(bytes, old+delta)
+	vm.codeWritten(addr, 4)
+	return old
 }
 
 // Instruction fetch, decode+execute
@@ -557,16 +966,16 @@ func storep32(vm *VM, addr uint32, valueBytes []byte) {
 // It's ok to move certain things to functions if the instructions are very simple (meaning Go's inlining rules take over),
 // but otherwise it's best to try and embed the logic directly into the switch statement.
 //
-// singleStep can be set when in debug mode so that this function runs 1 instruction
-// and then returns to caller.
+// At most vm.instructionBudget instructions are executed (debug mode sets it to 1 to single step) before
+// returning to the caller, and the budget is decremented for each one.
 //
 // The current design of this function attempts to balance performance, readability and code reuse.
-func (vm *VM) execInstructions(singleStep bool) (retcode bool) {
+func (vm *VM) execInstructions() (retcode bool) {
 	defer func() {
 		if r := recover(); r != nil {
 			// If not already a set errorcode, fill it in with segfault here
 			if vm.errcode == nil {
-				vm.errcode = errSegmentationFault
+				vm.errcode = ErrSegmentationFault
 			}
 
 			// Signal to caller that we want to retry execution
@@ -591,33 +1000,51 @@ func (vm *VM) execInstructions(singleStep bool) (retcode bool) {
 				return false
 			}
 
-			vm.initForInterrupt()
+			vm.initForInterrupt(noInterruptLine)
 			*pc = handlerAddr
 
 			// Reset the error flag
 			vm.errcode = nil
-		} else if vm.responseBus.Ready() {
-			resp := vm.responseBus.Receive()
-			if resp.deviceErr != nil {
+		} else if !vm.interruptsDisabled && vm.responseBus.responseCount.Load() > vm.heldResponses {
+			// The interrupt controller picks which response to deliver (see interrupts.go). If it holds
+			// all of them back, the bus isn't looked at again until something changes
+			resp, held := vm.responseBus.receiveChosen(vm.chooseResponse)
+			vm.heldResponses = held
+			if resp != nil && resp.deviceErr != nil {
 				vm.errcode = resp.deviceErr
 				continue
 			}
 
-			handlerAddr := uint32FromBytes(vm.memory[resp.interruptAddr:])
-			if handlerAddr != 0 {
-				// Store state related to current frame first
-				vm.initForInterrupt()
+			if resp != nil {
+				handlerAddr := uint32FromBytes(vm.memory[resp.interruptAddr:])
+				if handlerAddr != 0 {
+					// Store state related to current frame first
+					vm.initForInterrupt(interruptLine(resp))
 
-				// Store response information next
-				vm.pushStackSegment(resp.data)
-				vm.pushStackTwo(resp.id, uint32(len(resp.data)))
+					// Store response information next
+					vm.pushStackSegment(resp.data)
+					vm.pushStackTwo(resp.id, uint32(len(resp.data)))
 
-				// Redirect program counter to the handler's address
-				*pc = handlerAddr
+					// Redirect program counter to the handler's address
+					*pc = handlerAddr
+				}
 			}
 		}
 
-		code, opreg, oparg := decodeInstruction(vm.memory[*pc:])
+		if vm.instructionBudget == 0 {
+			return true
+		}
+		vm.instructionBudget--
+
+		// Use the already decoded instruction when pc is inside of the instruction cache (see icache.go)
+		var code, opreg uint16
+		var oparg uint32
+		if i := vm.icache.index(*pc); i < vm.icache.count {
+			instr := &vm.icache.instructions[i]
+			code, opreg, oparg = instr.code, instr.register, instr.arg
+		} else {
+			code, opreg, oparg = decodeInstruction(vm.memory[*pc:])
+		}
 		*pc += instructionBytes
 
 		switch code {
@@ -692,7 +1119,7 @@ func (vm *VM) execInstructions(singleStep bool) (retcode bool) {
 			vm.popStackFast(bytes)
 
 			relative := vm.computeRelativeStackPointer(*vm.sp)
-			if relative > uint32(len(vm.activeSegment)) {
+			if uint64(relative) > uint64(len(vm.activeSegment)) {
 				// This will ensure we catch invalid stack addresses
 				var _ = vm.activeSegment[relative]
 			}
@@ -700,11 +1127,33 @@ func (vm *VM) execInstructions(singleStep bool) (retcode bool) {
 			vm.popStackFast(oparg)
 
 			relative := vm.computeRelativeStackPointer(*vm.sp)
-			if relative > uint32(len(vm.activeSegment)) {
+			if uint64(relative) > uint64(len(vm.activeSegment)) {
 				// This will ensure we catch invalid stack addresses
 				var _ = vm.activeSegment[relative]
 			}
 
+		// Begin stack manipulation instructions
+		case dupNoArgs:
+			vm.pushStack(uint32FromBytes(vm.peekStack()))
+		case swapNoArgs:
+			bytes := vm.peekStack()
+			x, y := uint32FromBytes(bytes), uint32FromBytes(bytes[varchBytes:])
+			uint32ToBytes(y, bytes)
+			uint32ToBytes(x, bytes[varchBytes:])
+		case overNoArgs:
+			vm.pushStack(uint32FromBytes(vm.peekStack()[varchBytes:]))
+		case rotNoArgs:
+			bytes := vm.peekStack()
+			x, y, z := uint32FromBytes(bytes), uint32FromBytes(bytes[varchBytes:]), uint32FromBytes(bytes[varchBytesx2:])
+			uint32ToBytes(z, bytes)
+			uint32ToBytes(x, bytes[varchBytes:])
+			uint32ToBytes(y, bytes[varchBytesx2:])
+		case pickNoArgs:
+			index := vm.popStackUint32()
+			pick(vm, index)
+		case pickOneArg:
+			pick(vm, oparg)
+
 		// Begin add instructions
 		case addiNoArgs:
 			x, y, bytes := getStackTwoInputs(vm)
@@ -754,7 +1203,7 @@ func (vm *VM) execInstructions(singleStep bool) (retcode bool) {
 			// See https://stackoverflow.com/questions/23505212/floating-point-is-an-equality-comparison-enough-to-prevent-division-by-zero
 			// and its discussion
 			if y == 0 {
-				vm.errcode = errDivisionByZero
+				vm.errcode = ErrDivisionByZero
 				continue
 			}
 
@@ -764,12 +1213,46 @@ func (vm *VM) execInstructions(singleStep bool) (retcode bool) {
 			// See https://stackoverflow.com/questions/23505212/floating-point-is-an-equality-comparison-enough-to-prevent-division-by-zero
 			// and its discussion
 			if oparg == 0 {
-				vm.errcode = errDivisionByZero
+				vm.errcode = ErrDivisionByZero
 				continue
 			}
 
 			x, bytes := getStackOneInput(vm)
 			uint32ToBytes(x/oparg, bytes)
+
+		case divuNoArgs:
+			x, y, bytes := getStackTwoInputs(vm)
+			if y == 0 {
+				vm.errcode = ErrDivisionByZero
+				continue
+			}
+
+			uint32ToBytes(x/y, bytes)
+		case divuOneArg:
+			if oparg == 0 {
+				vm.errcode = ErrDivisionByZero
+				continue
+			}
+
+			x, bytes := getStackOneInput(vm)
+			uint32ToBytes(x/oparg, bytes)
+
+		case divsNoArgs:
+			x, y, bytes := getStackTwoInputs(vm)
+			if y == 0 {
+				vm.errcode = ErrDivisionByZero
+				continue
+			}
+
+			uint32ToBytes(uint32(int32(x)/int32(y)), bytes)
+		case divsOneArg:
+			if oparg == 0 {
+				vm.errcode = ErrDivisionByZero
+				continue
+			}
+
+			x, bytes := getStackOneInput(vm)
+			uint32ToBytes(uint32(int32(x)/int32(oparg)), bytes)
 		case divfNoArgs:
 			x, y, bytes := getStackTwoInputs(vm)
 			float32ToBytes(math.Float32frombits(x)/math.Float32frombits(y), bytes)
@@ -777,6 +1260,28 @@ func (vm *VM) execInstructions(singleStep bool) (retcode bool) {
 			x, bytes := getStackOneInput(vm)
 			float32ToBytes(math.Float32frombits(x)/math.Float32frombits(oparg), bytes)
 
+		// Begin unary arithmetic instructions (with an argument they push the result for the argument instead)
+		case negNoArgs:
+			x, bytes := getStackOneInput(vm)
+			uint32ToBytes(-x, bytes)
+		case negOneArg:
+			vm.pushStack(-oparg)
+		case negfNoArgs:
+			x, bytes := getStackOneInput(vm)
+			float32ToBytes(-math.Float32frombits(x), bytes)
+		case negfOneArg:
+			vm.pushStack(math.Float32bits(-math.Float32frombits(oparg)))
+		case absfNoArgs:
+			x, bytes := getStackOneInput(vm)
+			float32ToBytes(absf(math.Float32frombits(x)), bytes)
+		case absfOneArg:
+			vm.pushStack(math.Float32bits(absf(math.Float32frombits(oparg))))
+		case sqrtfNoArgs:
+			x, bytes := getStackOneInput(vm)
+			float32ToBytes(sqrtf(math.Float32frombits(x)), bytes)
+		case sqrtfOneArg:
+			vm.pushStack(math.Float32bits(sqrtf(math.Float32frombits(oparg))))
+
 		// Begin radd instructions
 		case raddiOneArg:
 			x, bytes := getStackOneInput(vm)
@@ -832,7 +1337,7 @@ func (vm *VM) execInstructions(singleStep bool) (retcode bool) {
 			// See https://stackoverflow.com/questions/23505212/floating-point-is-an-equality-comparison-enough-to-prevent-division-by-zero
 			// and its discussion
 			if x == 0 {
-				vm.errcode = errDivisionByZero
+				vm.errcode = ErrDivisionByZero
 				continue
 			}
 
@@ -843,7 +1348,7 @@ func (vm *VM) execInstructions(singleStep bool) (retcode bool) {
 			// See https://stackoverflow.com/questions/23505212/floating-point-is-an-equality-comparison-enough-to-prevent-division-by-zero
 			// and its discussion
 			if oparg == 0 {
-				vm.errcode = errDivisionByZero
+				vm.errcode = ErrDivisionByZero
 				continue
 			}
 
@@ -857,6 +1362,24 @@ func (vm *VM) execInstructions(singleStep bool) (retcode bool) {
 			vm.pubRegisters[opreg] = math.Float32bits(math.Float32frombits(vm.pubRegisters[opreg]) / math.Float32frombits(oparg))
 			vm.pushStack(vm.pubRegisters[opreg])
 
+		case rdivsOneArg:
+			x, bytes := getStackOneInput(vm)
+			if x == 0 {
+				vm.errcode = ErrDivisionByZero
+				continue
+			}
+
+			vm.pubRegisters[opreg] = uint32(int32(vm.pubRegisters[opreg]) / int32(x))
+			uint32ToBytes(vm.pubRegisters[opreg], bytes)
+		case rdivsTwoArgs:
+			if oparg == 0 {
+				vm.errcode = ErrDivisionByZero
+				continue
+			}
+
+			vm.pubRegisters[opreg] = uint32(int32(vm.pubRegisters[opreg]) / int32(oparg))
+			vm.pushStack(vm.pubRegisters[opreg])
+
 		// Begin register shift instructions
 		case rshiftLOneArg:
 			x, bytes := getStackOneInput(vm)
@@ -950,6 +1473,44 @@ func (vm *VM) execInstructions(singleStep bool) (retcode bool) {
 		case shiftROneArg:
 			x, bytes := getStackOneInput(vm)
 			uint32ToBytes(x>>oparg, bytes)
+		case sarNoArgs:
+			x, y, bytes := getStackTwoInputs(vm)
+			uint32ToBytes(uint32(int32(x)>>y), bytes)
+		case sarOneArg:
+			x, bytes := getStackOneInput(vm)
+			uint32ToBytes(uint32(int32(x)>>oparg), bytes)
+
+		// Begin conversion instructions (with an argument they push the converted argument instead)
+		case itofNoArgs:
+			x, bytes := getStackOneInput(vm)
+			float32ToBytes(float32(int32(x)), bytes)
+		case itofOneArg:
+			vm.pushStack(math.Float32bits(float32(int32(oparg))))
+		case utofNoArgs:
+			x, bytes := getStackOneInput(vm)
+			float32ToBytes(float32(x), bytes)
+		case utofOneArg:
+			vm.pushStack(math.Float32bits(float32(oparg)))
+		case ftoiNoArgs:
+			x, bytes := getStackOneInput(vm)
+			uint32ToBytes(floatToInt32(math.Float32frombits(x)), bytes)
+		case ftoiOneArg:
+			vm.pushStack(floatToInt32(math.Float32frombits(oparg)))
+		case ftouNoArgs:
+			x, bytes := getStackOneInput(vm)
+			uint32ToBytes(floatToUint32(math.Float32frombits(x)), bytes)
+		case ftouOneArg:
+			vm.pushStack(floatToUint32(math.Float32frombits(oparg)))
+		case floorNoArgs:
+			x, bytes := getStackOneInput(vm)
+			float32ToBytes(floorf(math.Float32frombits(x)), bytes)
+		case floorOneArg:
+			vm.pushStack(math.Float32bits(floorf(math.Float32frombits(oparg))))
+		case ceilNoArgs:
+			x, bytes := getStackOneInput(vm)
+			float32ToBytes(ceilf(math.Float32frombits(x)), bytes)
+		case ceilOneArg:
+			vm.pushStack(math.Float32bits(ceilf(math.Float32frombits(oparg))))
 
 		// Begin jump instructions
 		case jmpNoArgs:
@@ -1074,44 +1635,100 @@ func (vm *VM) execInstructions(singleStep bool) (retcode bool) {
 		case srLoadOneArg:
 			// privilege check
 			if *vm.mode != 0 {
-				vm.errcode = errIllegalInstruction
+				vm.errcode = ErrIllegalInstruction
 				continue
 			}
 
+			if uint32(opreg) == picPendingRegister {
+				vm.updatePendingInterrupts()
+			}
 			vm.pushStack(vm.registers[opreg])
 		case srStoreOneArg:
 			// privilege check
 			if *vm.mode != 0 {
-				vm.errcode = errIllegalInstruction
+				vm.errcode = ErrIllegalInstruction
 				continue
 			}
 
 			regVal := uint32FromBytes(vm.popStack())
-			vm.registers[opreg] = register(regVal)
+			if uint32(opreg) >= picMaskRegister {
+				vm.storeInterruptControllerRegister(uint32(opreg), register(regVal))
+			} else {
+				vm.registers[opreg] = register(regVal)
+			}
+
+			// The stack pointer is one of the registers that can be stored to
+			vm.stackMoved()
 
 			// Allow memory management device to potentially update memory bounds (if store
 			// register was vm.mode)
 			vm.devices[2].TrySend(0, 3, nil)
 
+		// Begin block memory instructions
+		case memcpyNoArgs:
+			dest, src, numBytes := vm.popStackx3Uint32()
+			memcpy(vm, dest, src, numBytes)
+		case memcpyOneArg:
+			dest, src := vm.popStackx2Uint32()
+			memcpy(vm, dest, src, oparg)
+		case memmoveNoArgs:
+			dest, src, numBytes := vm.popStackx3Uint32()
+			memmove(vm, dest, src, numBytes)
+		case memmoveOneArg:
+			dest, src := vm.popStackx2Uint32()
+			memmove(vm, dest, src, oparg)
+		case memsetNoArgs:
+			dest, value, numBytes := vm.popStackx3Uint32()
+			memset(vm, dest, value, numBytes)
+		case memsetOneArg:
+			dest, value := vm.popStackx2Uint32()
+			memset(vm, dest, value, oparg)
+		case memcmpNoArgs:
+			x, y, numBytes := vm.popStackx3Uint32()
+			vm.pushStack(memcmp(vm, x, y, numBytes))
+		case memcmpOneArg:
+			x, y := vm.popStackx2Uint32()
+			vm.pushStack(memcmp(vm, x, y, oparg))
+
+		// Begin atomic instructions
+		case cas32NoArgs:
+			addr, expected, value := vm.popStackx3Uint32()
+			vm.pushStack(cas32(vm, addr, expected, value))
+		case cas32OneArg:
+			addr, expected, value := vm.popStackx3Uint32()
+			vm.pushStack(cas32(vm, addr+oparg, expected, value))
+		case xchg32NoArgs:
+			addr, value := vm.popStackx2Uint32()
+			vm.pushStack(xchg32(vm, addr, value))
+		case xchg32OneArg:
+			addr, value := vm.popStackx2Uint32()
+			vm.pushStack(xchg32(vm, addr+oparg, value))
+		case fetchadd32NoArgs:
+			addr, delta := vm.popStackx2Uint32()
+			vm.pushStack(fetchadd32(vm, addr, delta))
+		case fetchadd32OneArg:
+			addr, delta := vm.popStackx2Uint32()
+			vm.pushStack(fetchadd32(vm, addr+oparg, delta))
+
 		// Begin system interrupt and resume
 		case sysintOneArg:
 			if oparg < restrictedInterruptsAddrRange {
 				// Perform privilege check to make sure calling code can actually initiate a
 				// privileged interrupt
 				if *vm.mode != 0 {
-					vm.errcode = errIllegalInstruction
+					vm.errcode = ErrIllegalInstruction
 					continue
 				}
 			}
 
 			handlerAddr := uint32FromBytes(vm.memory[oparg:])
 			if handlerAddr == 0 {
-				vm.errcode = errUnknownInstruction
+				vm.errcode = ErrUnknownInstruction
 				continue
 			}
 
 			// Push caller frame info to the stack so we can resume later
-			vm.initForInterrupt()
+			vm.initForInterrupt(noInterruptLine)
 
 			// Update the program counter to be the interrupt handler's address
 			*pc = handlerAddr
@@ -1119,12 +1736,13 @@ func (vm *VM) execInstructions(singleStep bool) (retcode bool) {
 		case resumeNoArgs:
 			// privilege check
 			if *vm.mode != 0 {
-				vm.errcode = errIllegalInstruction
+				vm.errcode = ErrIllegalInstruction
 				continue
 			}
 
 			// Back up to frame pointer
 			*vm.sp = *vm.fp
+			vm.endInterrupts(*vm.fp)
 
 			prevPc, prevSp, prevFp, prevMode := vm.popStackx4Uint32()
 			// Since resume is a privileged instruction, we know the current mode must be 0
@@ -1139,11 +1757,12 @@ func (vm *VM) execInstructions(singleStep bool) (retcode bool) {
 			*vm.pc = prevPc
 			*vm.sp = prevSp
 			*vm.fp = prevFp
+			vm.stackMoved()
 
 		case writeTwoArgs:
 			// privilege check
 			if *vm.mode != 0 {
-				vm.errcode = errIllegalInstruction
+				vm.errcode = ErrIllegalInstruction
 				continue
 			}
 
@@ -1154,31 +1773,51 @@ func (vm *VM) execInstructions(singleStep bool) (retcode bool) {
 			} else {
 				interactionId, numBytes := vm.popStackx2Uint32()
 				sptr := *vm.sp
-				data := vm.memory[sptr : sptr+numBytes]
+				// Computed in 64 bits so that reads past the end of memory can't wrap around
+				data := vm.memory[sptr : uint64(sptr)+uint64(numBytes)]
 
 				vm.popStackFast(numBytes)
 				vm.pushStack(vm.devices[opreg].TrySend(interactionId, oparg, data))
 			}
 
+		case cliNoArgs:
+			// privilege check
+			if *vm.mode != 0 {
+				vm.errcode = ErrIllegalInstruction
+				continue
+			}
+
+			vm.interruptsDisabled = true
+		case stiNoArgs:
+			// privilege check
+			if *vm.mode != 0 {
+				vm.errcode = ErrIllegalInstruction
+				continue
+			}
+
+			vm.interruptsDisabled = false
+
 		case haltNoArgs:
 			// privilege check
 			if *vm.mode != 0 {
-				vm.errcode = errIllegalInstruction
+				vm.errcode = ErrIllegalInstruction
 				continue
 			}
 
 			// Sets the pc to be this instruction (continues loop until interrupt)
 			*pc -= instructionBytes
 
+			if vm.stopOnHalt {
+				vm.halted = true
+				return true
+			}
+
 		default:
 			// Shouldn't get here since we preprocess+parse all source into
 			// valid instructions before executing
-			vm.errcode = errUnknownInstruction
+			vm.errcode = ErrUnknownInstruction
 			continue
 		}
 
-		if singleStep {
-			return true
-		}
 	}
 }
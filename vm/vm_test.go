@@ -1,9 +1,19 @@
 package gvm
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
 	"strings"
 	"testing"
+	"time"
 )
 
 func assert(t *testing.T, cond bool, format string, args ...any) {
@@ -12,30 +22,224 @@ func assert(t *testing.T, cond bool, format string, args ...any) {
 	}
 }
 
-func compileAndCheckSource(t *testing.T, source string) *VM {
+func compileAndCheckSource(t *testing.T, source string, options ...VMOption) *VM {
 	instrs, err := CompileSourceFromBuffer(false, strings.Split(source, "\n"))
 	assert(t, err == nil, "Failed to compile: %s", err)
 
-	vm := NewVirtualMachine(instrs)
-	assert(t, vm != nil, "Failed to create new VM")
+	vm, err := NewVirtualMachine(instrs, options...)
+	assert(t, err == nil, "Failed to create new VM: %s", err)
 	return vm
 }
 
 func compileAndCheck(t *testing.T, files ...string) *VM {
+	return compileAndCheckWithOptions(t, files, nil)
+}
+
+func compileAndCheckWithOptions(t *testing.T, files []string, options []VMOption) *VM {
 	instrs, err := CompileSource(false, files...)
 	assert(t, err == nil, "Failed to compile: %s", err)
 
-	vm := NewVirtualMachine(instrs)
-	assert(t, vm != nil, "Failed to create new VM")
+	vm, err := NewVirtualMachine(instrs, options...)
+	assert(t, err == nil, "Failed to create new VM: %s", err)
 	return vm
 }
 
+// Runs the program and makes sure it stopped because of errcode (nil is returned for ErrSystemShutdown)
 func runAndEnsureSpecificShutdown(t *testing.T, vm *VM, errcode error) {
-	vm.RunProgram()
-	assert(t, vm.errcode == errcode, "Got unexpected error code after running VM: %s", vm.errcode)
+	err := vm.RunProgram()
+	if errcode == ErrSystemShutdown {
+		assert(t, err == nil, "Got unexpected error after running VM: %s", err)
+	} else {
+		assert(t, errors.Is(err, errcode), "Got unexpected error after running VM: %v", err)
+	}
 }
 
 var (
+	diagnosticsTest = `
+start:
+  consts 1
+  rstore
+  jmp   nowhere
+  raddi 3 0xZZ
+  rstore 1
+  // halt is fine
+  halt
+  start:
+  jmp start
+	`
+
+	linkTest = `
+.extern fmt.Print
+.global main
+
+main:
+  const message
+  call fmt.Print
+.end:
+  return
+
+.data
+message:
+  .asciz "Linked hello\n"
+  .align 4
+  .word fmt.Print main.end
+`
+
+	optimizeTest = `
+  const 5
+  const 3
+  addi
+  rstore 3
+  nop
+  const 2
+  raddi 3
+  pop 4
+  const 1
+  const 10
+  subi
+  rstore 4
+  jmp first
+  const 99
+  rstore 4
+first:
+  jmp second
+second:
+  jmp done
+done:
+  const 0
+  const 0
+  write 1 3
+
+.data
+  .word done first
+`
+
+	// What optimizeTest should turn into
+	optimizedTest = `
+  const 5
+  addi 3
+  rstore 3
+  raddi 3 2
+  pop 4
+  const 1
+  const 10
+  subi
+  rstore 4
+  jmp done
+first:
+  jmp done
+second:
+  jmp done
+done:
+  const 0
+  const 0
+  write 1 3
+
+.data
+  .word done first
+`
+
+	constantsTest = `
+.equ COUNT LIMIT
+.define LIMIT 3
+.equ COUNTER 4
+.equ NEWLINE '\n'
+.equ POWER_PORT 1
+
+    const COUNT
+    rstore COUNTER
+loop:
+    raddi COUNTER -1
+    jnz loop
+    const NEWLINE
+    rstore COUNTER
+    const 0
+    const 0
+    write POWER_PORT 3
+    halt
+	`
+
+	expressionsTest = `
+.equ SIZE 4*2
+start:
+    const buffer+16
+buffer:
+    const ((SIZE + 8) * 2)
+    const (SIZE << 2 >> 2)
+    const 17%6|0x4
+    const (0xFF << 8 & ~0xF)
+    const ~0
+    const -SIZE
+    const ((buffer - start) / instructionBytes - 1 + SIZE / 2 * 2 - 2)
+    const 'A'+1
+    const 1.5
+    raddi SIZE/2 3
+	`
+
+	dataTest = `
+.equ PI 3.25
+    const table+4
+    loadp32
+    rstore 4
+    const message
+    loadp8 1
+    rstore 5
+    const 0
+    const 0
+    write 1 3
+    halt
+
+.data
+message:
+    .asciz "hi\n"
+    .align 4
+table:
+    .word 1 (end - message) -1
+floats:
+    .float 1.5 PI 2
+bytes:
+    .byte 'a' 255 -1
+    .space 3 0x7
+end:
+	`
+
+	macroTest = `
+.macro countdown reg n
+    const n
+    rstore reg
+loop:
+    raddi reg -1
+    jnz loop
+.endm
+
+.macro countdownTwice reg n
+    countdown reg n
+    countdown reg (n * 2)
+.endm
+
+    countdown 4 3
+    countdownTwice 5 2
+    const 0
+    const 0
+    write 1 3
+    halt
+	`
+
+	labelsTest = `
+first:
+    jmp .end
+.end:
+    jmp 1f
+1:
+    jmp 1b
+1:
+    jmp 1b
+second:
+    jmp .end
+.end:
+    jmp first.end
+	`
+
 	divByZeroTest1 = `
 		const 0
 		const 1
@@ -73,6 +277,40 @@ var (
 		jmp 0x00			// jump to instruction at mem location 0x00
 	`
 
+	// Overwrites the argument of an instruction that has already been decoded, then the instruction itself
+	selfModifyingTest = `
+		const 42
+		const patched
+		storep32 4			// replace the argument of the const below with 42
+	patched:
+		const 1
+		rstore 3			// register[3] = 42
+		const 0xFFFFFFFF
+		const unknown
+		storep32			// replace the nop below with an unknown instruction
+		jmp unknown
+	unknown:
+		nop
+	`
+
+	// Moves the stack pointer to the end of target and pushes the bytes of replacement over it
+	stackOverProgramTest = `
+		const target
+		addi 8
+		srstore 1
+		const replacement
+		addi 4
+		loadp32
+		const replacement
+		loadp32
+		jmp target
+	target:
+		nop
+		halt
+	replacement:
+		rload 3
+	`
+
 	errIOTest = `
 	loop:
 		// set up a character input request from console IO device
@@ -173,45 +411,1380 @@ var (
 		const 0x00
 		loadp32
 	`
+
+	// Same setup as memoryAddressSanityCheck2, then stores to and loads from an address past the default
+	// 64 KiB of memory
+	memoryAboveDefaultSizeTest = `
+		addi
+		rstore 3
+
+		rload 1
+		rload 3
+		const 8
+		const 0
+		write 2 2
+		pop 4
+
+		const 1
+		srstore 32
+
+		const 42
+		const 0x20000
+		storep32
+		const 0x20000
+		loadp32
+		rstore 4
+		halt               // not allowed in non-privileged mode, which ends the test
+	`
+
+	customDeviceTest = `
+		const poweroff
+		const 0x10
+		storep32            // set port 4 interrupt handler to be poweroff
+
+		const 0             // no input data
+		const 0             // unused interaction id
+		write 4 2           // port 4 = custom device, command 2 = raise interrupt
+		pop 4
+		halt                // wait for the custom device to interrupt us
+
+	poweroff:
+		const 0             // no data required
+		const 0             // interation id unused
+		write 1 3           // port: 1 (power management unit)
+							// cmd:  3 (perform poweroff)
+		halt
+	`
 )
 
+// Raises an interrupt whenever it receives command 2
+type interruptingDevice struct {
+	DeviceBaseInfo
+}
+
+func (*interruptingDevice) GetInfo() HardwareDeviceInfo {
+	return HardwareDeviceInfo{HWID: 0xFF}
+}
+
+func (d *interruptingDevice) TrySend(id InteractionID, command uint32, _ []byte) StatusCode {
+	if command == 2 {
+		go d.ResponseBus.Send(NewResponse(d.InterruptAddr, id, nil, nil))
+	}
+	return StatusDeviceReady
+}
+
+func (*interruptingDevice) Reset() {}
+
+func (*interruptingDevice) Close() {}
+
+func TestAttachDevice(t *testing.T) {
+	newDevice := func(base DeviceBaseInfo) HardwareDevice {
+		return &interruptingDevice{DeviceBaseInfo: base}
+	}
+
+	vm := compileAndCheckSource(t, customDeviceTest)
+	assert(t, vm.AttachDevice(0, newDevice) != nil, "Expected attaching to an occupied port to fail")
+	assert(t, vm.AttachDevice(maxHWDevices, newDevice) != nil, "Expected attaching to an invalid port to fail")
+	assert(t, vm.AttachDevice(4, newDevice) == nil, "Failed to attach device to free port")
+	assert(t, vm.AttachDevice(4, newDevice) != nil, "Expected attaching to the same port twice to fail")
+
+	runAndEnsureSpecificShutdown(t, vm, ErrSystemShutdown)
+	assert(t, vm.AttachDevice(5, newDevice) != nil, "Expected attaching after the VM started to fail")
+}
+
+func TestInstructionCache(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		vm := compileAndCheckSource(t, selfModifyingTest, WithInstructionCache(enabled))
+		assert(t, (vm.icache.size != 0) == enabled, "Unexpected instruction cache state (enabled %v)", enabled)
+
+		runAndEnsureSpecificShutdown(t, vm, ErrUnknownInstruction)
+		assert(t, vm.registers[3] == 42, "Modified instruction was not used (cache enabled %v): %d", enabled, vm.registers[3])
+
+		// Pushes made after the stack pointer is moved into the program overwrite its instructions
+		vm = compileAndCheckSource(t, stackOverProgramTest, WithInstructionCache(enabled))
+		vm.registers[3] = 42
+		result := vm.Run(context.Background(), RunLimits{StopOnHalt: true})
+		assert(t, result.Reason == StopHalted && uint32FromBytes(vm.peekStack()) == 42, "Pushed instruction was not used (cache enabled %v)", enabled)
+	}
+}
+
+// Runs source until it halts and returns the values it left on the stack (not including the program's 2
+// initial arguments), starting at the top
+func haltedStack(t *testing.T, source string) []uint32 {
+	vm := compileAndCheckSource(t, source+"\nhalt")
+	result := vm.Run(context.Background(), RunLimits{StopOnHalt: true})
+	assert(t, result.Reason == StopHalted, "Unexpected result for %q: %s", source, result)
+	return haltedStackValues(vm)
+}
+
+// Returns the values on the stack (not including the program's 2 initial arguments), starting at the top
+func haltedStackValues(vm *VM) []uint32 {
+	stack := vm.stackBytes()
+	values := make([]uint32, len(stack)/4-2)
+	for i := range values {
+		values[i] = uint32FromBytes(stack[i*4:])
+	}
+	return values
+}
+
+func TestStackOps(t *testing.T) {
+	for _, tc := range []struct {
+		source string
+		stack  []uint32
+	}{
+		{"const 7\ndup", []uint32{7, 7}},
+		{"const 1\nconst 2\nswap", []uint32{1, 2}},
+		{"const 1\nconst 2\nover", []uint32{1, 2, 1}},
+		{"const 1\nconst 2\nconst 3\nrot", []uint32{1, 3, 2}},
+		{"const 1\nconst 2\nconst 3\npick 2", []uint32{1, 3, 2, 1}},
+		{"const 1\nconst 2\nconst 3\nconst 0\npick", []uint32{3, 3, 2, 1}},
+		{"const 5\npick 1", []uint32{24, 5}},
+	} {
+		stack := haltedStack(t, tc.source)
+		assert(t, slices.Equal(stack, tc.stack), "Unexpected stack for %q: %v", tc.source, stack)
+	}
+
+	// Reading past the bottom of the stack is a segmentation fault
+	for _, source := range []string{"pop 4\nrot", "pick 2", "const 0xFFFFFFFF\npick"} {
+		vm := compileAndCheckSource(t, source)
+		runAndEnsureSpecificShutdown(t, vm, ErrSegmentationFault)
+	}
+}
+
+func TestArithmetic(t *testing.T) {
+	f := math.Float32bits
+	for _, tc := range []struct {
+		source string
+		stack  []uint32
+	}{
+		{"const 2\nconst -7\ndivs", []uint32{uint32(0xFFFFFFFD)}},
+		{"const -7\ndivs 2", []uint32{uint32(0xFFFFFFFD)}},
+		{"const 2\nconst -7\ndivu", []uint32{0x7FFFFFFC}},
+		{"const -7\ndivu 2", []uint32{0x7FFFFFFC}},
+		{"const -7\ndivi 2", []uint32{0x7FFFFFFC}},
+		{"const 0x80000000\ndivs -1", []uint32{0x80000000}},
+		{"raddi 3 -9\nrdivs 3 2", []uint32{uint32(0xFFFFFFFC), uint32(0xFFFFFFF7)}},
+		{"raddi 3 -9\nrdivi 3 2", []uint32{0x7FFFFFFB, uint32(0xFFFFFFF7)}},
+		{"const 5\nneg", []uint32{uint32(0xFFFFFFFB)}},
+		{"neg 5", []uint32{uint32(0xFFFFFFFB)}},
+		{"const 1.5\nnegf", []uint32{f(-1.5)}},
+		{"negf -0.0", []uint32{f(0)}},
+		{"const -2.5\nabsf", []uint32{f(2.5)}},
+		{"sqrtf 2.25", []uint32{f(1.5)}},
+		{"const 1\nconst -8\nsar", []uint32{uint32(0xFFFFFFFC)}},
+		{"const -8\nsar 2", []uint32{uint32(0xFFFFFFFE)}},
+		{"const -8\nshiftr 2", []uint32{0x3FFFFFFE}},
+		{"const -3\nitof", []uint32{f(-3)}},
+		{"utof -1", []uint32{f(4294967295)}},
+		{"const -2.75\nftoi", []uint32{uint32(0xFFFFFFFE)}},
+		{"ftoi 100000000000.0\nftoi -100000000000.0\nftoi 2.75", []uint32{2, 0x80000000, 0x7FFFFFFF}},
+		{"ftou -1.5\nftou 100000000000.0\nftou 3000000000.0", []uint32{3000000000, 0xFFFFFFFF, 0}},
+		{"const 0x7FC00000\nftoi\nconst 0x7FC00000\nftou", []uint32{0, 0}},
+		{"floor -1.5\nceil -1.5\nceil 1.25", []uint32{f(2), f(-1), f(-2)}},
+	} {
+		stack := haltedStack(t, tc.source)
+		assert(t, slices.Equal(stack, tc.stack), "Unexpected stack for %q: %v", tc.source, stack)
+	}
+
+	for _, source := range []string{"const 0\nconst 1\ndivu", "const 1\ndivu 0", "const 0\nconst 5\ndivi", "const 1\ndivs 0", "rdivs 3 0"} {
+		vm := compileAndCheckSource(t, source)
+		runAndEnsureSpecificShutdown(t, vm, ErrDivisionByZero)
+	}
+}
+
+var blockMemoryTest = `
+	const 0x44434241
+	const 4096
+	storep32            // 4096: ABCD
+
+	const 4
+	const 4096
+	const 4100
+	memcpy              // 4100: ABCD
+
+	const 4096
+	const 4097
+	memcpy 6            // overlaps, so 4097: AAAAAA
+
+	const 0x5A
+	const 4200
+	memset 3            // 4200: ZZZ
+
+	const 4
+	const 4200
+	const 4201
+	memmove             // 4201: ZZ (the 0 after it moves too)
+
+	const 4096
+	const 4200
+	memcmp 4            // Z > A so 1
+	`
+
+func TestBlockMemory(t *testing.T) {
+	vm := compileAndCheckSource(t, blockMemoryTest+"\nhalt")
+	result := vm.Run(context.Background(), RunLimits{StopOnHalt: true})
+	assert(t, result.Reason == StopHalted, "Unexpected result: %s", result)
+	assert(t, string(vm.memory[4096:4104]) == "AAAAAAAD", "Unexpected memcpy result: %q", vm.memory[4096:4104])
+	assert(t, string(vm.memory[4200:4206]) == "ZZZZ\x00\x00", "Unexpected memset/memmove result: %q", vm.memory[4200:4206])
+	assert(t, uint32FromBytes(vm.peekStack()) == 1, "Unexpected memcmp result: %d", uint32FromBytes(vm.peekStack()))
+
+	for _, tc := range []struct {
+		source string
+		stack  []uint32
+	}{
+		{"const 4096\nconst 4200\nmemcmp 0", []uint32{0}},
+		{"const 8\nconst 4096\nconst 4096\nmemcmp", []uint32{0}},
+		// Byte 2 of the program (the upper byte of the first code) is 0x01 while byte 0 is 0x02 (const)
+		{"const 256\nconst 258\nmemcmp 1", []uint32{0xFFFFFFFF}},
+	} {
+		stack := haltedStack(t, tc.source)
+		assert(t, slices.Equal(stack, tc.stack), "Unexpected stack for %q: %v", tc.source, stack)
+	}
+
+	// The whole range is checked before anything is written
+	vm = compileAndCheckSource(t, "const 1\nconst 65530\nmemset 7")
+	runAndEnsureSpecificShutdown(t, vm, ErrSegmentationFault)
+	assert(t, !slices.ContainsFunc(vm.memory[65530:65532], func(b byte) bool { return b == 1 }), "memset wrote past a segmentation fault")
+	vm = compileAndCheckSource(t, "const 16\nconst 0xFFFFFFF8\nconst 4096\nmemcpy")
+	runAndEnsureSpecificShutdown(t, vm, ErrSegmentationFault)
+
+	// Copying over the program's instructions updates the instruction cache
+	for _, enabled := range []bool{true, false} {
+		vm = compileAndCheckSource(t, "const replacement\nconst target\nmemcpy 8\ntarget:\nnop\nhalt\nreplacement:\nrload 3", WithInstructionCache(enabled))
+		vm.registers[3] = 42
+		result = vm.Run(context.Background(), RunLimits{StopOnHalt: true})
+		assert(t, result.Reason == StopHalted && uint32FromBytes(vm.peekStack()) == 42, "Copied instruction was not used (cache enabled %v)", enabled)
+	}
+}
+
+func TestAtomics(t *testing.T) {
+	for _, tc := range []struct {
+		source string
+		stack  []uint32
+	}{
+		{"const 7\nconst 0\nconst 4096\ncas32\nconst 4096\nloadp32", []uint32{7, 0}},
+		{"const 7\nconst 1\nconst 4096\ncas32\nconst 4096\nloadp32", []uint32{0, 0}},
+		{"const 5\nconst 4096\nxchg32\nconst 6\nconst 4096\nxchg32", []uint32{5, 0}},
+		{"const 3\nconst 4092\nfetchadd32 4\nconst -1\nconst 4096\nfetchadd32\nconst 4096\nloadp32", []uint32{2, 3, 0}},
+	} {
+		stack := haltedStack(t, tc.source)
+		assert(t, slices.Equal(stack, tc.stack), "Unexpected stack for %q: %v", tc.source, stack)
+	}
+
+	vm := compileAndCheckSource(t, "const 1\nconst 0xFFFFFFFE\nxchg32")
+	runAndEnsureSpecificShutdown(t, vm, ErrSegmentationFault)
+
+	// Exchanging an instruction updates the instruction cache
+	for _, enabled := range []bool{true, false} {
+		vm = compileAndCheckSource(t, "const replacement\nloadp32\nconst target\nxchg32\ntarget:\nnop\nhalt\nreplacement:\nrload 3", WithInstructionCache(enabled))
+		vm.registers[3] = 42
+		result := vm.Run(context.Background(), RunLimits{StopOnHalt: true})
+		assert(t, result.Reason == StopHalted && uint32FromBytes(vm.peekStack()) == 42, "Exchanged instruction was not used (cache enabled %v)", enabled)
+	}
+}
+
+var interruptsDisabledTest = `
+	cli
+	const poweroff
+	const 0x10
+	storep32            // set port 4 interrupt handler to be poweroff
+
+	const 0
+	const 0
+	write 4 2           // port 4 = custom device, command 2 = raise interrupt
+	pop 4
+	halt                // interrupts are disabled, so this never wakes up
+	sti
+	halt
+
+poweroff:
+	const 0
+	const 0
+	write 1 3
+	halt
+	`
+
+func TestInterruptsDisabled(t *testing.T) {
+	device := WithDevice(4, func(base DeviceBaseInfo) HardwareDevice {
+		return &interruptingDevice{DeviceBaseInfo: base}
+	})
+	vm := compileAndCheckSource(t, interruptsDisabledTest, device)
+
+	result := vm.Run(context.Background(), RunLimits{StopOnHalt: true})
+	assert(t, result.Reason == StopHalted && vm.interruptsDisabled, "Unexpected result: %s", result)
+	haltAddr := result.PC
+
+	for start := time.Now(); !vm.responseBus.Ready(); time.Sleep(time.Millisecond) {
+		assert(t, time.Since(start) < time.Second, "Device never raised its interrupt")
+	}
+
+	// The response waits on the bus instead of waking up the halt
+	result = vm.Run(context.Background(), RunLimits{StopOnHalt: true})
+	assert(t, result.Reason == StopHalted && result.PC == haltAddr && vm.responseBus.Ready(), "Unexpected result: %s", result)
+
+	restored := snapshotAndRestore(t, vm, device)
+	assert(t, restored.interruptsDisabled && restored.started && restored.responseBus.Ready(), "Restored VM lost its state")
+
+	// Move past the halt so that sti runs
+	*vm.pc += instructionBytes
+	result = vm.Run(context.Background(), RunLimits{})
+	assert(t, result.Reason == StopShutdown, "Unexpected result: %s", result)
+
+	for _, source := range []string{"const 1\nsrstore 32\ncli", "const 1\nsrstore 32\nsti"} {
+		vm = compileAndCheckSource(t, source)
+		runAndEnsureSpecificShutdown(t, vm, ErrIllegalInstruction)
+	}
+}
+
+var (
+	// Both lines share a handler that appends the in service bits to a log at 4096 (8192 holds its size)
+	interruptControllerSetup = `
+	const logInService
+	const 0x10
+	storep32
+	const logInService
+	const 0x14
+	storep32
+	`
+
+	interruptControllerHandler = `
+logInService:
+	srload 36
+	const 4
+	const 8192
+	fetchadd32
+	const 4096
+	addi
+	storep32
+	resume
+	`
+
+	// Raises both interrupts while they're masked and waits until they're pending
+	interruptControllerRaise = `
+	const 0x30
+	srstore 34
+
+	const 0
+	const 0
+	write 4 2
+	pop 4
+	const 0
+	const 0
+	write 5 2
+	pop 4
+
+wait:
+	srload 35
+	const 0x30
+	cmpu
+	jnz wait
+	`
+
+	interruptPriorityTest = interruptControllerSetup + `
+	const 0x00210000
+	srstore 37          // line 4 has priority 1 and line 5 has priority 2
+	` + interruptControllerRaise + `
+	const 0
+	srstore 34          // line 5 goes first, and line 4 waits until its handler resumes
+	halt
+	` + interruptControllerHandler
+
+	interruptEndTest = interruptControllerSetup + `
+	const 1
+	srstore 39          // only end interrupts through sr 36
+	` + interruptControllerRaise + `
+	const 0
+	srstore 34          // one of the lines is delivered, the other waits since they have the same priority
+	srload 36
+	srload 35
+	const 0x30
+	srstore 36          // end of interrupt for both lines
+	halt
+	` + interruptControllerHandler
+
+	interruptNestingTest = `
+	const handler4
+	const 0x10
+	storep32
+	const logInService
+	const 0x14
+	storep32
+	const 0x00210000
+	srstore 37
+
+	const 0
+	const 0
+	write 4 2
+	pop 4
+	halt
+
+handler4:
+	srload 36
+	const 4096
+	storep32
+	const 4
+	const 8192
+	storep32
+
+	const 0
+	const 0
+	write 5 2           // line 5 has a higher priority, so it interrupts this handler
+	pop 4
+wait:
+	const 8192
+	loadp32
+	const 8
+	cmpu
+	jnz wait
+
+	const 0
+	const 0
+	write 1 3
+	halt
+	` + interruptControllerHandler
+)
+
+func TestInterruptController(t *testing.T) {
+	newDevice := func(base DeviceBaseInfo) HardwareDevice {
+		return &interruptingDevice{DeviceBaseInfo: base}
+	}
+	devices := []VMOption{WithDevice(4, newDevice), WithDevice(5, newDevice)}
+	logged := func(vm *VM) []uint32 {
+		log := make([]uint32, uint32FromBytes(vm.memory[8192:])/4)
+		for i := range log {
+			log[i] = uint32FromBytes(vm.memory[4096+4*i:])
+		}
+		return log
+	}
+	limits := RunLimits{StopOnHalt: true, Deadline: time.Now().Add(5 * time.Second)}
+
+	vm := compileAndCheckSource(t, interruptPriorityTest, devices...)
+	result := vm.Run(context.Background(), limits)
+	assert(t, result.Reason == StopHalted, "Unexpected result: %s", result)
+	assert(t, slices.Equal(logged(vm), []uint32{0x20, 0x10}), "Unexpected interrupt order: %v", logged(vm))
+	assert(t, vm.registers[picInServiceRegister] == 0, "Lines still in service: %x", vm.registers[picInServiceRegister])
+
+	// Whichever line was sent first is delivered first, and the other one waits for the end of interrupt
+	vm = compileAndCheckSource(t, interruptEndTest, devices...)
+	result = vm.Run(context.Background(), limits)
+	assert(t, result.Reason == StopHalted, "Unexpected result: %s", result)
+	stack, log := haltedStackValues(vm), logged(vm)
+	assert(t, len(log) == 2 && stack[1]|stack[0] == 0x30 && log[0] == stack[1] && log[1] == stack[0], "Unexpected log %v and stack %v", log, stack)
+	assert(t, vm.registers[picInServiceRegister] == log[1], "Resume ended the interrupt: %x", vm.registers[picInServiceRegister])
+
+	restored := snapshotAndRestore(t, vm, devices...)
+	assert(t, restored.interruptFrames == vm.interruptFrames, "Restored VM has different interrupt frames")
+
+	vm = compileAndCheckSource(t, interruptNestingTest, devices...)
+	limits.StopOnHalt = false
+	result = vm.Run(context.Background(), limits)
+	assert(t, result.Reason == StopShutdown, "Unexpected result: %s", result)
+	assert(t, slices.Equal(logged(vm), []uint32{0x10, 0x30}), "Unexpected nested interrupts: %v", logged(vm))
+}
+
+func TestRunLimits(t *testing.T) {
+	// Budgets are exact, so the program stops in the same place every time and can be continued
+	vm := compileAndCheckSource(t, stackOverflowTest)
+	result := vm.Run(context.Background(), RunLimits{MaxInstructions: 1001})
+	assert(t, result.Reason == StopBudget && result.Instructions == 1001, "Unexpected result: %s", result)
+	assert(t, result.PC == vm.loadAddr+instructionBytes && len(vm.stackBytes()) == 8+501*4, "Program did not stop after the last instruction in the budget: %s", result)
+
+	result = vm.Run(context.Background(), RunLimits{MaxInstructions: 1})
+	assert(t, result.Reason == StopBudget && result.PC == vm.loadAddr, "Unexpected result after continuing: %s", result)
+
+	// Without a budget the stack eventually overflows
+	result = vm.Run(context.Background(), RunLimits{})
+	assert(t, result.Reason == StopFault && errors.Is(result.Err, ErrSegmentationFault), "Unexpected result: %s", result)
+
+	vm = compileAndCheckSource(t, "loop:\njmp loop")
+	result = vm.Run(context.Background(), RunLimits{Deadline: time.Now().Add(10 * time.Millisecond)})
+	assert(t, result.Reason == StopDeadline && result.Instructions > 0, "Unexpected result: %s", result)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	result = vm.Run(ctx, RunLimits{})
+	assert(t, result.Reason == StopCanceled && result.Instructions == 0 && result.Err == context.Canceled, "Unexpected result: %s", result)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	result = vm.Run(ctx, RunLimits{})
+	assert(t, result.Reason == StopCanceled && result.Err == context.DeadlineExceeded, "Unexpected result: %s", result)
+
+	vm = compileAndCheckSource(t, "nop\nhalt")
+	result = vm.Run(context.Background(), RunLimits{StopOnHalt: true})
+	assert(t, result.Reason == StopHalted && result.Instructions == 2 && result.PC == vm.loadAddr+instructionBytes, "Unexpected result: %s", result)
+
+	// Continuing after a halt waits for the timer interrupt
+	vm = compileAndCheck(t, "../examples/poweroff.b")
+	result = vm.Run(context.Background(), RunLimits{StopOnHalt: true})
+	assert(t, result.Reason == StopHalted, "Unexpected result: %s", result)
+	result = vm.Run(context.Background(), RunLimits{})
+	assert(t, result.Reason == StopShutdown, "Unexpected result: %s", result)
+
+	vm = compileAndCheckSource(t, divByZeroTest1)
+	result = vm.Run(context.Background(), RunLimits{})
+	assert(t, result.Reason == StopFault && errors.Is(result.Err, ErrDivisionByZero) && result.PC == vm.loadAddr+2*instructionBytes, "Unexpected result: %s", result)
+}
+
+// Takes a snapshot of the VM and reads it back with the given options
+func snapshotAndRestore(t *testing.T, vm *VM, options ...VMOption) *VM {
+	var snapshot bytes.Buffer
+	err := vm.WriteSnapshot(&snapshot)
+	assert(t, err == nil, "Failed to write snapshot: %s", err)
+
+	restored, err := ReadSnapshot(&snapshot, options...)
+	assert(t, err == nil, "Failed to read snapshot: %s", err)
+	return restored
+}
+
+func TestSnapshot(t *testing.T) {
+	files := []string{"../examples/input.b"}
+	stdout := &strings.Builder{}
+	vm := compileAndCheckWithOptions(t, files, []VMOption{WithStdout(stdout), WithStdin(strings.NewReader("hey\n"))})
+	runAndEnsureSpecificShutdown(t, vm, ErrSystemShutdown)
+	expected := stdout.String()
+
+	// Stop partway through printing the prompt (before any input is read) and continue from a snapshot
+	stdout.Reset()
+	vm = compileAndCheckWithOptions(t, files, []VMOption{WithStdout(stdout)})
+	result := vm.Run(context.Background(), RunLimits{MaxInstructions: 500})
+	assert(t, result.Reason == StopBudget && stdout.Len() > 0 && stdout.Len() < len(expected), "Unexpected result: %s (output %q)", result, stdout.String())
+
+	restoredOut := &strings.Builder{}
+	restored := snapshotAndRestore(t, vm, WithStdout(restoredOut), WithStdin(strings.NewReader("hey\n")))
+	assert(t, restored.registers == vm.registers && bytes.Equal(restored.memory, vm.memory), "Registers or memory were not restored")
+	assert(t, restored.icache.size == vm.icache.size && restored.loadAddr == vm.loadAddr, "Program layout was not restored")
+	runAndEnsureSpecificShutdown(t, restored, ErrSystemShutdown)
+	assert(t, stdout.String()+restoredOut.String() == expected, "Unexpected output after restoring: %q + %q", stdout.String(), restoredOut.String())
+
+	// Pending timers are restored along with the time they had left
+	vm = compileAndCheckWithOptions(t, []string{"../examples/poweroff.b"}, []VMOption{WithMemorySize(8192)})
+	result = vm.Run(context.Background(), RunLimits{StopOnHalt: true})
+	assert(t, result.Reason == StopHalted, "Unexpected result: %s", result)
+	restored = snapshotAndRestore(t, vm)
+	assert(t, len(restored.memory) == 8192, "Memory size was not restored: %d", len(restored.memory))
+	timer := restored.devices[0].(*systemTimer)
+	assert(t, timer.armed && timer.iid == 123 && time.Until(timer.deadline) > 0, "Timer was not restored")
+	result = restored.Run(context.Background(), RunLimits{})
+	assert(t, result.Reason == StopShutdown, "Unexpected result after restoring: %s", result)
+
+	// A snapshot taken while a timer fires has either the pending timer or its response, never both.
+	// The bus starts out full so that the timer has to wait before its response can be sent.
+	vm = compileAndCheck(t, "../examples/poweroff.b")
+	result = vm.Run(context.Background(), RunLimits{StopOnHalt: true})
+	assert(t, result.Reason == StopHalted, "Unexpected result: %s", result)
+	vm.responseBus.Send(NewResponse(0, 1, nil, nil))
+	vm.devices[0].(*systemTimer).arm(123, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+
+	// The timer's state comes after the device count, its port and HWID, the state flag and the state's length
+	timerArmed := func(devices []byte) bool { return uint32FromBytes(devices[17:]) != 0 }
+	devices, responses, err := vm.encodeSnapshotDevicesAndResponses()
+	assert(t, err == nil, "Failed to save devices: %s", err)
+	assert(t, timerArmed(devices) && uint32FromBytes(responses) == 1, "Expected an expired timer to stay armed while the bus is full")
+
+	// Saving the responses takes them off of the bus, which makes room for the timer's
+	for start := time.Now(); ; {
+		assert(t, time.Since(start) < time.Second, "Timer never fired")
+		devices, responses, err = vm.encodeSnapshotDevicesAndResponses()
+		assert(t, err == nil, "Failed to save devices: %s", err)
+		fired := uint32FromBytes(responses) == 2
+		assert(t, timerArmed(devices) != fired, "Timer is armed: %t, response is pending: %t", timerArmed(devices), fired)
+		if fired {
+			break
+		}
+	}
+
+	// Responses that haven't been received yet are delivered after restoring, and the devices have to
+	// match
+	newDevice := func(base DeviceBaseInfo) HardwareDevice {
+		return &interruptingDevice{DeviceBaseInfo: base}
+	}
+	vm = compileAndCheckSource(t, customDeviceTest, WithDevice(4, newDevice), WithDevice(0, nil))
+	result = vm.Run(context.Background(), RunLimits{StopOnHalt: true})
+	assert(t, result.Reason == StopHalted, "Unexpected result: %s", result)
+	for !vm.responseBus.Ready() {
+		time.Sleep(time.Millisecond)
+	}
+
+	var snapshot bytes.Buffer
+	err = vm.WriteSnapshot(&snapshot)
+	assert(t, err == nil, "Failed to write snapshot: %s", err)
+	_, err = ReadSnapshot(bytes.NewReader(snapshot.Bytes()), WithDevice(0, nil))
+	assert(t, err != nil && strings.Contains(err.Error(), "port 4"), "Expected a missing device to fail: %v", err)
+	_, err = ReadSnapshot(bytes.NewReader(snapshot.Bytes()), WithDevice(4, newDevice))
+	assert(t, err != nil && strings.Contains(err.Error(), "port 0"), "Expected an extra device to fail: %v", err)
+	_, err = ReadSnapshot(bytes.NewReader(snapshot.Bytes()[:len(snapshot.Bytes())-1]), WithDevice(4, newDevice), WithDevice(0, nil))
+	assert(t, errors.Is(err, errInvalidSnapshot), "Expected a truncated snapshot to fail: %v", err)
+
+	restored, err = ReadSnapshot(bytes.NewReader(snapshot.Bytes()), WithDevice(4, newDevice), WithDevice(0, nil))
+	assert(t, err == nil, "Failed to read snapshot: %s", err)
+	runAndEnsureSpecificShutdown(t, restored, ErrSystemShutdown)
+
+	// The original VM is unaffected by taking the snapshot
+	runAndEnsureSpecificShutdown(t, vm, ErrSystemShutdown)
+}
+
+func TestRunError(t *testing.T) {
+	vm := compileAndCheckSource(t, divByZeroTest1)
+	err := vm.RunProgram()
+
+	var runErr *RunError
+	assert(t, errors.As(err, &runErr), "Expected a RunError but got %v", err)
+	assert(t, errors.Is(err, ErrDivisionByZero) && !errors.Is(err, ErrSegmentationFault), "RunError does not unwrap to the right error: %v", err)
+	assert(t, runErr.PC == vm.loadAddr+2*instructionBytes && runErr.Instruction.String() == "divi", "Unexpected instruction: %d %s", runErr.PC, runErr.Instruction)
+	assert(t, runErr.Mode == 0, "Unexpected CPU mode: %d", runErr.Mode)
+	// divi has popped the 1 and left the 0, which is on top of the 2 initial arguments (program size and
+	// load address)
+	assert(t, slices.Equal(runErr.Stack, slices.Concat(make([]byte, 4), []byte{24, 0, 0, 0}, []byte{0, 1, 0, 0})), "Unexpected stack: %v", runErr.Stack)
+	assert(t, err.Error() == fmt.Sprintf("division by zero %d: divi", runErr.PC), "Unexpected error message: %s", err)
+
+	// Debug symbols show the original source
+	program, compileErr := CompileSourceFromBuffer(true, strings.Split(illegalInstrTest, "\n"))
+	assert(t, compileErr == nil, "Failed to compile: %s", compileErr)
+	vm, compileErr = NewVirtualMachine(program, WithStdout(io.Discard))
+	assert(t, compileErr == nil, "Failed to create new VM: %s", compileErr)
+	err = vm.RunProgram()
+	assert(t, errors.As(err, &runErr) && errors.Is(err, ErrIllegalInstruction), "Unexpected error: %v", err)
+	assert(t, runErr.Mode == 1 && runErr.Source == "write 0 0", "Unexpected mode or source: %d %q", runErr.Mode, runErr.Source)
+}
+
+func TestVMOptions(t *testing.T) {
+	stdout := &strings.Builder{}
+	vm := compileAndCheckWithOptions(t, []string{"../examples/runtime.b", "../examples/helloworld.b"}, []VMOption{WithStdout(stdout)})
+	runAndEnsureSpecificShutdown(t, vm, ErrSystemShutdown)
+	assert(t, stdout.String() == "Hello world!\n", "Unexpected program output: %q", stdout.String())
+
+	stdout.Reset()
+	vm = compileAndCheckWithOptions(t, []string{"../examples/runtime.b", "../examples/input.b"}, []VMOption{WithStdout(stdout), WithStdin(strings.NewReader("hi\n"))})
+	runAndEnsureSpecificShutdown(t, vm, ErrSystemShutdown)
+	assert(t, strings.HasSuffix(stdout.String(), ":\nhi\n"), "Unexpected program output: %q", stdout.String())
+
+	// Programs with debug symbols write to stdout as well as to the output the debugger shows
+	stdout.Reset()
+	program, err := CompileSource(true, "../examples/runtime.b", "../examples/helloworld.b")
+	assert(t, err == nil, "Failed to compile: %s", err)
+	vm, err = NewVirtualMachine(program, WithStdout(stdout))
+	assert(t, err == nil, "Failed to create new VM: %s", err)
+	runAndEnsureSpecificShutdown(t, vm, ErrSystemShutdown)
+	assert(t, stdout.String() == "Hello world!\n" && vm.debugOut.String() == stdout.String(), "Unexpected program output: %q", stdout.String())
+
+	vm = compileAndCheckSource(t, memoryAddressSanityCheck1, WithMemorySize(minHeapSizeBytes))
+	assert(t, len(vm.memory) == int(minHeapSizeBytes), "Unexpected memory size: %d", len(vm.memory))
+	assert(t, *vm.sp == uint32(minHeapSizeBytes-uint64(varchBytesx2)), "Stack did not start at the top of memory: %d", *vm.sp)
+	runAndEnsureSpecificShutdown(t, vm, ErrSystemShutdown)
+
+	vm = compileAndCheckSource(t, deviceCheck, WithDevice(3, nil))
+	runAndEnsureSpecificShutdown(t, vm, ErrDivisionByZero)
+
+	vm = compileAndCheckSource(t, illegalInstrTest, WithPrivilegeMode(1))
+	runAndEnsureSpecificShutdown(t, vm, ErrIllegalInstruction)
+
+	program, _ = CompileSourceFromBuffer(false, []string{"nop"})
+	_, err = NewVirtualMachine(program, WithMemorySize(minHeapSizeBytes-1))
+	assert(t, err != nil, "Expected invalid memory size to fail")
+	_, err = NewVirtualMachine(program, WithDevice(2, nil))
+	assert(t, err != nil, "Expected replacing memory management unit to fail")
+}
+
+func TestMemorySize(t *testing.T) {
+	// 1 MB of memory
+	stdout := &strings.Builder{}
+	vm := compileAndCheckWithOptions(t, []string{"../examples/runtime.b", "../examples/helloworld.b"}, []VMOption{WithMemorySize(1<<20), WithStdout(stdout)})
+	assert(t, *vm.sp == 1<<20-varchBytesx2, "Stack did not start at the top of memory: %d", *vm.sp)
+	runAndEnsureSpecificShutdown(t, vm, ErrSystemShutdown)
+	assert(t, stdout.String() == "Hello world!\n", "Unexpected program output: %q", stdout.String())
+
+	// Non-privileged code should be able to use memory past the default size
+	vm = compileAndCheckSource(t, memoryAboveDefaultSizeTest, WithMemorySize(1<<20))
+	runAndEnsureSpecificShutdown(t, vm, ErrIllegalInstruction)
+	assert(t, *vm.mode == 1 && vm.registers[4] == 42, "Value was not stored above the default memory size: %d", vm.registers[4])
+	assert(t, uint32FromBytes(vm.memory[0x20000:]) == 42, "Unexpected memory contents: %v", vm.memory[0x20000:0x20004])
+
+	// The memory bounds still apply
+	vm = compileAndCheckSource(t, memoryAddressSanityCheck2, WithMemorySize(1<<20))
+	runAndEnsureSpecificShutdown(t, vm, ErrSegmentationFault)
+
+	_, err := NewVirtualMachine(Program{}, WithMemorySize(maxHeapSizeBytes+1))
+	assert(t, err != nil, "Expected memory size larger than the 32-bit address space to fail")
+
+	// Needs 4 GiB of memory, so it only runs when asked for
+	if os.Getenv("GVM_TEST_FULL_MEMORY") == "" {
+		t.Skip("skipping full 32-bit address space test (set GVM_TEST_FULL_MEMORY=1 to run it)")
+	}
+
+	// Full 32-bit address space (stack top wraps around to 0)
+	stdout.Reset()
+	vm = compileAndCheckWithOptions(t, []string{"../examples/runtime.b", "../examples/helloworld.b"}, []VMOption{WithMemorySize(maxHeapSizeBytes), WithStdout(stdout)})
+	assert(t, *vm.sp == math.MaxUint32-varchBytesx2+1, "Stack did not start at the top of memory: %d", *vm.sp)
+	runAndEnsureSpecificShutdown(t, vm, ErrSystemShutdown)
+	assert(t, stdout.String() == "Hello world!\n", "Unexpected program output: %q", stdout.String())
+}
+
+func TestProgramImage(t *testing.T) {
+	for _, debug := range []bool{false, true} {
+		program, err := CompileSource(debug, "../examples/runtime.b", "../examples/helloworld.b")
+		assert(t, err == nil, "Failed to compile: %s", err)
+		assert(t, string(program.data) == "Hello world!\n\x00", "Unexpected static data: %q", program.data)
+
+		image := &bytes.Buffer{}
+		assert(t, program.WriteImage(image) == nil, "Failed to write image")
+		assert(t, bytes.HasPrefix(image.Bytes(), imageMagic[:]), "Image is missing magic number")
+
+		loaded, err := ReadImage(bytes.NewReader(image.Bytes()))
+		assert(t, err == nil, "Failed to read image: %s", err)
+		assert(t, reflect.DeepEqual(program, loaded), "Program changed after writing and reading image")
+
+		stdout := &strings.Builder{}
+		vm, err := NewVirtualMachine(loaded, WithStdout(stdout), WithDebugSymbols(false))
+		assert(t, err == nil, "Failed to create new VM: %s", err)
+
+		// Static data should sit directly after the instructions
+		dataAddr := reservedBytes + uint32(len(program.instructions))*instructionBytes
+		assert(t, string(vm.memory[dataAddr:dataAddr+uint32(len(program.data))]) == string(program.data), "Static data not loaded after instructions")
+
+		runAndEnsureSpecificShutdown(t, vm, ErrSystemShutdown)
+		assert(t, stdout.String() == "Hello world!\n", "Unexpected program output: %q", stdout.String())
+
+		// Truncating the image anywhere should be detected
+		_, err = ReadImage(bytes.NewReader(image.Bytes()[:image.Len()-1]))
+		assert(t, errors.Is(err, errInvalidImage), "Expected truncated image to fail: %s", err)
+	}
+
+	_, err := ReadImage(strings.NewReader("not an image at all"))
+	assert(t, errors.Is(err, errInvalidImage), "Expected bad magic number to fail: %s", err)
+}
+
+func TestLink(t *testing.T) {
+	runtime, err := (&Assembler{}).AssembleFiles("../examples/runtime.b")
+	assert(t, err == nil, "Failed to assemble runtime: %s", err)
+	assert(t, slices.Equal(runtime.imports, []string{"main"}), "Unexpected runtime imports: %v", runtime.imports)
+	assert(t, runtime.symbols["fmt.Print"].exported && !runtime.symbols["runtime.__writeBytes"].exported, "Wrong runtime symbols exported")
+
+	// Objects should come back the same after writing and reading them
+	objFile := &bytes.Buffer{}
+	assert(t, runtime.WriteObject(objFile) == nil, "Failed to write object")
+	loaded, err := ReadObject(bytes.NewReader(objFile.Bytes()))
+	assert(t, err == nil, "Failed to read object: %s", err)
+	assert(t, reflect.DeepEqual(runtime, loaded), "Object changed after writing and reading it")
+
+	_, err = ReadObject(bytes.NewReader(objFile.Bytes()[:objFile.Len()-1]))
+	assert(t, errors.Is(err, errInvalidObject), "Expected truncated object to fail: %s", err)
+
+	program, err := (&Assembler{}).AssembleBuffer(strings.Split(linkTest, "\n"))
+	assert(t, err == nil, "Failed to assemble program: %s", err)
+	assert(t, slices.Equal(program.imports, []string{"fmt.Print"}), "Unexpected program imports: %v", program.imports)
+
+	linkMap := &strings.Builder{}
+	linked, err := Link([]*Object{loaded, program}, LinkOptions{LoadAddress: 0x1000, Map: linkMap})
+	assert(t, err == nil, "Failed to link: %s", err)
+	assert(t, linked.loadAddr == 0x1000 && linked.entryPoint == 0x1000, "Program not placed at the load address")
+
+	// Every address in the program should have been moved to where the sections ended up
+	mainAddr := 0x1000 + uint32(len(runtime.instructions))*instructionBytes
+	dataAddr := mainAddr + uint32(len(program.instructions))*instructionBytes
+	printAddr := 0x1000 + uint32(runtime.symbols["fmt.Print"].offset)
+	assert(t, linked.instructions[len(runtime.instructions)].arg == dataAddr, "Data label was not relocated")
+	assert(t, uint32FromBytes(linked.data[16:]) == printAddr, "Imported symbol in data was not relocated")
+	assert(t, uint32FromBytes(linked.data[20:]) == mainAddr+16, "Text label in data was not relocated")
+
+	assert(t, strings.Contains(linkMap.String(), "Load address: 0x00001000"), "Map is missing the load address")
+	assert(t, strings.Contains(linkMap.String(), fmt.Sprintf("0x%08X  global  main  (<buffer>)", mainAddr)), "Map is missing main:\n%s", linkMap)
+	assert(t, strings.Contains(linkMap.String(), fmt.Sprintf("0x%08X  local   message  (<buffer>)", dataAddr)), "Map is missing message:\n%s", linkMap)
+
+	stdout := &strings.Builder{}
+	vm, err := NewVirtualMachine(linked, WithStdout(stdout))
+	assert(t, err == nil, "Failed to create new VM: %s", err)
+	assert(t, string(vm.memory[dataAddr:dataAddr+13]) == "Linked hello\n", "Static data not loaded after instructions")
+	runAndEnsureSpecificShutdown(t, vm, ErrSystemShutdown)
+	assert(t, stdout.String() == "Linked hello\n", "Unexpected program output: %q", stdout.String())
+
+	for _, tc := range []struct {
+		objects []*Object
+		options LinkOptions
+		err     string
+	}{
+		{[]*Object{program}, LinkOptions{}, "undefined symbol fmt.Print (imported by <buffer>)"},
+		{[]*Object{runtime, program, program}, LinkOptions{}, "symbol main is exported by both <buffer> and <buffer>"},
+		{[]*Object{runtime, program}, LinkOptions{LoadAddress: 16}, "load address 0x10 overlaps the interrupt vector table"},
+		{[]*Object{runtime, program}, LinkOptions{LoadAddress: 0x1004}, "load address 0x1004 is not a multiple of 8"},
+	} {
+		_, err := Link(tc.objects, tc.options)
+		assert(t, err != nil && strings.Contains(err.Error(), tc.err), "Expected %q, got: %v", tc.err, err)
+	}
+
+	for source, want := range map[string]string{
+		".global missing":      "exported symbol missing is not defined",
+		".extern":              ".extern wanted at least 1 name",
+		".global 1abc":         "invalid symbol name: 1abc",
+		".extern x\nraddi x 1": "can't take an address as its first argument",
+		".extern x\nconst x*2": "operator * can't be used on an address",
+	} {
+		_, err := (&Assembler{}).AssembleBuffer(strings.Split(source, "\n"))
+		assert(t, err != nil && strings.Contains(err.Error(), want), "Expected %q for %q, got: %v", want, source, err)
+	}
+}
+
+func TestDisassemble(t *testing.T) {
+	program, err := CompileSource(false, "../examples/runtime.b", "../examples/input.b")
+	assert(t, err == nil, "Failed to compile: %s", err)
+
+	source := &strings.Builder{}
+	assert(t, program.Disassemble(source) == nil, "Failed to disassemble program")
+
+	reassembled, err := CompileSourceFromBuffer(false, strings.Split(source.String(), "\n"))
+	assert(t, err == nil, "Failed to reassemble disassembled program: %s", err)
+	assert(t, reflect.DeepEqual(program.instructions, reassembled.instructions), "Reassembled program does not match original")
+	assert(t, strings.Contains(source.String(), "\nivt.port3:\n") && strings.Contains(source.String(), "    const ivt.port3\n"),
+		"Interrupt handler installed by the program was not shown symbolically:\n%s", source)
+
+	// Run the program so that the runtime fills in the interrupt vector table, then disassemble memory
+	vm := compileAndCheckWithOptions(t, []string{"../examples/runtime.b", "../examples/helloworld.b"}, []VMOption{WithStdout(&strings.Builder{})})
+	runAndEnsureSpecificShutdown(t, vm, ErrSystemShutdown)
+
+	dump := &bytes.Buffer{}
+	assert(t, vm.WriteMemoryDump(dump) == nil, "Failed to dump memory")
+
+	source.Reset()
+	assert(t, DisassembleMemory(dump.Bytes(), source) == nil, "Failed to disassemble memory dump")
+	assert(t, strings.Contains(source.String(), "\nivt.port3:\n"), "Console IO interrupt handler was not labeled")
+	assert(t, strings.Contains(source.String(), "const ivt.public_0xA8"), "Interrupt handler address was not shown symbolically")
+
+	reassembled, err = CompileSourceFromBuffer(false, strings.Split(source.String(), "\n"))
+	assert(t, err == nil, "Failed to reassemble disassembled memory dump: %s", err)
+	assert(t, len(reassembled.instructions) == len(vm.memory[reservedBytes:reservedBytes+vm.processInstructionBytes])/int(instructionBytes),
+		"Memory dump disassembly has the wrong number of instructions")
+	assert(t, strings.Contains(source.String(), "\n.data\n") && strings.Contains(source.String(), "const D_"), "Static data was not disassembled:\n%s", source)
+
+	// The static data comes along, so the reassembled program still prints the message
+	stdout := &strings.Builder{}
+	vm, err = NewVirtualMachine(reassembled, WithStdout(stdout))
+	assert(t, err == nil, "Failed to create new VM: %s", err)
+	runAndEnsureSpecificShutdown(t, vm, ErrSystemShutdown)
+	assert(t, stdout.String() == "Hello world!\n", "Unexpected output from reassembled memory dump: %q", stdout.String())
+}
+
+func TestDiagnostics(t *testing.T) {
+	_, err := CompileSourceFromBuffer(false, strings.Split(diagnosticsTest, "\n"))
+	var diagnostics Diagnostics
+	assert(t, errors.As(err, &diagnostics), "Expected assembling to fail with diagnostics: %v", err)
+
+	// Every error should be reported (not just the first one) in source order, even though the label
+	// error is found before the others
+	expected := []string{
+		"<buffer>:3:3: error: unknown bytecode: consts",
+		"<buffer>:4:3: error: rstore wanted 1 args but only got 0",
+		"<buffer>:5:9: error: undefined symbol: nowhere",
+		"<buffer>:6:11: error: invalid number: 0xZZ",
+		"<buffer>:7:10: error: illegal register write (reg < 3): rstore 1",
+		"<buffer>:10:3: error: label start redefined (previous definition at <buffer>:2)",
+	}
+	assert(t, len(diagnostics) == len(expected), "Expected %d diagnostics but got %d:\n%s", len(expected), len(diagnostics), diagnostics)
+	for i, want := range expected {
+		assert(t, diagnostics[i].String() == want, "Expected diagnostic %q but got %q", want, diagnostics[i])
+	}
+
+	// Warnings alone shouldn't stop a program from assembling
+	program, err := CompileSourceFromBuffer(false, []string{".define A 1", ".equ A 2", "push A", "halt"})
+	assert(t, err == nil, "Failed to compile: %s", err)
+	want := "<buffer>:2:6: warning: constant A shadows the global constant defined at <buffer>:1"
+	assert(t, len(program.Warnings()) == 1 && program.Warnings()[0].String() == want, "Expected %q but got %v", want, program.Warnings())
+	assert(t, program.instructions[0].arg == 2, "File constant should take priority over the global constant: %s", program.instructions[0])
+
+	// File names and line numbers should be tracked per source file
+	badFile := filepath.Join(t.TempDir(), "bad.b")
+	assert(t, os.WriteFile(badFile, []byte("main:\n\n    pushh 1\n"), 0644) == nil, "Failed to write source file")
+	_, err = CompileSource(false, "../examples/runtime.b", badFile)
+	want = badFile + ":3:5: error: unknown bytecode: pushh"
+	assert(t, err != nil && err.Error() == want, "Expected %q but got %v", want, err)
+}
+
+func TestConstants(t *testing.T) {
+	program, err := CompileSourceFromBuffer(false, strings.Split(constantsTest, "\n"))
+	assert(t, err == nil, "Failed to compile: %s", err)
+	assert(t, program.instructions[0].arg == 3, "Constant defined in terms of another constant was not resolved: %s", program.instructions[0])
+	assert(t, program.instructions[1].register == 4, "Constant was not resolved as a register: %s", program.instructions[1])
+
+	vm, err := NewVirtualMachine(program)
+	assert(t, err == nil, "Failed to create new VM: %s", err)
+	vm.RunProgram()
+	assert(t, vm.registers[4] == '\n', "Unexpected register value: %d", vm.registers[4])
+
+	// .define is visible in every file but .equ is only visible in the file that defines it
+	dir := t.TempDir()
+	defines, uses := filepath.Join(dir, "defines.b"), filepath.Join(dir, "uses.b")
+	assert(t, os.WriteFile(defines, []byte(".define GLOBAL 1\n.equ LOCAL 2\n"), 0644) == nil, "Failed to write source file")
+	assert(t, os.WriteFile(uses, []byte(".equ GLOBAL 5\nconst GLOBAL\nconst LOCAL\n"), 0644) == nil, "Failed to write source file")
+	_, err = CompileSource(false, defines, uses)
+	assert(t, err != nil && strings.Contains(err.Error(), uses+":3:7: error: undefined symbol: LOCAL"), "Expected .equ to be file scoped: %v", err)
+
+	_, err = CompileSource(false, uses, defines)
+	assert(t, err != nil && strings.Contains(err.Error(), uses+":3:7"), "Expected .equ to be file scoped: %v", err)
+
+	expected := []string{
+		"<buffer>:3:11: error: constant A is defined in terms of itself",
+		"<buffer>:5:6: error: constant C redefined (previous definition at <buffer>:4)",
+		"<buffer>:6:1: error: unknown directive: .eq",
+		"<buffer>:7:1: error: .equ wanted a name and a value: .equ D",
+	}
+	_, err = CompileSourceFromBuffer(false, []string{"push A", ".equ A B", ".define B A", ".equ C 1", ".equ C 2", ".eq", ".equ D"})
+	for _, want := range expected {
+		assert(t, err != nil && strings.Contains(err.Error(), want), "Missing diagnostic %q in:\n%v", want, err)
+	}
+}
+
+func TestExpressions(t *testing.T) {
+	program, err := CompileSourceFromBuffer(false, strings.Split(expressionsTest, "\n"))
+	assert(t, err == nil, "Failed to compile: %s", err)
+
+	expected := []uint32{
+		reservedBytes + instructionBytes + 16, 32, 8, 5, 0xFF00, math.MaxUint32, uint32(-8 & math.MaxUint32), 6, 'A' + 1, math.Float32bits(1.5),
+	}
+	for i, want := range expected {
+		assert(t, program.instructions[i].arg == want, "Instruction %d: expected %d but got %d", i, want, program.instructions[i].arg)
+	}
+	assert(t, program.instructions[len(expected)].register == 4 && program.instructions[len(expected)].arg == 3, "Unexpected register instruction")
+
+	expectedErrors := []string{
+		"<buffer>:1:15: error: division by zero in expression",
+		"<buffer>:2:7: error: value 4294967296 does not fit in 32 bits",
+		"<buffer>:3:14: error: undefined symbol: missing",
+		"<buffer>:4:7: error: unbalanced parentheses",
+		"<buffer>:5:25: error: overflow in expression",
+		"<buffer>:7:7: error: floating point constant F can't be used in an expression",
+		"<buffer>:8:11: error: too many or invalid type of arguments to instruction: const 1 + 2",
+	}
+	_, err = CompileSourceFromBuffer(false, []string{
+		"const ((1 + 2)/0)",
+		"const 0xFFFFFFFF+1",
+		".equ BAD 1 + missing",
+		"const (1+(2*3)",
+		"const 0x7FFFFFFFFFFFFFFF+1",
+		".equ F 1.5",
+		"const F+1",
+		"const 1 + 2",
+		"const BAD",
+	})
+	var diagnostics Diagnostics
+	assert(t, errors.As(err, &diagnostics), "Expected assembling to fail with diagnostics: %v", err)
+	for _, want := range expectedErrors {
+		assert(t, strings.Contains(err.Error(), want), "Missing diagnostic %q in:\n%v", want, err)
+	}
+	assert(t, len(diagnostics) == len(expectedErrors), "Expected %d diagnostics but got %d:\n%s", len(expectedErrors), len(diagnostics), diagnostics)
+}
+
+func TestDataSection(t *testing.T) {
+	program, err := CompileSourceFromBuffer(false, strings.Split(dataTest, "\n"))
+	assert(t, err == nil, "Failed to compile: %s", err)
+
+	expected := &bytes.Buffer{}
+	expected.WriteString("hi\n\x00")
+	for _, v := range []uint32{1, 34, math.MaxUint32, math.Float32bits(1.5), math.Float32bits(3.25), math.Float32bits(2)} {
+		word := make([]byte, 4)
+		uint32ToBytes(v, word)
+		expected.Write(word)
+	}
+	expected.Write([]byte{'a', 255, 255, 7, 7, 7})
+	assert(t, bytes.Equal(program.data, expected.Bytes()), "Unexpected static data: %v", program.data)
+
+	// Labels in the .data section point to where the data is placed after the instructions
+	dataAddr := reservedBytes + uint32(len(program.instructions))*instructionBytes
+	assert(t, program.instructions[0].arg == dataAddr+8, "Unexpected data label address: %d", program.instructions[0].arg)
+
+	vm, err := NewVirtualMachine(program)
+	assert(t, err == nil, "Failed to create new VM: %s", err)
+	vm.RunProgram()
+	assert(t, vm.registers[4] == 34 && vm.registers[5] == 'i', "Unexpected register values: %d %d", vm.registers[4], vm.registers[5])
+
+	// Static data should survive being disassembled and reassembled
+	source := &strings.Builder{}
+	assert(t, program.Disassemble(source) == nil, "Failed to disassemble program")
+	reassembled, err := CompileSourceFromBuffer(false, strings.Split(source.String(), "\n"))
+	assert(t, err == nil, "Failed to reassemble disassembled program: %s", err)
+	assert(t, reflect.DeepEqual(program.instructions, reassembled.instructions) && bytes.Equal(program.data, reassembled.data),
+		"Reassembled program does not match original:\n%s", source)
+
+	expectedErrors := []string{
+		"<buffer>:1:1: error: .byte is only allowed in the .data section",
+		"<buffer>:4:1: error: instructions are only allowed in the .text section: const 1",
+		"<buffer>:5:7: error: value 256 does not fit in 8 bits",
+		"<buffer>:6:8: error: alignment 3 is not a power of 2",
+		"<buffer>:7:8: error: value depends on an address that isn't known until the program is linked",
+		"<buffer>:8:8: error: .ascii wanted a string: .ascii hi",
+	}
+	_, err = CompileSourceFromBuffer(false, []string{
+		".byte 1",
+		".data",
+		"earlier:",
+		"const 1",
+		".byte 256",
+		".align 3",
+		".space earlier",
+		".ascii hi",
+	})
+	for _, want := range expectedErrors {
+		assert(t, err != nil && strings.Contains(err.Error(), want), "Missing diagnostic %q in:\n%v", want, err)
+	}
+}
+
+func TestMacros(t *testing.T) {
+	program, err := CompileSourceFromBuffer(true, strings.Split(macroTest, "\n"))
+	assert(t, err == nil, "Failed to compile: %s", err)
+
+	// Each expansion gets its own copy of the labels in the macro
+	loops := 0
+	for _, source := range program.debugSymMap {
+		if strings.HasPrefix(source, "raddi") {
+			loops++
+		}
+	}
+	assert(t, loops == 3, "Expected 3 expanded loops but got %d", loops)
+	assert(t, program.debugSymMap[int(reservedBytes)] == "const 3 // countdown (<buffer>:15)", "Unexpected debug symbol: %q", program.debugSymMap[int(reservedBytes)])
+
+	vm, err := NewVirtualMachine(program, WithDebugSymbols(false))
+	assert(t, err == nil, "Failed to create new VM: %s", err)
+	runAndEnsureSpecificShutdown(t, vm, ErrSystemShutdown)
+
+	_, err = CompileSourceFromBuffer(false, []string{
+		".macro push2 a b",
+		"    const a",
+		"    consts b",
+		".endm",
+		".macro outer",
+		"    push2 1 2",
+		".endm",
+		"    outer",
+		"    push2 1",
+		".macro forever",
+		"    forever",
+		".endm",
+		"    forever",
+		".macro bad a,,b",
+		".endm",
+		"    bad 1 2",
+		"    bad",
+		"    push2 1,,2",
+		".macro unterminated",
+	})
+	expected := []string{
+		"<buffer>:3:5: error: unknown bytecode: consts\n    in expansion of macro push2 at <buffer>:6\n    in expansion of macro outer at <buffer>:8",
+		"<buffer>:9:5: error: macro push2 wanted 2 args but got 1",
+		"<buffer>:11:5: error: macro expansion of forever is nested too deeply (max depth 64)",
+		"<buffer>:14:12: error: invalid macro parameter list: .macro bad a,,b",
+		"<buffer>:18:11: error: invalid macro argument list: push2 1,,2",
+		"<buffer>:19: error: macro unterminated is missing .endm",
+	}
+	var diagnostics Diagnostics
+	assert(t, errors.As(err, &diagnostics), "Expected assembling to fail with diagnostics: %v", err)
+	// Uses of a macro with a bad parameter list don't report anything else
+	assert(t, len(diagnostics) == len(expected), "Expected %d diagnostics but got %d:\n%s", len(expected), len(diagnostics), diagnostics)
+	for i, want := range expected {
+		assert(t, strings.HasPrefix(diagnostics[i].String(), want), "Expected diagnostic %q but got %q", want, diagnostics[i])
+	}
+
+	// Parameters and arguments can be separated by commas
+	program, err = CompileSourceFromBuffer(false, []string{
+		".macro store3 reg, value ,offset",
+		"    const value",
+		"    const offset",
+		"    addi",
+		"    rstore reg",
+		".endm",
+		"    store3 3 40 2",
+		"    store3 4, 40, 3",
+		"    halt",
+	})
+	assert(t, err == nil, "Failed to compile: %s", err)
+	vm, err = NewVirtualMachine(program)
+	assert(t, err == nil, "Failed to create new VM: %s", err)
+	result := vm.Run(context.Background(), RunLimits{StopOnHalt: true})
+	assert(t, result.Reason == StopHalted && vm.registers[3] == 42 && vm.registers[4] == 43, "Unexpected result %s with registers 3 = %d and 4 = %d", result, vm.registers[3], vm.registers[4])
+}
+
+func TestLabels(t *testing.T) {
+	program, err := CompileSourceFromBuffer(false, strings.Split(labelsTest, "\n"))
+	assert(t, err == nil, "Failed to compile: %s", err)
+
+	// Local labels belong to the global label before them and numeric labels refer to the closest
+	// definition in the given direction
+	expected := []uint32{8, 16, 16, 24, 40, 8}
+	for i, offset := range expected {
+		instr := program.instructions[i]
+		assert(t, instr.arg == reservedBytes+offset, "Unexpected jump target for %s: wanted %d", instr, reservedBytes+offset)
+	}
+
+	// Each expansion of a macro gets its own copy of its local labels
+	_, err = CompileSourceFromBuffer(false, []string{
+		".macro spin",
+		".again:",
+		"    jmp .again",
+		".endm",
+		"main:",
+		"    spin",
+		"    spin",
+	})
+	assert(t, err == nil, "Failed to compile: %s", err)
+
+	_, err = CompileSourceFromBuffer(false, []string{
+		".early:",
+		"main:",
+		"    jmp 1b",
+		"    jmp 2f",
+		".loop:",
+		".loop:",
+		"main:",
+		"    jmp .missing",
+	})
+	expectedErrors := []string{
+		"<buffer>:1:1: error: local label .early is not inside of a global label",
+		"<buffer>:3:9: error: no numeric label 1: before 1b",
+		"<buffer>:4:9: error: no numeric label 2: after 2f",
+		"<buffer>:6:1: error: label .loop redefined (previous definition at <buffer>:5)",
+		"<buffer>:7:1: error: label main redefined (previous definition at <buffer>:2)",
+		"<buffer>:8:9: error: undefined symbol: .missing (in scope main)",
+	}
+	for _, want := range expectedErrors {
+		assert(t, err != nil && strings.Contains(err.Error(), want), "Missing diagnostic %q in:\n%v", want, err)
+	}
+}
+
+func TestOptimizer(t *testing.T) {
+	program, err := (&Assembler{Optimize: true}).CompileBuffer(strings.Split(optimizeTest, "\n"))
+	assert(t, err == nil, "Failed to compile: %s", err)
+	expected, err := CompileSourceFromBuffer(false, strings.Split(optimizedTest, "\n"))
+	assert(t, err == nil, "Failed to compile: %s", err)
+
+	// Labels and addresses (including the ones in .data) should have moved along with the instructions
+	assert(t, reflect.DeepEqual(program.instructions, expected.instructions), "Unexpected optimized instructions: %v", program.instructions)
+	assert(t, bytes.Equal(program.data, expected.data), "Addresses in .data were not updated: %v", program.data)
+
+	report := program.OptimizationReport()
+	assert(t, report.InstructionsBefore == 20 && report.InstructionsAfter == 15, "Unexpected instruction counts: %d -> %d", report.InstructionsBefore, report.InstructionsAfter)
+	expectedReport := []string{
+		"20 instructions -> 15 instructions, fused const x2, removed nop x1, removed dead code x1, threaded jump x2",
+		"<buffer>:3: fused const: const 3; addi",
+		"<buffer>:7: fused const: const 2; raddi 3",
+		"<buffer>:14: threaded jump: jmp first now jumps directly to done",
+		"<buffer>:18: threaded jump: jmp second now jumps directly to done",
+		"<buffer>:15: removed dead code: 2 unreachable instruction(s) starting with const 99",
+		"<buffer>:6: removed nop: nop",
+	}
+	assert(t, report.String() == strings.Join(expectedReport, "\n"), "Unexpected report:\n%s", report)
+
+	vm, err := NewVirtualMachine(program)
+	assert(t, err == nil, "Failed to create new VM: %s", err)
+	runAndEnsureSpecificShutdown(t, vm, ErrSystemShutdown)
+	assert(t, vm.registers[3] == 10 && vm.registers[4] == 9, "Unexpected register values: %d %d", vm.registers[3], vm.registers[4])
+
+	// const X is only fused with the instructions that use X the same way as an argument
+	for _, tc := range []struct {
+		source    string
+		optimized string
+	}{
+		{"const 1\nconst 0\npick", "const 1\npick 0"},
+		{"const 2\nneg\nconst 3\nitof", "neg 2\nitof 3"},
+		{"const 1\nsar\nconst 4\ndivu\nconst 4\ndivs", "const 1\nsar\nconst 4\ndivu\nconst 4\ndivs"},
+	} {
+		program, err := (&Assembler{Optimize: true}).CompileBuffer(strings.Split(tc.source, "\n"))
+		assert(t, err == nil, "Failed to compile: %s", err)
+		expected, err := CompileSourceFromBuffer(false, strings.Split(tc.optimized, "\n"))
+		assert(t, err == nil, "Failed to compile: %s", err)
+		assert(t, reflect.DeepEqual(program.instructions, expected.instructions), "Unexpected optimized instructions for %q: %v", tc.source, program.instructions)
+	}
+
+	// nops (including the ones debug mode adds for labels) are kept in debug mode so breakpoints can still
+	// be set on them
+	program, err = (&Assembler{Optimize: true, Debug: true}).CompileBuffer(strings.Split(optimizeTest, "\n"))
+	assert(t, err == nil, "Failed to compile: %s", err)
+	nops := 0
+	for _, instr := range program.instructions {
+		if instr.bytecode() == Nop {
+			nops++
+		}
+	}
+	assert(t, nops == 4 && program.instructions[3].bytecode() == Nop, "Debug build should keep nops: %v", program.instructions)
+	assert(t, program.debugSymMap[int(reservedBytes)+8] == "const 3; addi", "Debug symbols not moved with instructions: %v", program.debugSymMap)
+
+	// Runtime and examples should behave the same when optimized
+	stdout := &strings.Builder{}
+	program, err = (&Assembler{Optimize: true}).CompileFiles("../examples/helloworld.b")
+	assert(t, err == nil, "Failed to compile: %s", err)
+	vm, err = NewVirtualMachine(program, WithStdout(stdout))
+	assert(t, err == nil, "Failed to create new VM: %s", err)
+	runAndEnsureSpecificShutdown(t, vm, ErrSystemShutdown)
+	assert(t, stdout.String() == "Hello world!\n", "Unexpected program output: %q", stdout.String())
+}
+
+func TestLexLine(t *testing.T) {
+	tests := []struct {
+		text   string
+		fields []sourceField
+	}{
+		{"  const 5 // comment", []sourceField{{"const", 3}, {"5", 9}}},
+		{"const \"a // b\" // comment", []sourceField{{"const", 1}, {"\"a // b\"", 7}}},
+		{"const '/' // comment", []sourceField{{"const", 1}, {"'/'", 7}}},
+		{"raddi 4 (N + 1)", []sourceField{{"raddi", 1}, {"4", 7}, {"(N + 1)", 9}}},
+		{".asciz \"say \\\"hi\\\"\"", []sourceField{{".asciz", 1}, {"\"say \\\"hi\\\"\"", 8}}},
+		{"const ' '", []sourceField{{"const", 1}, {"' '", 7}}},
+		{"// only a comment", nil},
+	}
+	for _, test := range tests {
+		lexed := lexLine(test.text)
+		assert(t, reflect.DeepEqual(lexed.fields, test.fields), "Unexpected fields for %q: %v", test.text, lexed.fields)
+		assert(t, lexed.unterminated == 0, "Unexpected unterminated string in %q", test.text)
+	}
+
+	lexed := lexLine("  const \"abc")
+	assert(t, lexed.unterminated == 9, "Expected unterminated string at column 9 but got %d", lexed.unterminated)
+
+	// Labels are looked up by their exact name, so one label being a prefix of another doesn't matter
+	program, err := CompileSourceFromBuffer(false, []string{
+		"loop:",
+		"    jmp loop2",
+		"loop2:",
+		"    jmp loop",
+		"    const \"a//b\" // comment",
+	})
+	assert(t, err == nil, "Failed to compile: %s", err)
+	assert(t, program.instructions[0].arg == reservedBytes+8 && program.instructions[1].arg == reservedBytes, "Labels resolved to the wrong addresses: %v", program.instructions[:2])
+	assert(t, len(program.instructions) == 6, "Expected a string with // in it to be kept whole: %v", program.instructions)
+
+	// Columns of later arguments aren't affected by local label names being expanded
+	_, err = CompileSourceFromBuffer(false, []string{"main:", ".reg:", "    raddi .reg missing"})
+	want := "<buffer>:3:16: error: undefined symbol: missing"
+	assert(t, err != nil && err.Error() == want, "Expected %q but got %v", want, err)
+}
+
+// Assembles a generated program with lots of labels, local labels and numeric labels
+func BenchmarkCompileSourceFromBuffer(b *testing.B) {
+	const functions = 2000
+	lines := make([]string, 0, functions*10)
+	for i := 0; i < functions; i++ {
+		lines = append(lines,
+			fmt.Sprintf("function%d:", i),
+			"    const 10",
+			"    rstore 4",
+			".loop:",
+			"    raddi 4 -1",
+			"    jnz .loop",
+			"    jmp 1f",
+			"1:",
+			fmt.Sprintf("    call function%d", (i+1)%functions),
+			"    return",
+		)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := CompileSourceFromBuffer(false, lines); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestIncludes(t *testing.T) {
+	// A program that imports the runtime doesn't need it listed separately
+	stdout := &strings.Builder{}
+	vm := compileAndCheckWithOptions(t, []string{"../examples/helloworld.b"}, []VMOption{WithStdout(stdout)})
+	runAndEnsureSpecificShutdown(t, vm, ErrSystemShutdown)
+	assert(t, stdout.String() == "Hello world!\n", "Unexpected program output: %q", stdout.String())
+
+	// Listing the runtime first still works since .import skips files that were already assembled
+	withRuntime, err := CompileSource(false, "../examples/runtime.b", "../examples/helloworld.b")
+	assert(t, err == nil, "Failed to compile: %s", err)
+	alone, err := CompileSource(false, "../examples/helloworld.b")
+	assert(t, err == nil, "Failed to compile: %s", err)
+	assert(t, reflect.DeepEqual(withRuntime, alone), "Runtime was assembled more than once")
+
+	dir := t.TempDir()
+	libDir := filepath.Join(dir, "lib")
+	assert(t, os.Mkdir(libDir, 0755) == nil, "Failed to create directory")
+	files := map[string]string{
+		filepath.Join(libDir, "counter.b"): ".data\ncounter:\n.word 0\n",
+		filepath.Join(libDir, "nop.b"):     "nop\n",
+		filepath.Join(dir, "main.b"):       ".import \"counter.b\"\n.import \"counter.b\"\n.include \"nop.b\"\n.include \"nop.b\"\nconst counter\n",
+		filepath.Join(dir, "cycle1.b"):     ".include \"cycle2.b\"\n",
+		filepath.Join(dir, "cycle2.b"):     "nop\n.include \"cycle1.b\"\n",
+	}
+	for name, contents := range files {
+		assert(t, os.WriteFile(name, []byte(contents), 0644) == nil, "Failed to write %s", name)
+	}
+
+	// Files are found through the include paths, .import only assembles a file once and .include
+	// assembles it every time
+	assembler := &Assembler{IncludePaths: []string{libDir}}
+	program, err := assembler.CompileFiles(filepath.Join(dir, "main.b"))
+	assert(t, err == nil, "Failed to compile: %s", err)
+	assert(t, len(program.instructions) == 3 && len(program.data) == 4, "Unexpected program size: %d instructions, %d bytes of data", len(program.instructions), len(program.data))
+
+	_, err = (&Assembler{}).CompileFiles(filepath.Join(dir, "main.b"))
+	assert(t, err != nil && strings.Contains(err.Error(), "main.b:1:9: error: could not find counter.b"), "Expected missing include error: %v", err)
+
+	_, err = CompileSource(false, filepath.Join(dir, "cycle1.b"))
+	want := fmt.Sprintf("cycle2.b:2:1: error: include cycle: %s -> %s -> %s", filepath.Join(dir, "cycle1.b"), filepath.Join(dir, "cycle2.b"), filepath.Join(dir, "cycle1.b"))
+	assert(t, err != nil && strings.HasSuffix(err.Error(), want), "Expected include cycle error %q: %v", want, err)
+}
+
 func TestVM(t *testing.T) {
 	vm := compileAndCheck(t, "../examples/poweroff.b")
-	runAndEnsureSpecificShutdown(t, vm, errSystemShutdown)
+	runAndEnsureSpecificShutdown(t, vm, ErrSystemShutdown)
 
 	vm = compileAndCheck(t, "../examples/runtime.b", "../examples/loop.b")
-	runAndEnsureSpecificShutdown(t, vm, errSystemShutdown)
+	runAndEnsureSpecificShutdown(t, vm, ErrSystemShutdown)
 
 	vm = compileAndCheck(t, "../examples/runtime.b", "../examples/helloworld.b")
-	runAndEnsureSpecificShutdown(t, vm, errSystemShutdown)
+	runAndEnsureSpecificShutdown(t, vm, ErrSystemShutdown)
 
 	vm = compileAndCheckSource(t, divByZeroTest1)
-	runAndEnsureSpecificShutdown(t, vm, errDivisionByZero)
+	runAndEnsureSpecificShutdown(t, vm, ErrDivisionByZero)
 
 	vm = compileAndCheckSource(t, divByZeroTest2)
-	runAndEnsureSpecificShutdown(t, vm, errDivisionByZero)
+	runAndEnsureSpecificShutdown(t, vm, ErrDivisionByZero)
 
 	vm = compileAndCheckSource(t, divByZeroTest3)
-	runAndEnsureSpecificShutdown(t, vm, errDivisionByZero)
+	runAndEnsureSpecificShutdown(t, vm, ErrDivisionByZero)
 
 	vm = compileAndCheckSource(t, stackOverflowTest)
-	runAndEnsureSpecificShutdown(t, vm, errSegmentationFault)
+	runAndEnsureSpecificShutdown(t, vm, ErrSegmentationFault)
 
 	vm = compileAndCheckSource(t, illegalInstrTest)
-	runAndEnsureSpecificShutdown(t, vm, errIllegalInstruction)
+	runAndEnsureSpecificShutdown(t, vm, ErrIllegalInstruction)
 
 	vm = compileAndCheckSource(t, unknownInstrTest)
-	runAndEnsureSpecificShutdown(t, vm, errUnknownInstruction)
+	runAndEnsureSpecificShutdown(t, vm, ErrUnknownInstruction)
 
 	vm = compileAndCheckSource(t, errIOTest)
-	runAndEnsureSpecificShutdown(t, vm, errIO)
+	runAndEnsureSpecificShutdown(t, vm, ErrIO)
 
 	vm = compileAndCheckSource(t, deviceCheck)
-	runAndEnsureSpecificShutdown(t, vm, errSystemShutdown)
+	runAndEnsureSpecificShutdown(t, vm, ErrSystemShutdown)
 
 	vm = compileAndCheckSource(t, memoryAddressSanityCheck1)
-	runAndEnsureSpecificShutdown(t, vm, errSystemShutdown)
+	runAndEnsureSpecificShutdown(t, vm, ErrSystemShutdown)
 
 	vm = compileAndCheckSource(t, memoryAddressSanityCheck2)
-	runAndEnsureSpecificShutdown(t, vm, errSegmentationFault)
+	runAndEnsureSpecificShutdown(t, vm, ErrSegmentationFault)
+}
+
+// Runs examples/loop.b (50M iterations of a 2 instruction loop) with and without the instruction cache
+func BenchmarkLoop(b *testing.B) {
+	program, err := CompileSource(false, "../examples/runtime.b", "../examples/loop.b")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, enabled := range []bool{true, false} {
+		b.Run(fmt.Sprintf("cache=%v", enabled), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				vm, err := NewVirtualMachine(program, WithInstructionCache(enabled), WithStdout(io.Discard))
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				if err := vm.RunProgram(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
 }